@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"time"
+)
+
+// Cache DNS响应缓存接口。DNSCache为默认的内存实现，也可替换为外部缓存（如Redis）以便多个实例共享
+type Cache interface {
+	// Get 获取请求对应的缓存响应，未命中时返回nil。返回的响应可能与缓存共享记录，调用方修改前需先复制
+	Get(request *dns.Msg) *dns.Msg
+	// Set 缓存请求对应的响应，由实现决定缓存时长及是否缓存
+	Set(request *dns.Msg, r *dns.Msg)
+	// Delete 删除请求对应的缓存
+	Delete(request *dns.Msg)
+	// Len 返回缓存条目数量（可包括已过期条目）
+	Len() int
+}
+
+// TTLSetter 可按指定的缓存时长范围缓存响应的缓存，用于按组覆盖min_ttl、max_ttl
+type TTLSetter interface {
+	// SetTTL 同Set，但使用minTTL、maxTTL代替缓存的默认范围，不大于0的值沿用默认范围
+	SetTTL(request, r *dns.Msg, minTTL, maxTTL time.Duration)
+}
+
+// EntryLister 可列出缓存条目快照的缓存，管理接口的/cache依赖该接口
+type EntryLister interface {
+	Entries() []Entry
+}
+
+// StatsReporter 可报告统计数据的缓存，管理接口的/cache/stats依赖该接口
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// Stats 缓存的统计数据，用于观察缓存压力
+type Stats struct {
+	Size      int    `json:"size"`      // 当前条目数（包括未清理的过期条目）
+	Capacity  int    `json:"capacity"`  // 条目数上限
+	Bytes     int    `json:"bytes"`     // 未过期条目的估算内存占用（按缓存key及响应报文的长度计算）
+	Evictions uint64 `json:"evictions"` // 因过期被清除的条目数
+	Rejected  uint64 `json:"rejected"`  // 因缓存已满而未写入的响应数
+}
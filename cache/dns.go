@@ -2,102 +2,397 @@ package cache
 
 import (
 	"fmt"
+	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
 	"math/rand"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // 获取dns请求或响应extra中的subnet字符串，格式为"Address/SourceNetmask"
 func getSubnet(extra []dns.RR) string {
-	for _, extra := range extra {
-		switch extra.(type) {
-		case *dns.OPT:
-			for _, opt := range extra.(*dns.OPT).Option {
-				switch opt.(type) {
-				case *dns.EDNS0_SUBNET:
-					subOpt := opt.(*dns.EDNS0_SUBNET)
-					return fmt.Sprintf("%s/%d", subOpt.Address, subOpt.SourceNetmask)
-				}
-			}
-		}
+	if subOpt := getECS(extra); subOpt != nil {
+		return fmt.Sprintf("%s/%d", subOpt.Address, subOpt.SourceNetmask)
 	}
 	return ""
 }
 
-// DNSCache DNS响应缓存器
+// 生成dns请求对应的缓存key，包含域名、请求类型、请求类（非IN时）、CD标志位及ECS子网
+func cacheKey(request *dns.Msg) string {
+	key := baseKey(request)
+	if subnet := getSubnet(request.Extra); subnet != "" {
+		key += "." + subnet
+	}
+	return key
+}
+
+// 生成不含ECS子网的缓存key
+func baseKey(request *dns.Msg) string {
+	question := request.Question[0]
+	key := question.Name + strconv.FormatInt(int64(question.Qtype), 10)
+	if question.Qclass != dns.ClassINET { // CHAOS等非IN类请求的响应与IN类不同
+		key += ".c" + strconv.FormatInt(int64(question.Qclass), 10)
+	}
+	if request.CheckingDisabled { // 客户端自行验证DNSSEC时上游响应可能不同
+		key += ".cd"
+	}
+	return key
+}
+
+// Key 返回dns请求对应的缓存key，请求相同（域名、类型、类、CD标志位、ECS子网均相同）时key相同
+func Key(request *dns.Msg) string {
+	return cacheKey(request)
+}
+
+// 全局随机数生成器只在启动时设置种子，每次打乱记录时重新设置的开销远大于打乱本身
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// 随机打乱A/AAAA记录的顺序，其它记录（CNAME、SRV、MX等）的位置和顺序保持不变
+func shuffleAddrs(answer []dns.RR) {
+	var buf [16]int // 多数响应的A/AAAA记录不超过16条，避免分配
+	idx := buf[:0]
+	for i, rr := range answer {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			idx = append(idx, i)
+		}
+	}
+	for i := len(idx) - 1; i > 0; i-- { // Fisher-Yates，同rand.Shuffle
+		j := rand.Intn(i + 1)
+		answer[idx[i]], answer[idx[j]] = answer[idx[j]], answer[idx[i]]
+	}
+}
+
+// 缓存时长策略，由DNSCache、RedisCache共用
+type ttlPolicy struct {
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	FailTTL time.Duration // SERVFAIL响应的缓存时间，不大于0时不缓存SERVFAIL
+	Jitter  int           // ttl随机浮动的百分比（±Jitter%），避免大量缓存同时过期，不大于0时不浮动
+	KeepTTL bool          // 为true时响应的ttl为上游ttl的倒计时（不低于0），否则为缓存时长的倒计时
+}
+
+// 判断记录中的DNSSEC签名是否不完整：存在RRSIG记录，但有RRset没有对应的RRSIG。不含RRSIG的记录视为未签名
+func signatureIncomplete(rrs []dns.RR) bool {
+	type rrset struct {
+		name   string
+		rrtype uint16
+	}
+	signed, sets := map[rrset]bool{}, map[rrset]bool{}
+	for _, rr := range rrs {
+		header := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			signed[rrset{strings.ToLower(header.Name), sig.TypeCovered}] = true
+		} else {
+			sets[rrset{strings.ToLower(header.Name), header.Rrtype}] = true
+		}
+	}
+	if len(signed) == 0 {
+		return false
+	}
+	for set := range sets {
+		if !signed[set] {
+			return true
+		}
+	}
+	return false
+}
+
+// 计算响应的缓存时长，由minTTL、maxTTL、响应本身的ttl共同决定，SERVFAIL响应固定为FailTTL。不大于0时代表不缓存。
+// 被截断（TC）及DNSSEC签名不完整的响应不缓存，避免影响进行DNSSEC验证的客户端
+func (policy *ttlPolicy) expire(r *dns.Msg) time.Duration {
+	if r.Truncated || signatureIncomplete(r.Answer) {
+		return 0
+	}
+	if r.Rcode == dns.RcodeServerFailure { // 短暂缓存SERVFAIL，避免上游故障时被反复请求
+		return policy.FailTTL
+	}
+	if len(r.Answer) <= 0 {
+		return 0
+	}
+	var ex = policy.maxTTL
+	for _, answer := range r.Answer {
+		if ttl := time.Duration(answer.Header().Ttl) * time.Second; ttl < ex {
+			ex = ttl
+		}
+	}
+	return policy.jitter(policy.clamp(ex))
+}
+
+// DNSCache DNS响应缓存器，Cache接口的默认内存实现。上游响应携带ECS时按其SCOPE PREFIX-LENGTH（RFC 7871）缓存，
+// 同一作用范围内的客户端子网共享缓存，不同子网的客户端互不影响
 type DNSCache struct {
-	ttlMap *TTLMap
-	size   int
-	minTTL time.Duration
-	maxTTL time.Duration
+	rejected uint64 // 因缓存已满而未写入的响应数，置于首位以保证32位平台上原子操作的对齐
+	ttlPolicy
+	ttlMap   *TTLMap
+	size     int
+	scopes   *TTLMap // 不含ECS子网的缓存key -> 出现过的ECS作用范围（[]uint8，从大到小）
+	scopeMux sync.Mutex
 }
 
 // dns响应的包裹，用以实现动态ttl
 type cacheEntry struct {
-	r      *dns.Msg
-	expire time.Time
+	r        *dns.Msg
+	expire   time.Time
+	stored   time.Time // 写入缓存的时间，keepTTL为true时用于计算上游ttl的倒计时
+	keepTTL  bool
+	question dns.Question
+	subnet   string
+}
+
+// Entry 缓存条目的快照，用于调试
+type Entry struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Subnet  string `json:"subnet,omitempty"`
+	TTL     int64  `json:"ttl"`
+	Records int    `json:"records"`
 }
 
 func (entry *cacheEntry) Get() *dns.Msg {
+	now := time.Now()
 	var ttl int64
-	if ttl = entry.expire.Unix() - time.Now().Unix(); ttl < 0 {
+	if ttl = entry.expire.Unix() - now.Unix(); ttl < 0 {
 		return nil
 	}
-	r := entry.r.Copy()
+	r := entry.copy()
+	elapsed := uint32(now.Unix() - entry.stored.Unix())
 	for i := 0; i < len(r.Answer); i++ {
-		r.Answer[i].Header().Ttl = uint32(ttl)
+		header := r.Answer[i].Header()
+		switch {
+		case !entry.keepTTL:
+			header.Ttl = uint32(ttl)
+		case header.Ttl > elapsed:
+			header.Ttl -= elapsed
+		default:
+			header.Ttl = 0
+		}
 	}
 	return r
 }
 
-// Get 获取DNS响应缓存，响应的ttl为倒计时形式
+// 返回缓存响应的副本，复制各section中的记录（Pack时会改写OPT记录，并发命中时不能共享），Question与缓存共享，
+// 切片的容量与长度相同，调用方追加内容时会重新分配，不影响缓存
+func (entry *cacheEntry) copy() *dns.Msg {
+	cached := entry.r
+	r := &dns.Msg{MsgHdr: cached.MsgHdr, Compress: cached.Compress}
+	r.Question = cached.Question[:len(cached.Question):len(cached.Question)]
+	r.Answer, r.Ns, r.Extra = copyRRs(cached.Answer), copyRRs(cached.Ns), copyRRs(cached.Extra)
+	return r
+}
+
+// 复制记录列表，rrs为nil时返回nil
+func copyRRs(rrs []dns.RR) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	copied := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copied[i] = copyRR(rr)
+	}
+	return copied
+}
+
+// 复制记录，A/AAAA记录只复制记录本身，与缓存共享ip
+func copyRR(rr dns.RR) dns.RR {
+	switch rr := rr.(type) {
+	case *dns.A:
+		a := *rr
+		return &a
+	case *dns.AAAA:
+		aaaa := *rr
+		return &aaaa
+	}
+	return dns.Copy(rr)
+}
+
+// Get 获取DNS响应缓存，响应的ttl为倒计时形式。cache为nil时代表禁用缓存，始终返回nil。
+// 响应的Question及A/AAAA记录的ip与缓存共享，调用方修改前需先复制响应
 func (cache *DNSCache) Get(request *dns.Msg) *dns.Msg {
-	question, extra := request.Question[0], request.Extra
-	cacheKey := question.Name + strconv.FormatInt(int64(question.Qtype), 10)
-	if subnet := getSubnet(extra); subnet != "" {
-		cacheKey += "." + subnet
-	}
-	if cacheHit, ok := cache.ttlMap.Get(cacheKey); ok {
-		r := cacheHit.(*cacheEntry).Get()
-		rand.Seed(time.Now().UnixNano()) // random record order
-		rand.Shuffle(len(r.Answer), func(i, j int) {
-			r.Answer[i], r.Answer[j] = r.Answer[j], r.Answer[i]
-		})
-		return r
+	if cache == nil {
+		return nil
+	}
+	// 优先查找按ECS作用范围缓存的响应，其次查找按请求子网缓存的响应
+	for _, key := range cache.scopedKeys(request) {
+		if r := cache.get(key); r != nil {
+			return r
+		}
+	}
+	return cache.get(cacheKey(request))
+}
+
+// 查找key对应的未过期缓存，并随机打乱A/AAAA记录的顺序
+func (cache *DNSCache) get(key string) *dns.Msg {
+	if cacheHit, ok := cache.ttlMap.Get(key); ok {
+		if r := cacheHit.(*cacheEntry).Get(); r != nil {
+			shuffleAddrs(r.Answer) // random record order
+			return r
+		}
 	}
 	return nil
 }
 
-// Set 设置DNS响应缓存，缓存的ttl由minTTL、maxTTL、响应本身的ttl共同决定
+// Set 设置DNS响应缓存，缓存的ttl由minTTL、maxTTL、响应本身的ttl共同决定。SERVFAIL响应的ttl固定为FailTTL。
+// 未启用KeepTTL时会将r中记录的ttl改写为缓存时长。cache为nil时不做任何操作
 func (cache *DNSCache) Set(request *dns.Msg, r *dns.Msg) {
-	question, extra := request.Question[0], request.Extra
-	if cache.ttlMap.Len() >= cache.size || r == nil || len(r.Answer) <= 0 {
+	if cache == nil {
 		return
 	}
-	cacheKey := question.Name + strconv.FormatInt(int64(question.Qtype), 10)
-	if subnet := getSubnet(extra); subnet != "" {
-		cacheKey += "." + subnet
+	cache.set(request, r, &cache.ttlPolicy)
+}
+
+// SetTTL 同Set，但使用minTTL、maxTTL代替NewDNSCache指定的范围，不大于0的值沿用原有范围
+func (cache *DNSCache) SetTTL(request, r *dns.Msg, minTTL, maxTTL time.Duration) {
+	if cache == nil {
+		return
 	}
-	var ex = cache.maxTTL
-	for _, answer := range r.Answer {
-		if ttl := time.Duration(answer.Header().Ttl) * time.Second; ttl < ex {
-			ex = ttl
+	cache.set(request, r, cache.within(minTTL, maxTTL))
+}
+
+// 按policy计算缓存时长并写入缓存
+func (cache *DNSCache) set(request, r *dns.Msg, policy *ttlPolicy) {
+	if r == nil || cache.full() {
+		return
+	}
+	ex := policy.expire(r)
+	if ex <= 0 {
+		return
+	}
+	if r.Rcode != dns.RcodeServerFailure && !cache.KeepTTL {
+		for i := 0; i < len(r.Answer); i++ {
+			r.Answer[i].Header().Ttl = uint32(ex.Seconds())
 		}
 	}
-	if ex < cache.minTTL {
-		ex = cache.minTTL
+	entry := newCacheEntry(request, r, ex, cache.KeepTTL)
+	if scope, ok := responseScope(request, r); ok {
+		entry.subnet = maskSubnet(getECS(request.Extra), scope)
+		cache.ttlMap.Set(scopedKey(request, scope), entry, ex)
+		cache.addScope(request, scope, ex)
+		return
 	}
-	for i := 0; i < len(r.Answer); i++ {
-		r.Answer[i].Header().Ttl = uint32(ex.Seconds())
+	cache.ttlMap.Set(cacheKey(request), entry, ex)
+}
+
+// 判断缓存是否已满，已满时计入rejected，首次出现时输出警告以便调整缓存大小
+func (cache *DNSCache) full() bool {
+	if cache.ttlMap.Len() < cache.size {
+		return false
+	}
+	if atomic.AddUint64(&cache.rejected, 1) == 1 {
+		log.Warnf("dns cache is full (size %d), new responses will not be cached", cache.size)
+	}
+	return true
+}
+
+// 将ttl限制在[minTTL, maxTTL]范围内，minTTL优先
+func (policy *ttlPolicy) clamp(ttl time.Duration) time.Duration {
+	if ttl > policy.maxTTL {
+		ttl = policy.maxTTL
+	}
+	if ttl < policy.minTTL {
+		ttl = policy.minTTL
+	}
+	return ttl
+}
+
+// 返回使用minTTL、maxTTL作为缓存时长范围的策略副本，不大于0的值沿用原有范围
+func (policy *ttlPolicy) within(minTTL, maxTTL time.Duration) *ttlPolicy {
+	bounded := *policy
+	if minTTL > 0 {
+		bounded.minTTL = minTTL
+	}
+	if maxTTL > 0 {
+		bounded.maxTTL = maxTTL
 	}
-	entry := &cacheEntry{r: r, expire: time.Now().Add(ex)}
-	cache.ttlMap.Set(cacheKey, entry, ex)
+	return &bounded
+}
+
+// 对ttl做±Jitter%的随机浮动，结果取整到秒且仍在[minTTL, maxTTL]范围内
+func (policy *ttlPolicy) jitter(ttl time.Duration) time.Duration {
+	if policy.Jitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	delta := int64(ttl) * int64(policy.Jitter) / 100
+	if delta <= 0 {
+		return ttl
+	}
+	ttl += time.Duration(rand.Int63n(2*delta+1) - delta)
+	return policy.clamp(ttl.Round(time.Second))
+}
+
+// Delete 删除请求对应的缓存。cache为nil时不做任何操作
+func (cache *DNSCache) Delete(request *dns.Msg) {
+	if cache == nil {
+		return
+	}
+	for _, key := range append(cache.scopedKeys(request), cacheKey(request)) {
+		cache.ttlMap.Del(key)
+	}
+}
+
+// Len 返回缓存条目数量（包括未清理的过期条目）。cache为nil时返回0
+func (cache *DNSCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+	return cache.ttlMap.Len()
+}
+
+// Entries 获取所有未过期缓存条目的快照，按域名、类型排序
+func (cache *DNSCache) Entries() (entries []Entry) {
+	if cache == nil {
+		return nil
+	}
+	now := time.Now()
+	cache.ttlMap.Range(func(key string, value interface{}, expire time.Time) bool {
+		entry := value.(*cacheEntry)
+		entries = append(entries, Entry{
+			Name: entry.question.Name, Type: dns.Type(entry.question.Qtype).String(), Subnet: entry.subnet,
+			TTL: int64(entry.expire.Sub(now).Seconds()), Records: len(entry.r.Answer),
+		})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		if entries[i].Type != entries[j].Type {
+			return entries[i].Type < entries[j].Type
+		}
+		return entries[i].Subnet < entries[j].Subnet
+	})
+	return
+}
+
+// Stats 返回缓存的统计数据。cache为nil时返回零值
+func (cache *DNSCache) Stats() (stats Stats) {
+	if cache == nil {
+		return
+	}
+	cache.ttlMap.Range(func(key string, value interface{}, _ time.Time) bool {
+		stats.Bytes += len(key) + value.(*cacheEntry).r.Len()
+		return true
+	})
+	stats.Size, stats.Capacity = cache.ttlMap.Len(), cache.size
+	stats.Evictions, stats.Rejected = cache.ttlMap.Evicted(), atomic.LoadUint64(&cache.rejected)
+	return
+}
+
+func newCacheEntry(request, r *dns.Msg, ex time.Duration, keepTTL bool) *cacheEntry {
+	now := time.Now()
+	return &cacheEntry{r: r, expire: now.Add(ex), stored: now, keepTTL: keepTTL, question: request.Question[0],
+		subnet: getSubnet(request.Extra)}
 }
 
 // NewDNSCache 生成一个DNS响应缓存器实例
 func NewDNSCache(size int, minTTL, maxTTL time.Duration) (c *DNSCache) {
-	c = &DNSCache{size: size, minTTL: minTTL, maxTTL: maxTTL}
-	c.ttlMap = NewTTLMap(time.Minute)
+	c = &DNSCache{size: size, ttlPolicy: ttlPolicy{minTTL: minTTL, maxTTL: maxTTL}}
+	c.ttlMap, c.scopes = NewTTLMap(time.Minute), NewTTLMap(time.Minute)
 	return
 }
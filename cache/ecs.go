@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"time"
+)
+
+// 获取dns请求或响应extra中的ECS选项，不存在时返回nil
+func getECS(extra []dns.RR) *dns.EDNS0_SUBNET {
+	for _, rr := range extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			for _, option := range opt.Option {
+				if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+					return subnet
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 将ECS中的地址按前缀长度prefix截断，返回"网段地址/prefix"格式的字符串
+func maskSubnet(ecs *dns.EDNS0_SUBNET, prefix uint8) string {
+	bits := 32
+	if ecs.Family == 2 {
+		bits = 128
+	}
+	ip := ecs.Address.Mask(net.CIDRMask(int(prefix), bits))
+	return fmt.Sprintf("%s/%d", ip, prefix)
+}
+
+// 生成按响应SCOPE PREFIX-LENGTH（RFC 7871）划分的缓存key，同一网段内的客户端共享该key
+func scopedKey(request *dns.Msg, scope uint8) string {
+	return baseKey(request) + ".scope." + maskSubnet(getECS(request.Extra), scope)
+}
+
+// 返回响应对请求生效的ECS作用范围：响应未携带ECS时ok为false，SCOPE大于请求的SOURCE时按SOURCE处理
+func responseScope(request, r *dns.Msg) (scope uint8, ok bool) {
+	reqECS, respECS := getECS(request.Extra), getECS(r.Extra)
+	if reqECS == nil || respECS == nil {
+		return 0, false
+	}
+	if scope = respECS.SourceScope; scope > reqECS.SourceNetmask {
+		scope = reqECS.SourceNetmask
+	}
+	return scope, true
+}
+
+// 记录baseKey对应的响应中出现过的ECS作用范围，供Get时查找。ex为对应缓存的有效期
+func (cache *DNSCache) addScope(request *dns.Msg, scope uint8, ex time.Duration) {
+	key := baseKey(request)
+	cache.scopeMux.Lock()
+	defer cache.scopeMux.Unlock()
+	if ex < cache.maxTTL {
+		ex = cache.maxTTL // 保留至该请求所有可能的缓存均过期
+	}
+	var scopes []uint8
+	if value, ok := cache.scopes.Get(key); ok {
+		scopes = value.([]uint8)
+		for _, s := range scopes {
+			if s == scope {
+				cache.scopes.Set(key, scopes, ex) // 仅延长有效期
+				return
+			}
+		}
+	}
+	// 写入新切片，避免与并发读取的Get共享底层数组
+	scopes = append(append([]uint8{}, scopes...), scope)
+	sort.Slice(scopes, func(i, j int) bool { return scopes[i] > scopes[j] })
+	cache.scopes.Set(key, scopes, ex)
+}
+
+// 返回请求可命中的按ECS作用范围划分的缓存key，作用范围从大到小排列（越具体越优先）
+func (cache *DNSCache) scopedKeys(request *dns.Msg) (keys []string) {
+	ecs := getECS(request.Extra)
+	if ecs == nil {
+		return nil
+	}
+	value, ok := cache.scopes.Get(baseKey(request))
+	if !ok {
+		return nil
+	}
+	for _, scope := range value.([]uint8) {
+		if scope <= ecs.SourceNetmask {
+			keys = append(keys, scopedKey(request, scope))
+		}
+	}
+	return keys
+}
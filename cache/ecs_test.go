@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// 生成携带ECS的请求
+func ecsRequest(subnet string) *dns.Msg {
+	req := new(dns.Msg).SetQuestion("cdn.example.com.", dns.TypeA)
+	_, ipNet, _ := net.ParseCIDR(subnet)
+	ones, _ := ipNet.Mask.Size()
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1,
+		SourceNetmask: uint8(ones), Address: ipNet.IP})
+	return req
+}
+
+// 生成携带ECS作用范围的响应，scope小于0时不携带ECS
+func ecsResponse(request *dns.Msg, ip string, scope int) *dns.Msg {
+	rr, _ := dns.NewRR("cdn.example.com. 600 IN A " + ip)
+	r := new(dns.Msg).SetReply(request)
+	r.Answer = []dns.RR{rr}
+	if scope >= 0 {
+		ecs := *getECS(request.Extra)
+		ecs.SourceScope = uint8(scope)
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		r.IsEdns0().Option = []dns.EDNS0{&ecs}
+	}
+	return r
+}
+
+func answerIP(r *dns.Msg) string {
+	if r == nil || len(r.Answer) == 0 {
+		return ""
+	}
+	return r.Answer[0].(*dns.A).A.String()
+}
+
+func TestDNSCache_ECS(t *testing.T) {
+	cache := NewDNSCache(100, time.Minute, time.Hour)
+	reqA, reqB := ecsRequest("1.2.3.0/24"), ecsRequest("5.6.7.0/24")
+	// 响应未携带ECS时按请求子网缓存，不同子网的客户端不共享缓存
+	cache.Set(reqA, ecsResponse(reqA, "10.0.0.1", -1))
+	assert.Equal(t, "10.0.0.1", answerIP(cache.Get(reqA)))
+	assert.Nil(t, cache.Get(reqB))
+	cache.Set(reqB, ecsResponse(reqB, "10.0.0.2", -1))
+	assert.Equal(t, "10.0.0.1", answerIP(cache.Get(reqA)))
+	assert.Equal(t, "10.0.0.2", answerIP(cache.Get(reqB)))
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestDNSCache_ECSScope(t *testing.T) {
+	cache := NewDNSCache(100, time.Minute, time.Hour)
+	req := ecsRequest("1.2.3.0/24")
+	// 作用范围为/16时，同一/16内的客户端共享缓存
+	cache.Set(req, ecsResponse(req, "10.0.0.1", 16))
+	assert.Equal(t, "10.0.0.1", answerIP(cache.Get(req)))
+	assert.Equal(t, "10.0.0.1", answerIP(cache.Get(ecsRequest("1.2.99.0/24"))))
+	assert.Nil(t, cache.Get(ecsRequest("1.3.0.0/24")))
+	assert.Nil(t, cache.Get(ecsRequest("1.2.0.0/8"))) // 请求子网范围大于作用范围
+	assert.Equal(t, "1.2.0.0/16", cache.Entries()[0].Subnet)
+	// 更具体的作用范围优先
+	other := ecsRequest("1.2.99.0/24")
+	cache.Set(other, ecsResponse(other, "10.0.0.2", 24))
+	assert.Equal(t, "10.0.0.2", answerIP(cache.Get(other)))
+	assert.Equal(t, "10.0.0.1", answerIP(cache.Get(req)))
+	// 删除请求可命中的所有缓存
+	cache.Delete(other)
+	assert.Nil(t, cache.Get(other))
+	assert.Nil(t, cache.Get(req))
+
+	// 作用范围为0时所有携带ECS的客户端共享缓存，未携带ECS的请求不受影响
+	cache.Set(req, ecsResponse(req, "10.0.0.3", 0))
+	assert.Equal(t, "10.0.0.3", answerIP(cache.Get(ecsRequest("8.8.8.0/24"))))
+	assert.Nil(t, cache.Get(new(dns.Msg).SetQuestion("cdn.example.com.", dns.TypeA)))
+	// 作用范围大于请求子网时按请求子网处理
+	scope, ok := responseScope(req, ecsResponse(req, "10.0.0.4", 32))
+	assert.True(t, ok)
+	assert.Equal(t, uint8(24), scope)
+	_, ok = responseScope(req, ecsResponse(req, "10.0.0.4", -1))
+	assert.False(t, ok)
+}
@@ -9,12 +9,21 @@ import (
 
 // RamSet 在go内存中的ipset
 type RamSet struct {
-	subnet []*net.IPNet
-	ipMap  map[string]bool
+	subnet  []*net.IPNet
+	ipMap   map[string]bool
+	exclude *RamSet // 以"!"开头的例外ip/网段，优先于subnet、ipMap
 }
 
+var (
+	v4reg    = regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}$`)
+	cidr4reg = regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}/\d{1,2}$`)
+)
+
 // Contain 判断目标ip是否在范围内
 func (s *RamSet) Contain(target net.IP) bool {
+	if s.exclude != nil && s.exclude.Contain(target) {
+		return false
+	}
 	if _, ok := s.ipMap[target.String()]; ok {
 		return true
 	}
@@ -26,20 +35,46 @@ func (s *RamSet) Contain(target net.IP) bool {
 	return false
 }
 
-// NewRamSetByText 用文本内容初始化一个RamSet，每行一个ip/网段
+// 添加单个ipv4/ipv6地址或网段，格式不符时忽略
+func (s *RamSet) add(line string) {
+	if v4reg.MatchString(line) {
+		s.ipMap[net.ParseIP(line).String()] = true
+	}
+	if cidr4reg.MatchString(line) {
+		if _, subnet, err := net.ParseCIDR(line); err == nil {
+			s.subnet = append(s.subnet, subnet)
+		}
+	}
+	if !strings.Contains(line, ":") { // 以下为ipv6
+		return
+	}
+	if ip := net.ParseIP(line); ip != nil {
+		s.ipMap[ip.String()] = true
+	} else if _, subnet, err := net.ParseCIDR(line); err == nil {
+		s.subnet = append(s.subnet, subnet)
+	}
+}
+
+func newRamSet() *RamSet {
+	return &RamSet{subnet: []*net.IPNet{}, ipMap: map[string]bool{}}
+}
+
+// NewRamSetByText 用文本内容初始化一个RamSet，每行一个ipv4/ipv6地址或网段。"#"之后的内容视为注释，
+// 以"!"开头的ip/网段为例外，例如"10.0.0.0/8"与"!10.1.0.0/16"搭配时10.1.0.0/16不在范围内
 func NewRamSetByText(text string) (s *RamSet) {
-	s = &RamSet{subnet: []*net.IPNet{}, ipMap: map[string]bool{}}
-	v4reg := regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}$`)
-	cidr4reg := regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}/\d{1,2}$`)
+	s = newRamSet()
 	for _, line := range strings.Split(text, "\n") {
-		line = strings.Trim(line, " \t\n\r")
-		if v4reg.MatchString(line) {
-			s.ipMap[net.ParseIP(line).String()] = true
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
 		}
-		if cidr4reg.MatchString(line) {
-			if _, subnet, err := net.ParseCIDR(line); err == nil {
-				s.subnet = append(s.subnet, subnet)
+		line = strings.Trim(line, " \t\n\r")
+		if strings.HasPrefix(line, "!") {
+			if s.exclude == nil {
+				s.exclude = newRamSet()
 			}
+			s.exclude.add(strings.Trim(line[1:], " \t"))
+		} else {
+			s.add(line)
 		}
 	}
 	return s
@@ -28,3 +28,23 @@ func TestRamSet(t *testing.T) {
 	}
 	_ = os.Remove(filename)
 }
+
+func TestRamSet_CommentAndExclude(t *testing.T) {
+	text := "# cn ip list\n\n\t10.0.0.0/8  # private\n !10.1.0.0/16\n! 10.2.2.2 \n1.1.1.1#dns\n#2.2.2.2\n   \n"
+	s := NewRamSetByText(text)
+	assert.True(t, s.Contain(net.ParseIP("10.0.0.1")))
+	assert.True(t, s.Contain(net.ParseIP("10.2.2.3")))
+	assert.True(t, s.Contain(net.ParseIP("1.1.1.1")))
+	assert.False(t, s.Contain(net.ParseIP("2.2.2.2")))  // 注释行
+	assert.False(t, s.Contain(net.ParseIP("10.1.2.3"))) // 例外网段
+	assert.False(t, s.Contain(net.ParseIP("10.2.2.2"))) // 例外ip
+}
+
+func TestRamSet_IPv6(t *testing.T) {
+	s := NewRamSetByText("240e::/20\n2001:db8::1\n!240e:1::/32\n1.1.1.1")
+	assert.True(t, s.Contain(net.ParseIP("240e::1")))
+	assert.True(t, s.Contain(net.ParseIP("2001:db8::1")))
+	assert.True(t, s.Contain(net.ParseIP("1.1.1.1")))
+	assert.False(t, s.Contain(net.ParseIP("2001:db8::2")))
+	assert.False(t, s.Contain(net.ParseIP("240e:1::1"))) // 例外网段
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+const (
+	redisKeyPrefix   = "ts-dns:"   // RedisCache中缓存key的前缀
+	redisWarnTick    = time.Minute // Redis不可用时输出警告的最小间隔
+	redisDialTimeout = time.Second
+	redisIOTimeout   = 500 * time.Millisecond
+	redisFormat      = "v2:" // 缓存值的格式标记，格式变化时修改，其它格式的值（如旧版本写入的值）视为未命中
+)
+
+// RedisCache 基于Redis的DNS响应缓存，可供多个ts-dns实例共享。缓存key的有效期即缓存时长，
+// 值为格式标记redisFormat、过期时间、写入时间（各8字节unix纳秒）加上打包后的响应。Redis不可用时退化为不缓存，并定期输出警告。
+// 携带ECS的请求按请求子网缓存，不使用响应中的作用范围
+type RedisCache struct {
+	ttlPolicy
+	client   *redis.Client
+	warnMux  sync.Mutex
+	lastWarn time.Time
+}
+
+// NewRedisCache 生成一个基于Redis的DNS响应缓存器实例，addr为Redis地址（ip+端口），可选password及db。
+// 创建时不连接Redis，Redis暂不可用不影响创建
+func NewRedisCache(addr, password string, db int, minTTL, maxTTL time.Duration) *RedisCache {
+	client := redis.NewClient(&redis.Options{Addr: addr, Password: password, DB: db, MaxRetries: 0,
+		DialTimeout: redisDialTimeout, ReadTimeout: redisIOTimeout, WriteTimeout: redisIOTimeout})
+	return &RedisCache{ttlPolicy: ttlPolicy{minTTL: minTTL, maxTTL: maxTTL}, client: client}
+}
+
+// Redis请求失败时输出警告，每redisWarnTick最多输出一次
+func (cache *RedisCache) warn(err error) {
+	cache.warnMux.Lock()
+	defer cache.warnMux.Unlock()
+	if now := time.Now(); now.Sub(cache.lastWarn) >= redisWarnTick {
+		cache.lastWarn = now
+		log.Warnf("redis cache unavailable, skip caching: %v", err)
+	}
+}
+
+// Get 获取DNS响应缓存，响应的ttl为倒计时形式。Redis不可用时返回nil
+func (cache *RedisCache) Get(request *dns.Msg) *dns.Msg {
+	buf, err := cache.client.Get(redisKeyPrefix + cacheKey(request)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			cache.warn(err)
+		}
+		return nil
+	}
+	if !bytes.HasPrefix(buf, []byte(redisFormat)) || len(buf) < len(redisFormat)+16 {
+		return nil
+	}
+	buf = buf[len(redisFormat):]
+	expire := time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	stored := time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:])))
+	r := new(dns.Msg)
+	if err = r.Unpack(buf[16:]); err != nil {
+		return nil
+	}
+	entry := &cacheEntry{r: r, expire: expire, stored: stored, keepTTL: cache.KeepTTL}
+	if r = entry.Get(); r == nil {
+		return nil
+	}
+	shuffleAddrs(r.Answer)
+	return r
+}
+
+// Set 设置DNS响应缓存，缓存时长的计算同DNSCache。Redis不可用时不做任何操作
+func (cache *RedisCache) Set(request *dns.Msg, r *dns.Msg) {
+	cache.set(request, r, &cache.ttlPolicy)
+}
+
+// SetTTL 同Set，但使用minTTL、maxTTL代替NewRedisCache指定的范围，不大于0的值沿用原有范围
+func (cache *RedisCache) SetTTL(request, r *dns.Msg, minTTL, maxTTL time.Duration) {
+	cache.set(request, r, cache.within(minTTL, maxTTL))
+}
+
+// 按policy计算缓存时长并写入Redis
+func (cache *RedisCache) set(request, r *dns.Msg, policy *ttlPolicy) {
+	if r == nil {
+		return
+	}
+	ex := policy.expire(r)
+	if ex <= 0 {
+		return
+	}
+	if r.Rcode != dns.RcodeServerFailure && !cache.KeepTTL {
+		for i := 0; i < len(r.Answer); i++ {
+			r.Answer[i].Header().Ttl = uint32(ex.Seconds())
+		}
+	}
+	packed, err := r.Pack()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	buf := make([]byte, len(redisFormat)+16, len(redisFormat)+16+len(packed))
+	copy(buf, redisFormat)
+	binary.BigEndian.PutUint64(buf[len(redisFormat):], uint64(now.Add(ex).UnixNano()))
+	binary.BigEndian.PutUint64(buf[len(redisFormat)+8:], uint64(now.UnixNano()))
+	if err = cache.client.Set(redisKeyPrefix+cacheKey(request), append(buf, packed...), ex).Err(); err != nil {
+		cache.warn(err)
+	}
+}
+
+// Delete 删除请求对应的缓存
+func (cache *RedisCache) Delete(request *dns.Msg) {
+	if err := cache.client.Del(redisKeyPrefix + cacheKey(request)).Err(); err != nil {
+		cache.warn(err)
+	}
+}
+
+// Len 返回Redis当前db中的key数量（包括其它程序写入的key），Redis不可用时返回0
+func (cache *RedisCache) Len() int {
+	n, err := cache.client.DBSize().Result()
+	if err != nil {
+		cache.warn(err)
+		return 0
+	}
+	return int(n)
+}
+
+// Close 关闭Redis连接
+func (cache *RedisCache) Close() error {
+	return cache.client.Close()
+}
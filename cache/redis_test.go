@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"encoding/binary"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRedisCache(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+	var c Cache = NewRedisCache(server.Addr(), "", 0, time.Second, time.Hour)
+	defer func() { _ = c.(*RedisCache).Close() }()
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+
+	// set/get
+	assert.Nil(t, c.Get(req))
+	c.Set(req, nil)
+	c.Set(req, &dns.Msg{}) // 空响应不缓存
+	assert.Equal(t, 0, c.Len())
+	c.Set(req, &dns.Msg{Answer: []dns.RR{rr}})
+	assert.Equal(t, 1, c.Len())
+	assert.True(t, server.Exists("ts-dns:"+cacheKey(req)))
+	r := c.Get(req)
+	assert.NotNil(t, r)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.True(t, r.Answer[0].Header().Ttl <= 60 && r.Answer[0].Header().Ttl >= 59)
+	// key的有效期为缓存时长，过期后无法读取
+	assert.Equal(t, time.Minute, server.TTL("ts-dns:"+cacheKey(req)))
+	server.FastForward(time.Minute)
+	assert.Nil(t, c.Get(req))
+	// delete
+	c.Set(req, &dns.Msg{Answer: []dns.RR{rr}})
+	c.Delete(req)
+	assert.Nil(t, c.Get(req))
+	// SERVFAIL按FailTTL缓存
+	c.Set(req, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}})
+	assert.Nil(t, c.Get(req))
+	c.(*RedisCache).FailTTL = 5 * time.Second
+	c.Set(req, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}})
+	assert.Equal(t, dns.RcodeServerFailure, c.Get(req).Rcode)
+	// 无法解析的值视为未命中
+	assert.Nil(t, server.Set("ts-dns:"+cacheKey(req), "bad"))
+	assert.Nil(t, c.Get(req))
+	assert.Nil(t, server.Set("ts-dns:"+cacheKey(req), redisFormat+"bad"))
+	assert.Nil(t, c.Get(req))
+	// 旧格式（无格式标记，过期时间后直接为响应）的值视为未命中
+	packed, _ := (&dns.Msg{Answer: []dns.RR{rr}}).Pack()
+	old := make([]byte, 8, 8+len(packed))
+	binary.BigEndian.PutUint64(old, uint64(time.Now().Add(time.Minute).UnixNano()))
+	assert.Nil(t, server.Set("ts-dns:"+cacheKey(req), string(append(old, packed...))))
+	assert.Nil(t, c.Get(req))
+}
+
+func TestRedisCache_SetTTL(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+	c := NewRedisCache(server.Addr(), "", 0, time.Second, time.Hour)
+	defer func() { _ = c.Close() }()
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("ip.cn. 7200 IN A 1.1.1.1")
+	var setter TTLSetter = c
+	setter.SetTTL(req, &dns.Msg{Answer: []dns.RR{rr}}, 0, 10*time.Minute)
+	assert.Equal(t, 10*time.Minute, server.TTL("ts-dns:"+cacheKey(req)))
+	assert.Equal(t, uint32(600), c.Get(req).Answer[0].Header().Ttl)
+}
+
+func TestRedisCache_KeepTTL(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+	c := NewRedisCache(server.Addr(), "", 0, 0, time.Minute)
+	c.KeepTTL = true
+	defer func() { _ = c.Close() }()
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("ip.cn. 3600 IN A 1.1.1.1")
+	c.Set(req, &dns.Msg{Answer: []dns.RR{rr}})
+	assert.Equal(t, time.Minute, server.TTL("ts-dns:"+cacheKey(req)))
+	r := c.Get(req)
+	assert.NotNil(t, r)
+	assert.Equal(t, uint32(3600), r.Answer[0].Header().Ttl)
+}
+
+func TestRedisCache_Unavailable(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	c := NewRedisCache(server.Addr(), "", 0, time.Second, time.Hour)
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	c.Set(req, &dns.Msg{Answer: []dns.RR{rr}})
+	assert.NotNil(t, c.Get(req))
+	// redis不可用时退化为不缓存
+	server.Close()
+	c.Set(req, &dns.Msg{Answer: []dns.RR{rr}})
+	assert.Nil(t, c.Get(req))
+	c.Delete(req)
+	assert.Equal(t, 0, c.Len())
+	assert.False(t, c.lastWarn.IsZero())
+	// redis恢复后自动重连
+	assert.Nil(t, server.Restart())
+	defer server.Close()
+	c.Set(req, &dns.Msg{Answer: []dns.RR{rr}})
+	assert.NotNil(t, c.Get(req))
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +17,7 @@ type item struct {
 
 // TTLMap 类似redis的超时map
 type TTLMap struct {
+	evicted uint64 // 因过期被清除的对象数，置于首位以保证32位平台上原子操作的对齐
 	itemMap map[string]*item
 	mux     *sync.RWMutex
 }
@@ -36,20 +38,65 @@ func (m *TTLMap) Get(key string) (interface{}, bool) {
 	if !ok || time.Now().UnixNano() >= value.expire {
 		// delete item, use write lock
 		m.mux.Lock()
-		delete(m.itemMap, key)
+		if current, exists := m.itemMap[key]; exists && current == value { // 期间可能已被清除或重新写入
+			delete(m.itemMap, key)
+			atomic.AddUint64(&m.evicted, 1)
+		}
 		m.mux.Unlock()
 		return nil, false
 	}
 	return value.value, true
 }
 
+// Del 删除对象
+func (m *TTLMap) Del(key string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.itemMap, key)
+}
+
+// Range 遍历map中未过期的对象，f返回false时停止遍历。遍历期间持有读锁，f中不能再调用map的方法
+func (m *TTLMap) Range(f func(key string, value interface{}, expire time.Time) bool) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	now := time.Now().UnixNano()
+	for key, item := range m.itemMap {
+		if now >= item.expire {
+			continue
+		}
+		if !f(key, item.value, time.Unix(0, item.expire)) {
+			return
+		}
+	}
+}
+
 // Len 统计map中存在多少对象（包括已过期对象）
-func (m TTLMap) Len() int {
+func (m *TTLMap) Len() int {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 	return len(m.itemMap)
 }
 
+// Purge 立即清除所有已过期的对象，返回清除的数量
+func (m *TTLMap) Purge() (n int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := time.Now().UnixNano()
+	for key, item := range m.itemMap {
+		if now >= item.expire {
+			delete(m.itemMap, key)
+			n++
+		}
+	}
+	atomic.AddUint64(&m.evicted, uint64(n))
+	return n
+}
+
+// Evicted 返回因过期被清除（包括访问时发现过期及定时清除）的对象总数，不包括通过Del删除的对象
+func (m *TTLMap) Evicted() uint64 {
+	return atomic.LoadUint64(&m.evicted)
+}
+
 // NewTTLMap 新建一个超时map，cleanTick为清除过期对象的频率
 func NewTTLMap(cleanTick time.Duration) (m *TTLMap) {
 	if cleanTick < minCleanTick {
@@ -58,13 +105,7 @@ func NewTTLMap(cleanTick time.Duration) (m *TTLMap) {
 	m = &TTLMap{itemMap: map[string]*item{}, mux: new(sync.RWMutex)}
 	go func() {
 		for range time.Tick(cleanTick) {
-			m.mux.Lock()
-			for key, item := range m.itemMap {
-				if time.Now().UnixNano() >= item.expire {
-					delete(m.itemMap, key)
-				}
-			}
-			m.mux.Unlock()
+			m.Purge()
 		}
 	}()
 	return
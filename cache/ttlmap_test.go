@@ -25,3 +25,38 @@ func TestNewTTLMap(t *testing.T) {
 	time.Sleep(time.Millisecond * 500)
 	assert.Equal(t, ttlMap.Len(), 0) //
 }
+
+func TestTTLMap_Purge(t *testing.T) {
+	ttlMap := NewTTLMap(time.Hour)
+	ttlMap.Set("key1", "value1", time.Hour)
+	ttlMap.Set("key2", "value2", 0)
+	ttlMap.Set("key3", "value3", 0)
+	_, ok := ttlMap.Get("key2")
+	assert.False(t, ok)
+	_, ok = ttlMap.Get("missing") // 不存在的对象不计入
+	assert.False(t, ok)
+	assert.Equal(t, uint64(1), ttlMap.Evicted())
+	assert.Equal(t, 1, ttlMap.Purge())
+	assert.Equal(t, uint64(2), ttlMap.Evicted())
+	ttlMap.Del("key1")
+	assert.Equal(t, uint64(2), ttlMap.Evicted())
+	assert.Equal(t, 0, ttlMap.Len())
+}
+
+func TestTTLMap_Range(t *testing.T) {
+	ttlMap := NewTTLMap(time.Hour)
+	ttlMap.Set("key1", "value1", time.Hour)
+	ttlMap.Set("key2", "value2", time.Hour)
+	ttlMap.Set("key3", "value3", 0) // 已过期，不会被遍历
+	values := map[string]interface{}{}
+	ttlMap.Range(func(key string, value interface{}, expire time.Time) bool {
+		assert.True(t, expire.After(time.Now()))
+		values[key] = value
+		return true
+	})
+	assert.Equal(t, values, map[string]interface{}{"key1": "value1", "key2": "value2"})
+	// 提前停止遍历
+	count := 0
+	ttlMap.Range(func(string, interface{}, time.Time) bool { count++; return false })
+	assert.Equal(t, count, 1)
+}
@@ -0,0 +1,99 @@
+package conf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// 从文件读取的DoT证书。每次TLS握手前检查证书、私钥文件的修改时间及大小，发生变化（如ACME续期）时重新读取，
+// 无需重启程序。重新读取失败（如证书、私钥尚未全部写入）时继续使用原证书，文件再次变化后重试
+type certStore struct {
+	pairs  []*CertPair
+	mux    sync.Mutex
+	stamps []fileStamp       // 各证书、私钥文件最近一次成功读取时的状态
+	failed []fileStamp       // 各证书、私钥文件最近一次读取失败时的状态，同一状态只尝试读取一次
+	certs  []tls.Certificate // 与pairs一一对应
+}
+
+// 文件的修改时间及大小
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// 读取pairs中的所有证书，任一证书读取失败时返回错误
+func newCertStore(pairs []*CertPair) (*certStore, error) {
+	store := &certStore{pairs: pairs}
+	certs, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	store.certs, store.stamps = certs, store.stat()
+	return store, nil
+}
+
+// 读取所有证书及私钥，解析后的证书存入Leaf字段
+func (store *certStore) load() ([]tls.Certificate, error) {
+	certs := make([]tls.Certificate, 0, len(store.pairs))
+	for _, pair := range store.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return nil, err
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// 返回各证书、私钥文件的当前状态，文件不存在时为零值
+func (store *certStore) stat() (stamps []fileStamp) {
+	for _, pair := range store.pairs {
+		for _, filename := range []string{pair.Cert, pair.Key} {
+			var stamp fileStamp
+			if info, err := os.Stat(filename); err == nil {
+				stamp = fileStamp{modTime: info.ModTime(), size: info.Size()}
+			}
+			stamps = append(stamps, stamp)
+		}
+	}
+	return
+}
+
+// 返回最新的证书列表，文件发生变化时重新读取，首个证书为默认证书
+func (store *certStore) current() []tls.Certificate {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	stamps := store.stat()
+	if sameStamps(stamps, store.stamps) || sameStamps(stamps, store.failed) {
+		return store.certs
+	}
+	certs, err := store.load()
+	if err != nil {
+		log.Errorf("reload dot certificate error, keep using old certificate: %v", err)
+		store.failed = stamps
+		return store.certs
+	}
+	log.Warnf("dot certificate reloaded")
+	store.certs, store.stamps, store.failed = certs, stamps, nil
+	return certs
+}
+
+// 判断两组文件状态是否相同
+func sameStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
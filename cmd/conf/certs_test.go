@@ -0,0 +1,82 @@
+package conf
+
+import (
+	"bytes"
+	"crypto/tls"
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertStore_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ts-dns-certs")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	pair := genCertPair(t, dir, "dns.a.com")
+	tlsConfig, err := (&DoT{Listen: ":853", Cert: pair.Cert, Key: pair.Key}).GenTLSConfig()
+	assert.Nil(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	assert.Nil(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+	// 通过TLS握手获取服务端证书
+	peerCert := func() []byte {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		defer func() { _ = conn.Close() }()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	// 覆盖证书、私钥文件，并修改其修改时间，避免文件系统时间精度不足
+	replace := func(cert, key []byte, modTime time.Time) {
+		assert.Nil(t, ioutil.WriteFile(pair.Cert, cert, 0644))
+		assert.Nil(t, ioutil.WriteFile(pair.Key, key, 0600))
+		assert.Nil(t, os.Chtimes(pair.Cert, modTime, modTime))
+		assert.Nil(t, os.Chtimes(pair.Key, modTime, modTime))
+	}
+	readPair := func(pair *CertPair) (cert, key []byte) {
+		cert, _ = ioutil.ReadFile(pair.Cert)
+		key, _ = ioutil.ReadFile(pair.Key)
+		return
+	}
+	oldCert, oldKey := readPair(pair)
+	first := peerCert()
+	assert.Equal(t, first, peerCert())
+
+	// 证书文件更新后，新的握手使用新证书
+	newDir, err := ioutil.TempDir("", "ts-dns-certs")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(newDir) }()
+	newCert, newKey := readPair(genCertPair(t, newDir, "dns.a.com"))
+	replace(newCert, newKey, time.Now().Add(time.Minute))
+	second := peerCert()
+	assert.False(t, bytes.Equal(first, second))
+	assert.Equal(t, second, peerCert())
+
+	// 证书与私钥不匹配（如只写入了其一）时继续使用原证书，文件未再变化时不重复读取
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	replace(oldCert, newKey, time.Now().Add(2*time.Minute))
+	assert.Equal(t, second, peerCert())
+	assert.Equal(t, second, peerCert())
+	assert.Equal(t, 1, strings.Count(buf.String(), "reload dot certificate error"))
+	// 写入完成后使用新证书
+	replace(oldCert, oldKey, time.Now().Add(3*time.Minute))
+	assert.Equal(t, first, peerCert())
+}
@@ -0,0 +1,160 @@
+package conf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/inbound"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Lists 配置文件中lists section对应的结构，用于定期从远程地址更新gfwlist、cnip文件
+type Lists struct {
+	GFWListURL      string `toml:"gfwlist_url"`
+	GFWListChecksum string `toml:"gfwlist_checksum"`
+	CNIPURL         string `toml:"cnip_url"`
+	CNIPChecksum    string `toml:"cnip_checksum"`
+	Refresh         int    // 更新间隔，单位为秒
+}
+
+// RemoteList 一个远程列表：下载url的内容，校验通过后写入本地文件file
+type RemoteList struct {
+	URL      string
+	Checksum string // 期望的sha256（十六进制），或以http(s)://开头的校验文件地址（内容的首个字段为sha256，同sha256sum输出）
+	File     string
+	Parse    func(filename string) error // 替换本地文件前解析下载内容所在的临时文件，返回错误时不替换
+}
+
+// 远程列表下载使用的http客户端
+var listClient = &http.Client{Timeout: 30 * time.Second}
+
+// 下载url的内容，响应码非200时返回错误
+func download(url string) ([]byte, error) {
+	resp, err := listClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s failed: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// 返回期望的sha256，Checksum为校验文件地址时下载后提取，未配置时返回空字符串
+func (list *RemoteList) expectedSum() (string, error) {
+	sum := list.Checksum
+	if strings.HasPrefix(sum, "http://") || strings.HasPrefix(sum, "https://") {
+		raw, err := download(sum)
+		if err != nil {
+			return "", err
+		}
+		if fields := strings.Fields(string(raw)); len(fields) > 0 {
+			sum = fields[0]
+		} else {
+			return "", fmt.Errorf("empty checksum file: %s", list.Checksum)
+		}
+	}
+	return strings.ToLower(strings.TrimPrefix(sum, "sha256:")), nil
+}
+
+// Fetch 下载列表并校验sha256，通过且Parse解析成功后替换本地文件。失败时不修改本地文件，继续使用之前的有效副本
+func (list *RemoteList) Fetch() error {
+	raw, err := download(list.URL)
+	if err != nil {
+		return err
+	}
+	expected, err := list.expectedSum()
+	if err != nil {
+		return err
+	}
+	if expected != "" {
+		digest := sha256.Sum256(raw)
+		if actual := hex.EncodeToString(digest[:]); actual != expected {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", list.URL, expected, actual)
+		}
+	}
+	// 先写入临时文件再重命名，避免读取到写入一半的文件
+	tmp, err := ioutil.TempFile(filepath.Dir(list.File), filepath.Base(list.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if list.Parse != nil {
+		if err = list.Parse(tmp.Name()); err != nil {
+			return fmt.Errorf("parse %s failed: %v", list.URL, err)
+		}
+	}
+	return os.Rename(tmp.Name(), list.File)
+}
+
+// UpdateLists 下载配置的远程gfwlist、cnip，校验通过后写入本地文件并更新handler。
+// 某个列表更新失败时该列表保持不变，返回遇到的首个错误
+func (conf *Conf) UpdateLists(handler *inbound.Handler) (err error) {
+	var gfw *matcher.ABPlus
+	var cnip *cache.RamSet
+	if conf.Lists.GFWListURL != "" {
+		list := &RemoteList{URL: conf.Lists.GFWListURL, Checksum: conf.Lists.GFWListChecksum, File: conf.GFWList}
+		var parsed *matcher.ABPlus
+		list.Parse = func(filename string) (err error) {
+			parsed, err = matcher.NewABPByFile(filename, true)
+			return err
+		}
+		if err = list.Fetch(); err != nil {
+			log.WithField("url", list.URL).Errorf("update gfwlist error: %v", err)
+		} else {
+			gfw = parsed
+		}
+	}
+	if conf.Lists.CNIPURL != "" {
+		list := &RemoteList{URL: conf.Lists.CNIPURL, Checksum: conf.Lists.CNIPChecksum, File: conf.CNIP}
+		var parsed *cache.RamSet
+		list.Parse = func(filename string) (err error) {
+			parsed, err = cache.NewRamSetByFile(filename)
+			return err
+		}
+		var cnipErr error
+		if cnipErr = list.Fetch(); cnipErr != nil {
+			log.WithField("url", list.URL).Errorf("update cnip error: %v", cnipErr)
+		} else {
+			cnip = parsed
+		}
+		if err == nil {
+			err = cnipErr
+		}
+	}
+	handler.UpdateLists(gfw, cnip)
+	return err
+}
+
+// RefreshLists 按lists.refresh的间隔持续更新远程gfwlist、cnip。每次更新前重新读取配置文件，使配置变动生效；
+// 未配置远程地址或更新间隔时返回
+func RefreshLists(handler *inbound.Handler, filename string) {
+	for {
+		config, err := LoadConf(filename)
+		if err != nil {
+			log.WithField("file", filename).Errorf("read config error: %v", err)
+			return
+		}
+		if config.Lists.Refresh <= 0 || (config.Lists.GFWListURL == "" && config.Lists.CNIPURL == "") {
+			return
+		}
+		_ = config.UpdateLists(handler)
+		time.Sleep(time.Duration(config.Lists.Refresh) * time.Second)
+	}
+}
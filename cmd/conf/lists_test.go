@@ -0,0 +1,150 @@
+package conf
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/inbound"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func sha256Hex(raw string) string {
+	digest := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(digest[:])
+}
+
+// 提供远程列表及其校验文件的http服务，内容可在测试期间修改
+type listServer struct {
+	mux   sync.Mutex
+	files map[string]string
+}
+
+func (srv *listServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	srv.mux.Lock()
+	content, ok := srv.files[req.URL.Path]
+	srv.mux.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	_, _ = w.Write([]byte(content))
+}
+
+func (srv *listServer) set(path, content string) {
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+	srv.files[path] = content
+}
+
+func TestRemoteList_Fetch(t *testing.T) {
+	srv := &listServer{files: map[string]string{}}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "ts-dns-lists")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	file := filepath.Join(dir, "cnip.txt")
+	_ = ioutil.WriteFile(file, []byte("1.1.1.0/24\n"), 0644)
+	srv.set("/cnip.txt", "2.2.2.0/24\n")
+	list := &RemoteList{URL: server.URL + "/cnip.txt", Checksum: sha256Hex("2.2.2.0/24\n"), File: file}
+	// 校验通过时替换本地文件
+	assert.Nil(t, list.Fetch())
+	raw, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "2.2.2.0/24\n", string(raw))
+	// 校验失败时保留原文件
+	srv.set("/cnip.txt", "3.3.3.0/24\n")
+	assert.NotNil(t, list.Fetch())
+	raw, _ = ioutil.ReadFile(file)
+	assert.Equal(t, "2.2.2.0/24\n", string(raw))
+	// 通过校验文件获取期望的sha256
+	srv.set("/cnip.txt.sha256", sha256Hex("3.3.3.0/24\n")+"  cnip.txt\n")
+	list.Checksum = server.URL + "/cnip.txt.sha256"
+	assert.Nil(t, list.Fetch())
+	raw, _ = ioutil.ReadFile(file)
+	assert.Equal(t, "3.3.3.0/24\n", string(raw))
+	// 校验文件或列表下载失败时保留原文件
+	list.Checksum = server.URL + "/not-exists.sha256"
+	assert.NotNil(t, list.Fetch())
+	list.Checksum, list.URL = "", server.URL+"/not-exists.txt"
+	assert.NotNil(t, list.Fetch())
+	raw, _ = ioutil.ReadFile(file)
+	assert.Equal(t, "3.3.3.0/24\n", string(raw))
+	// 未配置校验时直接替换
+	list.URL = server.URL + "/cnip.txt"
+	srv.set("/cnip.txt", "4.4.4.0/24\n")
+	assert.Nil(t, list.Fetch())
+	// 解析失败时保留原文件
+	var parsed string
+	list.Parse = func(filename string) error {
+		raw, _ := ioutil.ReadFile(filename)
+		parsed = string(raw)
+		return errors.New("parse error")
+	}
+	srv.set("/cnip.txt", "invalid\n")
+	assert.NotNil(t, list.Fetch())
+	assert.Equal(t, "invalid\n", parsed)
+	raw, _ = ioutil.ReadFile(file)
+	assert.Equal(t, "4.4.4.0/24\n", string(raw))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1) // 不残留临时文件
+}
+
+func TestConf_UpdateLists(t *testing.T) {
+	srv := &listServer{files: map[string]string{}}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "ts-dns-lists")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	gfwlist := base64.StdEncoding.EncodeToString([]byte("||google.com\n"))
+	srv.set("/gfwlist.txt", gfwlist)
+	srv.set("/cnip.txt", "1.1.1.0/24\n")
+	conf := &Conf{GFWList: filepath.Join(dir, "gfwlist.txt"), CNIP: filepath.Join(dir, "cnip.txt"),
+		Lists: &Lists{GFWListURL: server.URL + "/gfwlist.txt", GFWListChecksum: sha256Hex(gfwlist),
+			CNIPURL: server.URL + "/cnip.txt", CNIPChecksum: "sha256:" + sha256Hex("1.1.1.0/24\n")}}
+	handler := &inbound.Handler{Mux: new(sync.RWMutex), GFWMatcher: matcher.NewABPByText(""),
+		CNIP: cache.NewRamSetByText(""), QueryLogger: log.New()}
+	// 校验通过的列表立即生效
+	assert.Nil(t, conf.UpdateLists(handler))
+	matched, ok := handler.GFWMatcher.Match("www.google.com")
+	assert.True(t, matched && ok)
+	assert.True(t, handler.CNIP.Contain(net.ParseIP("1.1.1.1")))
+	// 校验失败的列表被拒绝，继续使用之前的有效列表，其余列表正常更新
+	srv.set("/gfwlist.txt", base64.StdEncoding.EncodeToString([]byte("||github.com\n")))
+	srv.set("/cnip.txt", "2.2.2.0/24\n")
+	conf.Lists.CNIPChecksum = sha256Hex("2.2.2.0/24\n")
+	assert.NotNil(t, conf.UpdateLists(handler))
+	matched, ok = handler.GFWMatcher.Match("www.google.com")
+	assert.True(t, matched && ok)
+	_, ok = handler.GFWMatcher.Match("github.com")
+	assert.False(t, ok)
+	assert.True(t, handler.CNIP.Contain(net.ParseIP("2.2.2.2")))
+	reloaded, err := conf.GenGFWMatcher() // 本地文件仍为之前的有效副本
+	assert.Nil(t, err)
+	matched, ok = reloaded.Match("www.google.com")
+	assert.True(t, matched && ok)
+	// 未配置校验时，无法解析的列表同样被拒绝
+	srv.set("/gfwlist.txt", "invalid base64")
+	conf.Lists.GFWListChecksum = ""
+	assert.NotNil(t, conf.UpdateLists(handler))
+	matched, ok = handler.GFWMatcher.Match("www.google.com")
+	assert.True(t, matched && ok)
+	reloaded, err = conf.GenGFWMatcher()
+	assert.Nil(t, err)
+	matched, ok = reloaded.Match("www.google.com")
+	assert.True(t, matched && ok)
+}
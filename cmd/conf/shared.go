@@ -0,0 +1,65 @@
+package conf
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+)
+
+// 多个组中出现相同上游时的处理方式
+const (
+	DuplicateUpstreamsShare    = "share"    // 共享同一个Caller，组间共用连接池及熔断状态
+	DuplicateUpstreamsSeparate = "separate" // 每个组各自创建Caller
+)
+
+// 按上游地址+协议+代理共享的Caller，用于多个组引用相同上游时共用连接池及熔断器
+type sharedCallers struct {
+	mux     sync.Mutex
+	callers map[string]*sharedCaller
+}
+
+type sharedCaller struct {
+	options string // 创建该Caller的组内上游相关配置
+	group   string // 首个引用该上游的组
+	caller  outbound.Caller
+}
+
+// 根据duplicate_upstreams生成共享Caller的注册表，DuplicateUpstreamsSeparate时返回nil
+func (conf *Conf) genSharedCallers() (*sharedCallers, error) {
+	switch conf.UpstreamSharing {
+	case "", DuplicateUpstreamsShare:
+		return &sharedCallers{callers: map[string]*sharedCaller{}}, nil
+	case DuplicateUpstreamsSeparate:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown duplicate_upstreams: %q", conf.UpstreamSharing)
+}
+
+// 返回组内影响Caller行为的配置（TLS参数、padding、连接池、DoH参数及熔断器），相同时才可共享Caller
+func (conf *Group) callerOptions() string {
+	return fmt.Sprintf("%#v", []interface{}{conf.TLSMinVersion, conf.TLSMaxVersion, conf.TLSCipherSuites, conf.EDNSPadding,
+		conf.MaxIdleConns, conf.MaxConns, conf.DoHHTTPVersion, conf.DoHMaxConcurrent, conf.DoHFailFast,
+		conf.DoHMethod, conf.DoHParams, conf.DoHRandomPadding, conf.DoHDialTimeout, conf.DoHTLSTimeout, conf.DoHTimeout,
+		conf.BreakerThreshold, conf.BreakerCooldown})
+}
+
+// 返回已注册的相同上游的Caller，不存在时注册并返回caller。key为上游地址+协议+代理，
+// 上游相关配置与首个引用该上游的组不同时不共享，输出警告后返回caller。shared为nil时直接返回caller
+func (shared *sharedCallers) get(key string, conf *Group, caller outbound.Caller) outbound.Caller {
+	if shared == nil || caller == nil {
+		return caller
+	}
+	shared.mux.Lock()
+	defer shared.mux.Unlock()
+	options := conf.callerOptions()
+	if exists, ok := shared.callers[key]; !ok {
+		shared.callers[key] = &sharedCaller{options: options, group: conf.name, caller: caller}
+	} else if exists.options == options {
+		return exists.caller
+	} else {
+		log.Warnf("upstream %s in group %s has different options from group %s, not shared",
+			caller, conf.name, exists.group)
+	}
+	return caller
+}
@@ -0,0 +1,67 @@
+package conf
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// 操作系统解析器的配置文件，测试时可替换
+var resolvConf = "/etc/resolv.conf"
+
+// 返回resolv.conf中指向ts-dns自身监听地址的nameserver，不存在时返回空串。
+// resolv.conf中的nameserver固定使用53端口，监听所有地址时本机回环地址及网卡地址均视为自身
+func (conf *Conf) systemResolverLoop() string {
+	file, err := os.Open(resolvConf)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(strings.SplitN(fields[1], "%", 2)[0]) // 去除ipv6地址的zone
+		if ip != nil && conf.listenOn(ip, "53") {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// 判断ts-dns的dns服务是否监听ip:port
+func (conf *Conf) listenOn(ip net.IP, port string) bool {
+	for _, addr := range conf.Listen {
+		host, p, err := net.SplitHostPort(addr)
+		if err != nil || p != port {
+			continue
+		}
+		switch listenIP := net.ParseIP(host); {
+		case host != "" && listenIP == nil: // 以主机名指定的监听地址
+		case listenIP != nil && !listenIP.IsUnspecified():
+			if listenIP.Equal(ip) {
+				return true
+			}
+		case ip.IsLoopback() || ip.IsUnspecified() || isLocalAddr(ip): // 监听所有地址
+			return true
+		}
+	}
+	return false
+}
+
+// 判断ip是否为本机网卡地址
+func isLocalAddr(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,9 +5,10 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsnotify/fsnotify"
-	"github.com/miekg/dns"
 	"github.com/wolf-joe/ts-dns/cmd/conf"
 	"github.com/wolf-joe/ts-dns/inbound"
+	"io"
+	"net/http"
 	"os"
 	"time"
 )
@@ -20,31 +21,83 @@ func main() {
 	filename := flag.String("c", "ts-dns.toml", "config file path")
 	reload := flag.Bool("r", false, "auto reload config file")
 	showVer := flag.Bool("v", false, "show version and exit")
+	resolve := flag.String("resolve", "", "resolve domain through routing pipeline and exit")
+	qtype := flag.String("type", "A", "query type used by -resolve")
+	dumpConf := flag.String("dump-config", "", "print effective config of file and exit")
+	redact := flag.Bool("redact", true, "hide secrets when -dump-config")
 	flag.Parse()
 	if *showVer { // 显示版本号并退出
 		fmt.Println(VERSION)
 		os.Exit(0)
 	}
+	if *dumpConf != "" { // 输出填充默认值后的配置并退出
+		if err := dumpConfig(*dumpConf, *redact, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	// 读取配置文件
 	handler, err := conf.NewHandler(*filename)
 	if err != nil {
 		os.Exit(1)
 	}
+	if *resolve != "" { // 解析域名并退出
+		handler.ResolveDoH()
+		if err = dryResolve(handler, *resolve, *qtype, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if *reload { // 自动重载配置文件
 		log.Warnf("auto reload " + *filename)
 		go autoReload(handler, *filename)
 	}
-	// 启动dns服务后异步解析DoH服务器域名
-	go func() { time.Sleep(time.Second); handler.ResolveDoH() }()
+	// 定期更新远程gfwlist、cnip
+	go conf.RefreshLists(handler, *filename)
+	// 启动管理接口
+	if handler.AdminListen != "" {
+		go func() {
+			log.Warnf("admin listen on %s", handler.AdminListen)
+			if err := http.ListenAndServe(handler.AdminListen, handler.AdminHandler()); err != nil {
+				log.Errorf("listen admin error: %v", err)
+			}
+		}()
+	}
+	// 启动dns服务后异步解析DoH服务器域名，随后进行启动自检，必需的组自检失败时退出
+	go func() {
+		time.Sleep(time.Second)
+		handler.ResolveDoH()
+		if err := handler.SelfTest(); err != nil {
+			log.Fatalf("self test error: %v", err)
+		}
+	}()
 	// 启动dns服务
-	srv := &dns.Server{Addr: handler.Listen, Net: "udp", Handler: handler}
-	log.Warnf("listen on %s/udp", handler.Listen)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("listen udp error: %v", err)
+	if err := handler.ListenAndServe(); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// 读取配置文件并以toml格式输出实际生效的配置
+func dumpConfig(filename string, redact bool, w io.Writer) error {
+	config, err := conf.LoadConf(filename)
+	if err != nil {
+		return err
+	}
+	return config.Dump(w, redact)
+}
+
+// 将规则文件加入监测，重复加入不会产生影响
+func watchRuleFiles(watcher *fsnotify.Watcher, filenames []string) {
+	for _, filename := range filenames {
+		if err := watcher.Add(filename); err != nil {
+			log.WithField("file", filename).Errorf("watch file error: %v", err)
+		}
 	}
 }
 
-// 持续监测目标配置文件，如文件发生变动则尝试载入，载入成功后更新现有handler的配置
+// 持续监测目标配置文件及其引用的规则文件，如文件发生变动则尝试载入，载入成功后更新现有handler的配置
 func autoReload(handle *inbound.Handler, filename string) {
 	fields := log.Fields{"file": filename}
 	// 创建监测器
@@ -62,6 +115,7 @@ func autoReload(handle *inbound.Handler, filename string) {
 		log.WithFields(fields).Errorf("watch file error: %v", err)
 		return
 	}
+	watchRuleFiles(watcher, handle.RuleFiles)
 	// 接收文件事件
 	for {
 		select {
@@ -70,10 +124,16 @@ func autoReload(handle *inbound.Handler, filename string) {
 				return
 			}
 			if event.Op&fsnotify.Write == fsnotify.Write { // 文件变动事件
-				log.WithFields(fields).Warnf("file changed, reloading")
-				if newHandler, err := conf.NewHandler(filename); err == nil {
-					newHandler.ResolveDoH()
-					handle.Refresh(newHandler)
+				log.WithField("file", event.Name).Warnf("file changed, reloading")
+				newHandler, err := handle.Reload(func() (*inbound.Handler, error) {
+					newHandler, err := conf.NewHandler(filename)
+					if err == nil {
+						newHandler.ResolveDoH()
+					}
+					return newHandler, err
+				})
+				if err == nil { // 载入失败时保持原有配置
+					watchRuleFiles(watcher, newHandler.RuleFiles)
 				}
 			}
 		case err, ok := <-watcher.Errors: // 出现错误
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/inbound"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 记录每次上游请求的结果与耗时
+type callTrace struct {
+	mux   sync.Mutex
+	calls []string
+}
+
+// 包裹Caller，将请求结果记录到callTrace
+type tracedCaller struct {
+	outbound.Caller
+	trace *callTrace
+}
+
+// Call 调用被包裹的Caller并记录结果
+func (caller *tracedCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	begin := time.Now()
+	r, err := caller.Caller.Call(request)
+	status := "ok"
+	if err != nil {
+		status = "error: " + err.Error()
+	} else if r != nil {
+		status = dns.RcodeToString[r.Rcode]
+	}
+	caller.trace.mux.Lock()
+	defer caller.trace.mux.Unlock()
+	line := fmt.Sprintf("%v %v %s", caller.Caller, time.Since(begin).Round(time.Millisecond), status)
+	caller.trace.calls = append(caller.trace.calls, line)
+	return r, err
+}
+
+// 包裹Caller列表
+func traceCallers(callers []outbound.Caller, trace *callTrace) (traced []outbound.Caller) {
+	for _, caller := range callers {
+		traced = append(traced, &tracedCaller{Caller: caller, trace: trace})
+	}
+	return
+}
+
+// 通过完整的处理流程解析域名，输出分组、上游、耗时及响应，不启动dns服务。会替换handler中的Caller，仅用于调试
+func dryResolve(handler *inbound.Handler, name, qtype string, w io.Writer) error {
+	t, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return fmt.Errorf("unknown query type: %s", qtype)
+	}
+	trace := &callTrace{}
+	for _, group := range handler.Groups {
+		group.Callers = traceCallers(group.Callers, trace)
+		group.DirectCallers = traceCallers(group.DirectCallers, trace)
+	}
+	for suffix, caller := range handler.Forward {
+		handler.Forward[suffix] = &tracedCaller{Caller: caller, trace: trace}
+	}
+
+	request := new(dns.Msg).SetQuestion(dns.Fqdn(name), t)
+	begin := time.Now()
+	r, result := handler.Query(request)
+	cost := time.Since(begin).Round(time.Millisecond)
+
+	group := result.Group
+	if group == "" {
+		group = "-"
+	}
+	_, _ = fmt.Fprintf(w, "group:   %s (%s)\n", group, result.Reason)
+	if result.Rule != "" {
+		_, _ = fmt.Fprintf(w, "rule:    %s\n", result.Rule)
+	}
+	for _, call := range trace.calls {
+		_, _ = fmt.Fprintf(w, "caller:  %s\n", call)
+	}
+	_, _ = fmt.Fprintf(w, "latency: %v\n", cost)
+	_, _ = fmt.Fprintf(w, "rcode:   %s\n", dns.RcodeToString[r.Rcode])
+	for _, rr := range r.Answer {
+		_, _ = fmt.Fprintf(w, "answer:  %s\n", rr.String())
+	}
+	return nil
+}
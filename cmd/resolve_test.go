@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/inbound"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"sync"
+	"testing"
+)
+
+type mockCaller struct {
+	name string
+	ip   string
+}
+
+func (caller *mockCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	if caller.ip == "" {
+		return nil, fmt.Errorf("timeout")
+	}
+	r := new(dns.Msg).SetReply(request)
+	hdr := dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+	r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(caller.ip)})
+	return r, nil
+}
+
+func (caller *mockCaller) String() string {
+	return caller.name
+}
+
+func TestDryResolve(t *testing.T) {
+	clean := &inbound.Group{Callers: []outbound.Caller{&mockCaller{name: "clean1", ip: "1.1.1.1"}},
+		Matcher: matcher.NewABPByText("")}
+	dirty := &inbound.Group{Callers: []outbound.Caller{&mockCaller{name: "dirty1", ip: "2.2.2.2"}},
+		Matcher: matcher.NewABPByText("")}
+	handler := &inbound.Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText("||google.com"), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+		Groups:       map[string]*inbound.Group{"clean": clean, "dirty": dirty},
+	}
+	// clean组返回非cn ip且gfwlist命中，由dirty组再次解析
+	buf := new(bytes.Buffer)
+	assert.Nil(t, dryResolve(handler, "www.google.com", "a", buf))
+	out := buf.String()
+	assert.Contains(t, out, "group:   dirty (match gfwlist)")
+	assert.Contains(t, out, "rule:    ||google.com")
+	assert.Contains(t, out, "caller:  clean1")
+	assert.Contains(t, out, "caller:  clean1 ")
+	assert.Contains(t, out, "caller:  dirty1")
+	assert.Contains(t, out, "NOERROR")
+	assert.Contains(t, out, "2.2.2.2")
+
+	assert.NotNil(t, dryResolve(handler, "www.google.com", "unknown", buf))
+}
@@ -8,11 +8,14 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/Sirupsen/logrus v1.4.2
 	github.com/agiledragon/gomonkey v2.0.1+incompatible
+	github.com/alicebob/miniredis/v2 v2.11.0
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/fsnotify/fsnotify v1.4.9
+	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/janeczku/go-ipset v0.0.0-20170206212442-499ed3217c4b
 	github.com/miekg/dns v1.1.28
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/sparrc/go-ping v0.0.0-20190613174326-4e5b6552494c
-	github.com/stretchr/testify v1.2.2
+	github.com/stretchr/testify v1.4.0
 	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
 )
@@ -17,12 +17,17 @@ const (
 type Reader interface {
 	IP(hostname string, ipv6 bool) string
 	Record(hostname string, ipv6 bool) string
+	Hostname(ip string) string
+	CNAME(hostname string) string
+	Close() error
 }
 
 // TextReader 基于文本的读取器
 type TextReader struct {
 	v4Map map[string]string
 	v6Map map[string]string
+	ipMap map[string]string // ip -> 首个对应的hostname，用于反向解析
+	cname map[string]string // hostname -> 别名指向的目标域名
 }
 
 // IP 获取hostname对应的ip地址，如不存在则返回空串
@@ -47,21 +52,61 @@ func (r *TextReader) Record(hostname string, ipv6 bool) (record string) {
 	return fmt.Sprintf("%s 0 IN %s %s", hostname, t, ip)
 }
 
+// Hostname 获取ip对应的首个hostname，用于PTR请求，如不存在则返回空串
+func (r *TextReader) Hostname(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return r.ipMap[parsed.String()]
+	}
+	return ""
+}
+
+// CNAME 获取hostname作为别名时指向的目标域名，如不存在则返回空串
+func (r *TextReader) CNAME(hostname string) string {
+	return r.cname[hostname]
+}
+
+// AddCNAME 添加hostname指向target的别名记录，hosts文件格式本身不支持别名
+func (r *TextReader) AddCNAME(hostname, target string) {
+	r.cname[hostname] = target
+}
+
+// Close 实现Reader接口，TextReader无需释放资源
+func (r *TextReader) Close() error {
+	return nil
+}
+
 // NewReaderByText 解析文本内容中的Hosts
 func NewReaderByText(text string) (r *TextReader) {
-	r = &TextReader{v4Map: map[string]string{}, v6Map: map[string]string{}}
+	r = &TextReader{v4Map: map[string]string{}, v6Map: map[string]string{}, ipMap: map[string]string{},
+		cname: map[string]string{}}
 	for _, line := range strings.Split(text, "\n") {
 		line = strings.Trim(line, " \t\r")
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 		splitter := func(r rune) bool { return r == ' ' || r == '\t' }
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i] // 移除行尾注释
+		}
 		if arr := strings.FieldsFunc(line, splitter); len(arr) >= 2 {
-			ip, hostname := net.ParseIP(arr[0]), arr[1]
+			ip := net.ParseIP(arr[0])
+			if ip == nil {
+				continue
+			}
+			// 按书写形式区分地址类型，避免::ffff:1.2.3.4等映射地址被当作ipv4返回给A请求
+			v6 := ip.String()
 			if ip.To4() != nil {
-				r.v4Map[hostname] = ip.To4().String()
-			} else if ip.To16() != nil {
-				r.v6Map[hostname] = ip.To16().String()
+				v6 = "::ffff:" + ip.To4().String()
+			}
+			for _, hostname := range arr[1:] { // 同一行中ip之后的均为hostname（别名）
+				if strings.Contains(arr[0], ":") {
+					r.v6Map[hostname] = v6
+				} else {
+					r.v4Map[hostname] = ip.String()
+				}
+			}
+			if _, ok := r.ipMap[ip.String()]; !ok {
+				r.ipMap[ip.String()] = arr[1]
 			}
 		}
 	}
@@ -75,12 +120,13 @@ type FileReader struct {
 	timestamp  time.Time
 	reloadTick time.Duration
 	reader     *TextReader
+	closed     bool
 }
 
 func (r *FileReader) reload() {
 	r.mux.Lock()
 	defer r.mux.Unlock()
-	if r.reloadTick < minReloadTick || time.Now().Before(r.timestamp.Add(r.reloadTick)) {
+	if r.closed || r.reloadTick < minReloadTick || time.Now().Before(r.timestamp.Add(r.reloadTick)) {
 		return
 	}
 	// read host file again
@@ -104,6 +150,27 @@ func (r *FileReader) Record(hostname string, ipv6 bool) string {
 	return r.reader.Record(hostname, ipv6)
 }
 
+// Hostname 获取ip对应的首个hostname，如不存在则返回空串
+func (r *FileReader) Hostname(ip string) string {
+	r.reload()
+	return r.reader.Hostname(ip)
+}
+
+// CNAME 获取hostname作为别名时指向的目标域名，hosts文件中不存在别名记录，总是返回空串
+func (r *FileReader) CNAME(hostname string) string {
+	r.reload()
+	return r.reader.CNAME(hostname)
+}
+
+// Close 停止自动重载hosts文件，之后仍可读取最后一次加载的hosts记录。
+// 重载由读取时按reloadTick触发，不依赖后台goroutine，因此关闭后不会残留goroutine
+func (r *FileReader) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.closed = true
+	return nil
+}
+
 // NewReaderByFile 解析目标文件内容中的Hosts
 func NewReaderByFile(filename string, reloadTick time.Duration) (r *FileReader, err error) {
 	var raw []byte
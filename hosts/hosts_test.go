@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -23,6 +24,14 @@ func TestNewTextReader(t *testing.T) {
 	assert.Equal(t, reader.Record("ip6-localhost", true), expect)
 }
 
+func TestTextReader_Hostname(t *testing.T) {
+	reader := NewReaderByText("127.0.0.1 localhost\n127.0.0.1 alias\n::1 ip6-localhost\n256.0.0.1 ne")
+	assert.Equal(t, "localhost", reader.Hostname("127.0.0.1")) // 多个hostname时使用首个
+	assert.Equal(t, "ip6-localhost", reader.Hostname("0:0::1"))
+	assert.Equal(t, "", reader.Hostname("127.0.0.2"))
+	assert.Equal(t, "", reader.Hostname("256.0.0.1"))
+}
+
 func TestNewFileReader(t *testing.T) {
 	filename := "go_test_hosts_file"
 	reader, err := NewReaderByFile(filename, 0)
@@ -38,6 +47,7 @@ func TestNewFileReader(t *testing.T) {
 	assert.Equal(t, reader.IP("ip6-localhost", true), "::1")
 	expect := "localhost 0 IN A 127.0.0.1"
 	assert.Equal(t, reader.Record("localhost", false), expect)
+	assert.Equal(t, "localhost", reader.Hostname("127.0.0.1"))
 
 	content = "127.0.1.1 localhost\n::2 ip6-localhost"
 	_ = ioutil.WriteFile(filename, []byte(content), 0644)
@@ -50,3 +60,36 @@ func TestNewFileReader(t *testing.T) {
 
 	_ = os.Remove(filename)
 }
+
+func TestFileReader_Close(t *testing.T) {
+	filename := "go_test_hosts_close"
+	defer func() { _ = os.Remove(filename) }()
+	_ = ioutil.WriteFile(filename, []byte("127.0.0.1 localhost"), 0644)
+	before := runtime.NumGoroutine()
+	reader, err := NewReaderByFile(filename, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", reader.IP("localhost", false))
+	assert.Nil(t, reader.Close())
+	assert.Nil(t, NewReaderByText("").Close())
+	// 关闭后不再重载，已加载的记录仍可读取，且不残留goroutine
+	_ = ioutil.WriteFile(filename, []byte("127.0.1.1 localhost"), 0644)
+	reader.timestamp = time.Now().Add(-time.Hour)
+	assert.Equal(t, "127.0.0.1", reader.IP("localhost", false))
+	assert.True(t, runtime.NumGoroutine() <= before)
+}
+
+func TestTextReader_Types(t *testing.T) {
+	reader := NewReaderByText("1.1.1.1 both alias # comment\n::1 both\n::ffff:2.2.2.2 mapped")
+	// 同一hostname的A、AAAA记录互不影响，同一行的别名均生效
+	assert.Equal(t, "1.1.1.1", reader.IP("both", false))
+	assert.Equal(t, "::1", reader.IP("both", true))
+	assert.Equal(t, "1.1.1.1", reader.IP("alias", false))
+	assert.Equal(t, "", reader.IP("#", false))
+	// ipv4映射的ipv6地址仅用于AAAA记录
+	assert.Equal(t, "", reader.IP("mapped", false))
+	assert.Equal(t, "mapped 0 IN AAAA ::ffff:2.2.2.2", reader.Record("mapped", true))
+	// 别名记录
+	assert.Equal(t, "", reader.CNAME("www"))
+	reader.AddCNAME("www", "both")
+	assert.Equal(t, "both", reader.CNAME("www"))
+}
@@ -0,0 +1,81 @@
+package inbound
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// 拒绝客户端请求时的处理方式
+const (
+	DenyRefused  = "refused"  // 返回REFUSED
+	DenyNXDomain = "nxdomain" // 返回NXDOMAIN
+	DenyDrop     = "drop"     // 不返回响应，避免被用于放大攻击
+)
+
+// ACL 客户端访问控制列表，只允许列表内的ip/网段访问
+type ACL struct {
+	allowed []*net.IPNet
+	action  string
+}
+
+// Allow 判断客户端ip是否允许访问
+func (acl *ACL) Allow(ip net.IP) bool {
+	for _, subnet := range acl.allowed {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deny 生成拒绝请求时的响应，返回nil代表不响应
+func (acl *ACL) Deny(request *dns.Msg) *dns.Msg {
+	switch acl.action {
+	case DenyDrop:
+		return nil
+	case DenyNXDomain:
+		return new(dns.Msg).SetRcode(request, dns.RcodeNameError)
+	default:
+		return new(dns.Msg).SetRcode(request, dns.RcodeRefused)
+	}
+}
+
+// NewACL 创建访问控制列表，allowed为ip/网段列表，action为拒绝方式（为空时默认为refused）
+func NewACL(allowed []string, action string) (acl *ACL, err error) {
+	switch action = strings.ToLower(action); action {
+	case "":
+		action = DenyRefused
+	case DenyRefused, DenyNXDomain, DenyDrop:
+	default:
+		return nil, fmt.Errorf("unknown deny action: %s", action)
+	}
+	acl = &ACL{action: action}
+	for _, cidr := range allowed {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		acl.allowed = append(acl.allowed, subnet)
+	}
+	return acl, nil
+}
+
+// 获取dns请求来源ip
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
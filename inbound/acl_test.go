@@ -0,0 +1,61 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewACL(t *testing.T) {
+	_, err := NewACL(nil, "unknown")
+	assert.NotNil(t, err)
+	_, err = NewACL([]string{"1.1.1"}, "")
+	assert.NotNil(t, err)
+	acl, err := NewACL([]string{"127.0.0.1", "::1", "192.168.0.0/16"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, acl.action, DenyRefused)
+	assert.True(t, acl.Allow(net.ParseIP("127.0.0.1")))
+	assert.True(t, acl.Allow(net.ParseIP("::1")))
+	assert.True(t, acl.Allow(net.ParseIP("192.168.1.1")))
+	assert.False(t, acl.Allow(net.ParseIP("127.0.0.2")))
+	assert.False(t, acl.Allow(nil))
+}
+
+func TestHandler_ACL(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+	}
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	caller := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	// MockRespWriter的来源ip为127.0.0.1
+	for action, rcode := range map[string]int{"": dns.RcodeRefused, DenyRefused: dns.RcodeRefused,
+		DenyNXDomain: dns.RcodeNameError, DenyDrop: -1} {
+		handler.ACL, _ = NewACL([]string{"10.0.0.0/8"}, action)
+		writer := &MockRespWriter{}
+		handler.ServeDNS(writer, req)
+		if rcode == -1 { // 不响应
+			assert.Nil(t, writer.r)
+		} else {
+			assert.Equal(t, writer.r.Rcode, rcode)
+			assert.Empty(t, writer.r.Answer)
+		}
+	}
+	assert.Equal(t, caller.count, 0)
+	// 允许访问
+	handler.ACL, _ = NewACL([]string{"127.0.0.0/8"}, DenyDrop)
+	writer := &MockRespWriter{}
+	handler.ServeDNS(writer, req)
+	assert.Equal(t, writer.r.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, caller.count, 1)
+}
@@ -0,0 +1,148 @@
+package inbound
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/wolf-joe/ts-dns/cache"
+	"net/http"
+	"strconv"
+)
+
+const defaultPageLimit = 100
+
+// AdminHandler 生成管理接口，可能暴露敏感信息，只应监听在AdminListen上
+func (handler *Handler) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/entries", handler.handleCacheEntries)
+	mux.HandleFunc("/cache/stats", handler.handleCacheStats)
+	mux.HandleFunc("/groups/stats", handler.handleGroupStats)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handler.handleReadyz)
+	mux.HandleFunc("/drain", handler.handleDrain)
+	mux.HandleFunc("/reload/status", handler.handleReloadStatus)
+	return mux
+}
+
+// 以json格式写入http响应
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// 读取url中的非负整数参数，参数不存在时返回默认值
+func queryInt(req *http.Request, key string, def int) (int, bool) {
+	raw := req.URL.Query().Get(key)
+	if raw == "" {
+		return def, true
+	}
+	val, err := strconv.Atoi(raw)
+	return val, err == nil && val >= 0
+}
+
+// GET /cache/entries?offset=0&limit=100 分页列出dns缓存条目
+func (handler *Handler) handleCacheEntries(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	offset, ok1 := queryInt(req, "offset", 0)
+	limit, ok2 := queryInt(req, "limit", defaultPageLimit)
+	if !ok1 || !ok2 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid offset/limit"})
+		return
+	}
+	var entries []cache.Entry
+	handler.Mux.RLock()
+	if lister, ok := handler.Cache.(cache.EntryLister); ok { // 外部缓存可能不支持列出条目
+		entries = lister.Entries()
+	}
+	handler.Mux.RUnlock()
+	// 分页
+	total := len(entries)
+	if offset > total {
+		offset = total
+	}
+	if end := offset + limit; end < total {
+		entries = entries[offset:end]
+	} else {
+		entries = entries[offset:]
+	}
+	if entries == nil {
+		entries = []cache.Entry{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total": total, "offset": offset, "limit": limit, "entries": entries,
+	})
+}
+
+// GET /cache/stats 查看缓存的条目数、估算内存占用、过期清除及因已满未写入的次数，缓存不支持时返回404
+func (handler *Handler) handleCacheStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	handler.Mux.RLock()
+	reporter, ok := handler.Cache.(cache.StatsReporter)
+	handler.Mux.RUnlock()
+	if !ok { // 禁用缓存或外部缓存
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cache stats not available"})
+		return
+	}
+	writeJSON(w, http.StatusOK, reporter.Stats())
+}
+
+// GET /groups/stats 列出各组的统计数据，no_callers为因上游均不可用而直接返回SERVFAIL的请求次数
+func (handler *Handler) handleGroupStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	stats := map[string]map[string]uint64{}
+	handler.Mux.RLock()
+	for name, group := range handler.Groups {
+		stats[name] = map[string]uint64{"no_callers": group.NoCallers()}
+	}
+	handler.Mux.RUnlock()
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// GET /healthz 进程存活检测
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET /readyz 就绪检测，配置有效且clean、dirty组（rules-only模式下为默认组）均有可用上游时返回200，否则返回503
+func (handler *Handler) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	if err := handler.Ready(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// GET /drain 查看是否处于排空模式，POST /drain进入排空模式，DELETE /drain退出排空模式
+func (handler *Handler) handleDrain(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		handler.SetDraining(true)
+		log.Warnln("enter drain mode, readyz will report not ready")
+	case http.MethodDelete:
+		handler.SetDraining(false)
+		log.Warnln("leave drain mode")
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": handler.Draining()})
+}
+
+// GET /reload/status 查看配置重载的成功、失败次数及最近一次重载的结果
+func (handler *Handler) handleReloadStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, handler.ReloadStatus())
+}
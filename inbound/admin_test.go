@@ -0,0 +1,185 @@
+package inbound
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdmin_CacheEntries(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour)}
+	for _, name := range []string{"a.cn.", "b.cn.", "c.cn."} {
+		req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(name + " 120 IN A 1.1.1.1")
+		handler.Cache.Set(req, &dns.Msg{Answer: []dns.RR{rr}})
+	}
+	admin := handler.AdminHandler()
+	get := func(url string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		body := map[string]interface{}{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	code, body := get("/cache/entries")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body["total"], float64(3))
+	entries := body["entries"].([]interface{})
+	assert.Len(t, entries, 3)
+	first := entries[0].(map[string]interface{})
+	assert.Equal(t, first["name"], "a.cn.")
+	assert.Equal(t, first["type"], "A")
+	assert.Equal(t, first["records"], float64(1))
+	assert.True(t, first["ttl"].(float64) > 115 && first["ttl"].(float64) <= 120)
+	// 分页
+	_, body = get("/cache/entries?offset=1&limit=1")
+	entries = body["entries"].([]interface{})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, entries[0].(map[string]interface{})["name"], "b.cn.")
+	_, body = get("/cache/entries?offset=10")
+	assert.Len(t, body["entries"], 0)
+	// 参数错误
+	code, _ = get("/cache/entries?limit=-1")
+	assert.Equal(t, code, http.StatusBadRequest)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/cache/entries", nil))
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
+
+func TestAdmin_CacheStats(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(1, time.Minute, time.Hour)}
+	for _, name := range []string{"a.cn.", "b.cn.", "c.cn."} {
+		rr, _ := dns.NewRR(name + " 120 IN A 1.1.1.1")
+		handler.Cache.Set(new(dns.Msg).SetQuestion(name, dns.TypeA), &dns.Msg{Answer: []dns.RR{rr}})
+	}
+	admin := handler.AdminHandler()
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cache/stats", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats cache.Stats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, 1, stats.Size)
+	assert.Equal(t, 1, stats.Capacity)
+	assert.Equal(t, uint64(2), stats.Rejected)
+	assert.True(t, stats.Bytes > 0)
+	// 禁用缓存时返回404
+	handler.Cache = nil
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cache/stats", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/cache/stats", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdmin_Health(t *testing.T) {
+	defer func(ttl time.Duration) { reachableTTL = ttl }(reachableTTL)
+	reachableTTL = 0 // 每次检测均重新探测
+	handler := &Handler{Mux: new(sync.RWMutex)}
+	admin := handler.AdminHandler()
+	get := func(url string) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Code
+	}
+	assert.Equal(t, get("/healthz"), http.StatusOK)
+	// 配置无效
+	assert.Equal(t, get("/readyz"), http.StatusServiceUnavailable)
+	// 上游均不可用
+	failed := &countCaller{}
+	clean := &Group{Callers: []outbound.Caller{failed}}
+	dirty := &Group{Callers: []outbound.Caller{failed}}
+	handler.Groups = map[string]*Group{"clean": clean, "dirty": dirty}
+	assert.Equal(t, get("/readyz"), http.StatusServiceUnavailable)
+	// 仅clean组可用
+	clean.Callers = append(clean.Callers, &countCaller{resp: &dns.Msg{}})
+	assert.Equal(t, get("/readyz"), http.StatusServiceUnavailable)
+	// clean、dirty组均可用
+	dirty.Callers = append(dirty.Callers, &countCaller{resp: &dns.Msg{}})
+	assert.Equal(t, get("/readyz"), http.StatusOK)
+	assert.Equal(t, get("/healthz"), http.StatusOK)
+}
+
+func TestGroup_Reachable(t *testing.T) {
+	caller := &countCaller{resp: &dns.Msg{}}
+	group := &Group{Callers: []outbound.Caller{caller}}
+	// 缓存时长内复用探测结果
+	assert.True(t, group.Reachable())
+	assert.True(t, group.Reachable())
+	assert.Equal(t, 1, caller.count)
+	caller.resp = nil
+	assert.True(t, group.Reachable())
+	assert.Equal(t, 1, caller.count)
+	// 超出缓存时长后重新探测，失败结果同样缓存
+	group.probed = 0
+	assert.False(t, group.Reachable())
+	assert.False(t, group.Reachable())
+	assert.Equal(t, 2, caller.count)
+}
+
+func TestAdmin_Drain(t *testing.T) {
+	ok := &countCaller{resp: answerA("1.1.1.1")}
+	group := &Group{Callers: []outbound.Caller{ok}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups: map[string]*Group{"clean": group, "dirty": group}}
+	admin := handler.AdminHandler()
+	do := func(method, url string) (int, string) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+	code, _ := do(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	_, body := do(http.MethodGet, "/drain")
+	assert.Equal(t, `{"draining":false}`, body)
+	// 进入排空模式后/readyz返回503，/healthz及请求处理不受影响
+	code, body = do(http.MethodPost, "/drain")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"draining":true}`, body)
+	code, body = do(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "draining")
+	code, _ = do(http.MethodGet, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	r, _ := handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// 配置重载不影响排空状态
+	handler.Refresh(&Handler{Mux: new(sync.RWMutex), Groups: handler.Groups})
+	assert.True(t, handler.Draining())
+	// 退出排空模式
+	code, body = do(http.MethodDelete, "/drain")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"draining":false}`, body)
+	code, _ = do(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do(http.MethodPut, "/drain")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestAdmin_GroupStats(t *testing.T) {
+	group := &Group{noCallers: 3}
+	handler := &Handler{Mux: new(sync.RWMutex), Groups: map[string]*Group{"clean": group, "dirty": {}}}
+	admin := handler.AdminHandler()
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/groups/stats", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats map[string]map[string]uint64
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, uint64(3), stats["clean"]["no_callers"])
+	assert.Equal(t, uint64(0), stats["dirty"]["no_callers"])
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/groups/stats", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
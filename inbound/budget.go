@@ -0,0 +1,44 @@
+package inbound
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/outbound"
+)
+
+// 返回单个请求向上游转发时使用的ctx，parent结束或QueryBudget大于0且超出预算后ctx结束
+func (handler *Handler) budgetContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if handler.QueryBudget <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, handler.QueryBudget)
+}
+
+// 使用ctx调用caller，ctx不会结束时直接调用caller.Call。caller未实现outbound.ContextCaller时在后台调用，
+// ctx结束后立即返回而不等待其完成
+func callWithin(ctx context.Context, caller outbound.Caller, request *dns.Msg) (*dns.Msg, error) {
+	if ctx.Done() == nil {
+		return caller.Call(request)
+	}
+	if _, ok := caller.(outbound.ContextCaller); ok {
+		return outbound.CallContext(ctx, caller, request)
+	}
+	type result struct {
+		r   *dns.Msg
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		r, err := caller.Call(request)
+		ch <- result{r: r, err: err}
+	}()
+	select {
+	case res := <-ch:
+		return res.r, res.err
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return nil, outbound.ErrCanceled
+		}
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,89 @@
+package inbound
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandler_QueryBudget(t *testing.T) {
+	servFail := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	slow := &delayCaller{delay: 80 * time.Millisecond, resp: servFail}
+	last := &countCaller{resp: &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}}}
+	group := &Group{Callers: []outbound.Caller{slow, slow, slow, last}}
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(), RoutingMode: RoutingRulesOnly,
+		DefaultGroup: "default", Groups: map[string]*Group{"default": group}, QueryBudget: 200 * time.Millisecond}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	// 依次failover的总耗时不超过预算，超出后返回已收到的失败响应
+	begin := time.Now()
+	r, _ := handler.Query(req)
+	assert.True(t, time.Since(begin) < 300*time.Millisecond)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	assert.Equal(t, 0, last.count)
+	// 单个上游无响应时同样在预算内返回SERVFAIL
+	group.Callers = []outbound.Caller{&delayCaller{delay: time.Second, resp: servFail}, last}
+	begin = time.Now()
+	r, _ = handler.Query(req)
+	assert.True(t, time.Since(begin) < 300*time.Millisecond)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	assert.Equal(t, 0, last.count)
+	// 并发模式下同样受预算限制
+	group.Callers[1], group.Concurrent = group.Callers[0], true
+	begin = time.Now()
+	r, _ = handler.Query(req)
+	assert.True(t, time.Since(begin) < 300*time.Millisecond)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	group.Concurrent = false
+	// 未设置预算时尝试所有上游
+	handler.QueryBudget = 0
+	group.Callers = []outbound.Caller{slow, slow, slow, last}
+	r, _ = handler.Query(req)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 1, last.count)
+}
+
+func TestHandler_QueryBudgetCNIP(t *testing.T) {
+	clean := &delayCaller{delay: 150 * time.Millisecond, resp: answerA("8.8.8.8")}
+	dirty := &delayCaller{delay: 150 * time.Millisecond, resp: answerA("9.9.9.9")}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText("||example.com"), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		QueryLogger: log.New(), QueryBudget: 200 * time.Millisecond, Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{clean}},
+			"dirty": {Callers: []outbound.Caller{dirty}},
+		}}
+	// clean、dirty组先后请求的总耗时同样不超过预算
+	begin := time.Now()
+	r, result := handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.True(t, time.Since(begin) < 300*time.Millisecond)
+	assert.Equal(t, "match gfwlist", result.Reason)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+}
+
+func TestCallWithin(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	caller := &delayCaller{delay: 200 * time.Millisecond, resp: answerA("1.1.1.1")}
+	// ctx不会结束时直接调用
+	r, err := callWithin(context.Background(), caller, req)
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	// 不支持取消的caller在ctx结束后立即返回
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	_, err = callWithin(ctx, caller, req)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(begin) < 150*time.Millisecond)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = callWithin(ctx, caller, req)
+	assert.Equal(t, outbound.ErrCanceled, err)
+}
@@ -0,0 +1,114 @@
+package inbound
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCanaryTimeout 启动自检时每个组解析探测域名的默认超时
+const DefaultCanaryTimeout = 5 * time.Second
+
+// Canary 启动自检的配置：通过每个组解析Domain，检查组内上游配置是否可用
+type Canary struct {
+	Domain   string        // 已知可正常解析的探测域名
+	Required []string      // 必须能解析探测域名的组，任一组解析失败时自检失败，为空时只输出警告
+	Timeout  time.Duration // 每个组解析探测域名的超时，为0时使用DefaultCanaryTimeout
+	Minimize bool          // 为true时参考QNAME minimisation（RFC 7816）只查询探测域名顶级域的NS记录，不向上游发送完整域名
+}
+
+// 生成探测请求
+func (canary *Canary) request() *dns.Msg {
+	name := dns.Fqdn(canary.Domain)
+	if !canary.Minimize {
+		return new(dns.Msg).SetQuestion(name, dns.TypeA)
+	}
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 0 {
+		return probeRequest()
+	}
+	return new(dns.Msg).SetQuestion(dns.Fqdn(labels[len(labels)-1]), dns.TypeNS)
+}
+
+// SelfTest 通过每个组解析探测域名，解析失败的组输出警告，Canary.Required中的组解析失败时返回错误。
+// 未配置Canary时直接返回nil。探测期间不持有读锁，可在启动dns服务后调用
+func (handler *Handler) SelfTest() error {
+	handler.Mux.RLock()
+	canary := handler.Canary
+	handler.Mux.RUnlock()
+	if canary == nil || canary.Domain == "" {
+		return nil
+	}
+	errs := handler.canaryResults()
+	var failed []string
+	for _, name := range canary.Required {
+		if errs[name] != nil {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("canary %s failed in required group %s", canary.Domain, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// 依次通过每个组解析探测域名，返回组名 -> 解析结果（成功时为nil）
+func (handler *Handler) canaryResults() map[string]error {
+	handler.Mux.RLock()
+	canary, groups := handler.Canary, handler.Groups
+	handler.Mux.RUnlock()
+	timeout := canary.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCanaryTimeout
+	}
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	request := canary.request()
+	errs := map[string]error{}
+	for _, name := range names {
+		fields := log.Fields{"group": name, "domain": canary.Domain}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		errs[name] = canaryError(groups[name].CallDNSContext(ctx, request))
+		cancel()
+		if errs[name] != nil {
+			log.WithFields(fields).Warnf("self test failed: %v", errs[name])
+		} else {
+			log.WithFields(fields).Infof("self test passed")
+		}
+	}
+	return errs
+}
+
+// 判断探测域名的响应是否有效：需返回NOERROR且包含至少一条记录
+func canaryError(r *dns.Msg) error {
+	switch {
+	case r == nil:
+		return fmt.Errorf("no response")
+	case r.Rcode != dns.RcodeSuccess:
+		return fmt.Errorf("got %s", dns.RcodeToString[r.Rcode])
+	case len(r.Answer) == 0:
+		return fmt.Errorf("empty answer")
+	}
+	return nil
+}
+
+// 检查Canary.Required中的组是否存在
+func (handler *Handler) checkCanary() bool {
+	if handler.Canary == nil {
+		return true
+	}
+	for _, name := range handler.Canary.Required {
+		if _, ok := handler.Groups[name]; !ok {
+			log.Errorf("canary required group %q not found", name)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandler_SelfTest(t *testing.T) {
+	clean := &recordCaller{resp: answerA("1.1.1.1")}
+	dirty := &staticCaller{resp: new(dns.Msg).SetRcode(new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+		dns.RcodeServerFailure)}
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(), GFWMatcher: matcher.NewABPByText(""),
+		Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{clean}},
+			"dirty": {Callers: []outbound.Caller{dirty}},
+			"empty": {},
+		}}
+	// 未配置时不自检
+	assert.Nil(t, handler.SelfTest())
+	assert.Nil(t, clean.request)
+
+	// 解析失败的组只输出警告
+	handler.Canary = &Canary{Domain: "example.com", Timeout: time.Second}
+	assert.True(t, handler.IsValid())
+	assert.Nil(t, handler.SelfTest())
+	assert.Equal(t, "example.com.", clean.request.Question[0].Name)
+	errs := handler.canaryResults()
+	assert.Nil(t, errs["clean"])
+	assert.EqualError(t, errs["dirty"], "got SERVFAIL")
+	assert.EqualError(t, errs["empty"], "no response")
+	// 必需的组解析失败时返回错误
+	handler.Canary.Required = []string{"clean"}
+	assert.Nil(t, handler.SelfTest())
+	handler.Canary.Required = []string{"clean", "dirty", "empty"}
+	assert.EqualError(t, handler.SelfTest(), "canary example.com failed in required group dirty, empty")
+	// 必需的组不存在时配置无效
+	handler.Canary.Required = []string{"unknown"}
+	assert.False(t, handler.IsValid())
+
+	// 最小化探测请求只查询顶级域的NS记录
+	handler.Canary = &Canary{Domain: "www.example.com", Timeout: time.Second, Minimize: true}
+	assert.Nil(t, handler.SelfTest())
+	assert.Equal(t, "com.", clean.request.Question[0].Name)
+	assert.Equal(t, dns.TypeNS, clean.request.Question[0].Qtype)
+	assert.Equal(t, ".", (&Canary{Domain: ".", Minimize: true}).request().Question[0].Name)
+
+	// 空响应同样视为失败
+	assert.EqualError(t, canaryError(new(dns.Msg)), "empty answer")
+}
@@ -0,0 +1,55 @@
+package inbound
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// DefaultCNAMELimit Handler.CNAMELimit未设置时允许的CNAME链最大长度
+const DefaultCNAMELimit = 16
+
+// 从请求的域名出发沿响应中的CNAME记录逐级查找，出现循环或长度超过max时返回错误。不在链上的CNAME记录不参与计数
+func checkCNAMEChain(r *dns.Msg, qname string, max int) error {
+	if r == nil {
+		return nil
+	}
+	targets := map[string]string{}
+	for _, rr := range r.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[strings.ToLower(cname.Hdr.Name)] = strings.ToLower(cname.Target)
+		}
+	}
+	name, visited := strings.ToLower(qname), map[string]bool{}
+	for length := 0; ; length++ {
+		target, ok := targets[name]
+		if !ok {
+			return nil
+		}
+		if visited[name] {
+			return fmt.Errorf("cname loop at %s", name)
+		}
+		if length >= max {
+			return fmt.Errorf("cname chain of %s longer than %d", qname, max)
+		}
+		visited[name], name = true, target
+	}
+}
+
+// 返回允许的CNAME链最大长度
+func (handler *Handler) cnameLimit() int {
+	if handler.CNAMELimit > 0 {
+		return handler.CNAMELimit
+	}
+	return DefaultCNAMELimit
+}
+
+// 检查上游响应的CNAME链，出现循环或过长时输出警告并返回nil（视为上游请求失败）
+func (handler *Handler) checkChain(request, r *dns.Msg) *dns.Msg {
+	if err := checkCNAMEChain(r, request.Question[0].Name, handler.cnameLimit()); err != nil {
+		log.Warnf("reject upstream response: %v", err)
+		return nil
+	}
+	return r
+}
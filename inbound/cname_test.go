@@ -0,0 +1,78 @@
+package inbound
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+)
+
+// 生成由一系列CNAME记录及末尾A记录组成的响应
+func chainResponse(records ...string) *dns.Msg {
+	r := new(dns.Msg)
+	for _, record := range records {
+		rr, _ := dns.NewRR(record)
+		r.Answer = append(r.Answer, rr)
+	}
+	return r
+}
+
+// 生成长度为n的CNAME链
+func longChain(n int) *dns.Msg {
+	var records []string
+	name := "example.com."
+	for i := 0; i < n; i++ {
+		target := fmt.Sprintf("c%d.example.com.", i)
+		records = append(records, name+" 60 IN CNAME "+target)
+		name = target
+	}
+	return chainResponse(append(records, name+" 60 IN A 1.1.1.1")...)
+}
+
+func TestCheckCNAMEChain(t *testing.T) {
+	assert.Nil(t, checkCNAMEChain(nil, "example.com.", 3))
+	assert.Nil(t, checkCNAMEChain(longChain(0), "example.com.", 3))
+	assert.Nil(t, checkCNAMEChain(longChain(3), "Example.COM.", 3))
+	assert.NotNil(t, checkCNAMEChain(longChain(4), "example.com.", 3))
+	// 循环链
+	loop := chainResponse("example.com. 60 IN CNAME a.example.com.", "a.example.com. 60 IN CNAME example.com.")
+	assert.NotNil(t, checkCNAMEChain(loop, "example.com.", 16))
+	self := chainResponse("example.com. 60 IN CNAME example.com.")
+	assert.NotNil(t, checkCNAMEChain(self, "example.com.", 16))
+	// 不在链上的CNAME记录不计数
+	other := longChain(2)
+	other.Answer = append(other.Answer, longChain(10).Answer...)
+	for i := range other.Answer[2:] {
+		other.Answer[2+i].Header().Name = "other-" + other.Answer[2+i].Header().Name
+	}
+	assert.Nil(t, checkCNAMEChain(other, "example.com.", 3))
+}
+
+func TestHandler_CNAMELimit(t *testing.T) {
+	caller := &countCaller{resp: longChain(DefaultCNAMELimit + 1)}
+	group := &Group{Callers: []outbound.Caller{caller}}
+	handler := &Handler{Mux: new(sync.RWMutex), GFWMatcher: matcher.NewABPByText(""),
+		CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups:  map[string]*Group{"clean": group, "dirty": group},
+		Forward: map[string]outbound.Caller{"forward.com": caller}}
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+	// 默认长度上限下过长的链被拒绝
+	r, _ := handler.Query(req)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	// 调整上限后正常返回
+	handler.CNAMELimit = DefaultCNAMELimit + 1
+	r, _ = handler.Query(req)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Len(t, r.Answer, DefaultCNAMELimit+2)
+	// 循环链被拒绝，转发规则同样生效
+	caller.resp = chainResponse("forward.com. 60 IN CNAME a.forward.com.", "a.forward.com. 60 IN CNAME forward.com.")
+	r, result := handler.Query(new(dns.Msg).SetQuestion("forward.com.", dns.TypeA))
+	assert.Equal(t, "match forward forward.com", result.Reason)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+}
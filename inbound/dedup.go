@@ -0,0 +1,78 @@
+package inbound
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/cache"
+	"net"
+	"time"
+)
+
+// 同一客户端的一次请求及其处理结果，供DedupWindow内的重复请求复用
+type dedupEntry struct {
+	done   chan struct{} // 处理完成后关闭
+	expire time.Time     // 首个请求到达时间+DedupWindow
+	r      *dns.Msg
+	result *QueryResult
+}
+
+// 同queryContext，但DedupWindow内来自同一客户端（及监听地址）的相同请求（域名、类型、类、CD标志位、ECS子网均相同）只处理一次：处理中的请求等待
+// 首个请求的结果，已完成的请求直接复用其响应。可避免客户端重传或伪造源地址的放大攻击导致并发的上游请求
+func (handler *Handler) dedupQuery(ctx context.Context, request *dns.Msg, client net.IP) (*dns.Msg, *QueryResult) {
+	if handler.DedupWindow <= 0 || client == nil {
+		return handler.queryContext(ctx, request, client)
+	}
+	key, now := listenerFrom(ctx)+"|"+client.String()+"|"+cache.Key(request), time.Now()
+	handler.dedupMux.Lock()
+	if handler.dedupMap == nil {
+		handler.dedupMap = map[string]*dedupEntry{}
+	}
+	if entry := handler.dedupMap[key]; entry != nil && (now.Before(entry.expire) || !isDone(entry.done)) {
+		handler.dedupMux.Unlock()
+		<-entry.done
+		return duplicateOf(request, entry)
+	}
+	entry := &dedupEntry{done: make(chan struct{}), expire: now.Add(handler.DedupWindow)}
+	handler.dedupMap[key] = entry
+	handler.dedupMux.Unlock()
+
+	r, result := handler.queryContext(ctx, request, client)
+	if r != nil {
+		entry.r = r.Copy() // r在返回客户端前可能被修改
+	}
+	entry.result = result
+	close(entry.done)
+	// 超出窗口后移除，期间同一key可能已被新的请求替换
+	time.AfterFunc(time.Until(entry.expire), func() {
+		handler.dedupMux.Lock()
+		if handler.dedupMap[key] == entry {
+			delete(handler.dedupMap, key)
+		}
+		handler.dedupMux.Unlock()
+	})
+	return r, result
+}
+
+// 判断channel是否已关闭
+func isDone(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 以entry中首个请求的结果响应重复的请求，不再写入IPSet
+func duplicateOf(request *dns.Msg, entry *dedupEntry) (*dns.Msg, *QueryResult) {
+	result := &QueryResult{Reason: "duplicate query"}
+	if entry.result != nil {
+		result.Group, result.Rule = entry.result.Group, entry.result.Rule
+	}
+	if entry.r == nil {
+		return nil, result
+	}
+	r := entry.r.Copy()
+	r.Id = request.Id
+	return r, result
+}
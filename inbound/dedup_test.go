@@ -0,0 +1,74 @@
+package inbound
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandler_Dedup(t *testing.T) {
+	caller := &swapCaller{resp: answerA("1.1.1.1"), delay: 50 * time.Millisecond}
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(), DedupWindow: 200 * time.Millisecond,
+		GFWMatcher: matcher.NewABPByText(""), Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("||example.com")},
+		}}
+	client := net.IPv4(10, 0, 0, 1)
+	newReq := func(id uint16) *dns.Msg {
+		req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+		req.Id = id
+		return req
+	}
+
+	// 处理中的重复请求等待首个请求的结果，只请求一次上游
+	var wg sync.WaitGroup
+	results := make([]string, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, result := handler.dedupQuery(context.Background(), newReq(uint16(i+1)), client)
+			assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+			results[i] = result.Reason
+		}(i)
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	assert.Equal(t, []string{"match by rules", "duplicate query"}, results)
+	assert.Equal(t, 1, caller.calls())
+	// 窗口内已完成的请求直接复用
+	r, result := handler.dedupQuery(context.Background(), newReq(3), client)
+	assert.Equal(t, "duplicate query", result.Reason)
+	assert.Equal(t, "clean", result.Group)
+	assert.Equal(t, uint16(3), r.Id)
+	assert.Equal(t, 1, caller.calls())
+	// 其它客户端及不同类型的请求不受影响
+	_, result = handler.dedupQuery(context.Background(), newReq(4), net.IPv4(10, 0, 0, 2))
+	assert.Equal(t, "match by rules", result.Reason)
+	_, result = handler.dedupQuery(context.Background(), new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA), client)
+	assert.Equal(t, "match by rules", result.Reason)
+	assert.Equal(t, 3, caller.calls())
+
+	// 超出窗口后重新处理，并移除过期的记录
+	time.Sleep(250 * time.Millisecond)
+	_, result = handler.dedupQuery(context.Background(), newReq(5), client)
+	assert.Equal(t, "match by rules", result.Reason)
+	assert.Equal(t, 4, caller.calls())
+	assert.Eventually(t, func() bool {
+		handler.dedupMux.Lock()
+		defer handler.dedupMux.Unlock()
+		return len(handler.dedupMap) == 0
+	}, time.Second, 20*time.Millisecond)
+
+	// 未启用时不去重
+	handler.DedupWindow = 0
+	handler.ServeDNS(&MockRespWriter{}, newReq(6))
+	handler.ServeDNS(&MockRespWriter{}, newReq(7))
+	assert.Equal(t, 6, caller.calls())
+}
@@ -0,0 +1,68 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"net"
+)
+
+// 获取dns请求或响应中的ECS选项，不存在时返回nil
+func getECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+	}
+	return nil
+}
+
+// 返回替换ECS选项后的副本，不修改原消息
+func replaceECS(msg *dns.Msg, ecs *dns.EDNS0_SUBNET) *dns.Msg {
+	msg = msg.Copy()
+	opt := msg.IsEdns0()
+	for i, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_SUBNET); ok {
+			opt.Option[i] = ecs
+		}
+	}
+	return msg
+}
+
+// 客户端请求携带的ECS前缀长度超出ECSMaxPrefix（IPv6为ECSMaxPrefix6）时，截断至该长度后再转发至上游（及生成缓存key），
+// 避免向上游泄露客户端的完整地址。需要修改时返回副本
+func (handler *Handler) clampECS(request *dns.Msg) *dns.Msg {
+	ecs := getECS(request)
+	if ecs == nil {
+		return request
+	}
+	bits, max := 32, handler.ECSMaxPrefix
+	if ecs.Family == 2 {
+		bits, max = 128, handler.ECSMaxPrefix6
+	}
+	if max <= 0 || ecs.SourceNetmask <= max {
+		return request
+	}
+	clamped := *ecs
+	clamped.SourceNetmask = max
+	clamped.Address = ecs.Address.Mask(net.CIDRMask(int(max), bits))
+	return replaceECS(request, &clamped)
+}
+
+// 响应中的ECS与客户端请求不一致（如经clampECS截断）时，按RFC 7871恢复为请求中的地址及前缀长度，
+// SCOPE PREFIX-LENGTH不超过请求的前缀长度。需要修改时返回副本
+func restoreECS(request, r *dns.Msg) *dns.Msg {
+	reqECS, respECS := getECS(request), getECS(r)
+	if reqECS == nil || respECS == nil {
+		return r
+	}
+	if respECS.Family == reqECS.Family && respECS.SourceNetmask == reqECS.SourceNetmask &&
+		respECS.Address.Equal(reqECS.Address) {
+		return r
+	}
+	restored := *reqECS
+	if restored.SourceScope = respECS.SourceScope; restored.SourceScope > reqECS.SourceNetmask {
+		restored.SourceScope = reqECS.SourceNetmask
+	}
+	return replaceECS(r, &restored)
+}
@@ -0,0 +1,94 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟支持ECS的上游：记录收到的请求，并在响应中回显请求的ECS，SCOPE PREFIX-LENGTH同SOURCE PREFIX-LENGTH
+type ecsCaller struct {
+	request *dns.Msg
+}
+
+func (caller *ecsCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	caller.request = request
+	r = withQuestion(request, answerA("1.1.1.1"))
+	if ecs := getECS(request); ecs != nil {
+		echo := *ecs
+		echo.SourceScope = ecs.SourceNetmask
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &echo)
+	}
+	return r, nil
+}
+
+// 生成携带ECS的请求
+func ecsRequest(ip string, prefix uint8) *dns.Msg {
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: prefix, Address: net.ParseIP(ip)}
+	if ecs.Address.To4() == nil {
+		ecs.Family = 2
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, ecs)
+	return req
+}
+
+func TestHandler_ClampECS(t *testing.T) {
+	caller := &ecsCaller{}
+	group := &Group{Callers: []outbound.Caller{caller}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"), QueryLogger: log.New(),
+		Groups: map[string]*Group{"clean": group, "dirty": group}, ECSMaxPrefix: 24, ECSMaxPrefix6: 56}
+
+	// 客户端的/32 ECS截断为/24后转发至上游，不修改原请求
+	req := ecsRequest("192.0.2.123", 32)
+	writer := &MockRespWriter{}
+	handler.ServeDNS(writer, req)
+	ecs := getECS(caller.request)
+	assert.Equal(t, uint8(24), ecs.SourceNetmask)
+	assert.Equal(t, "192.0.2.0", ecs.Address.String())
+	assert.Equal(t, uint8(32), getECS(req).SourceNetmask)
+	// 响应中的ECS恢复为客户端请求的值
+	ecs = getECS(writer.r)
+	assert.Equal(t, uint8(32), ecs.SourceNetmask)
+	assert.Equal(t, "192.0.2.123", ecs.Address.String())
+	assert.Equal(t, uint8(24), ecs.SourceScope)
+	// 同一/24网段内的客户端命中截断后的缓存
+	caller.request = nil
+	writer = &MockRespWriter{}
+	handler.ServeDNS(writer, ecsRequest("192.0.2.45", 32))
+	assert.Nil(t, caller.request)
+	assert.Equal(t, "192.0.2.45", getECS(writer.r).Address.String())
+
+	// 不超出时原样转发
+	handler.ServeDNS(&MockRespWriter{}, ecsRequest("198.51.100.0", 16))
+	ecs = getECS(caller.request)
+	assert.Equal(t, uint8(16), ecs.SourceNetmask)
+	assert.Equal(t, "198.51.100.0", ecs.Address.String())
+	// IPv6按ECSMaxPrefix6截断
+	handler.ServeDNS(&MockRespWriter{}, ecsRequest("2001:db8:1:2:3::1", 128))
+	ecs = getECS(caller.request)
+	assert.Equal(t, uint8(56), ecs.SourceNetmask)
+	assert.Equal(t, "2001:db8:1::", ecs.Address.String())
+	// 未携带ECS的请求不受影响
+	handler.ServeDNS(&MockRespWriter{}, new(dns.Msg).SetQuestion("example.org.", dns.TypeA))
+	assert.Nil(t, getECS(caller.request))
+
+	// 未配置时不截断
+	handler.ECSMaxPrefix = 0
+	handler.ServeDNS(&MockRespWriter{}, ecsRequest("203.0.113.7", 32))
+	ecs = getECS(caller.request)
+	assert.Equal(t, uint8(32), ecs.SourceNetmask)
+	assert.Equal(t, "203.0.113.7", ecs.Address.String())
+}
@@ -0,0 +1,30 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+)
+
+// 为请求附加EDNS0选项，请求中已有的同代码选项会被替换。返回修改后的副本，不修改原请求
+func injectOptions(request *dns.Msg, options []dns.EDNS0) *dns.Msg {
+	if len(options) == 0 {
+		return request
+	}
+	request = request.Copy()
+	opt := request.IsEdns0()
+	if opt == nil {
+		request.SetEdns0(dns.DefaultMsgSize, false)
+		opt = request.IsEdns0()
+	}
+	replaced := map[uint16]bool{}
+	for _, option := range options {
+		replaced[option.Option()] = true
+	}
+	kept := make([]dns.EDNS0, 0, len(opt.Option)+len(options))
+	for _, option := range opt.Option {
+		if !replaced[option.Option()] {
+			kept = append(kept, option)
+		}
+	}
+	opt.Option = append(kept, options...)
+	return request
+}
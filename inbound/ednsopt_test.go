@@ -0,0 +1,63 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"testing"
+)
+
+// 返回请求中指定代码的EDNS0选项数据，不存在时ok为false
+func optionData(request *dns.Msg, code uint16) (data []byte, ok bool) {
+	if opt := request.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if local, isLocal := option.(*dns.EDNS0_LOCAL); isLocal && local.Code == code {
+				return local.Data, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func TestInjectOptions(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	assert.Equal(t, req, injectOptions(req, nil))
+	// 无OPT记录时新建
+	r := injectOptions(req, []dns.EDNS0{&dns.EDNS0_LOCAL{Code: 65100, Data: []byte{1}}})
+	assert.Nil(t, req.IsEdns0()) // 不修改原请求
+	data, ok := optionData(r, 65100)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1}, data)
+	// 替换同代码选项，保留其余选项及UDP大小
+	req.SetEdns0(4096, true)
+	req.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_LOCAL{Code: 65100, Data: []byte{9}}, &dns.EDNS0_NSID{Code: dns.EDNS0NSID}}
+	r = injectOptions(req, []dns.EDNS0{&dns.EDNS0_LOCAL{Code: 65100, Data: []byte{2}}})
+	assert.Len(t, r.IsEdns0().Option, 2)
+	assert.Equal(t, uint16(4096), r.IsEdns0().UDPSize())
+	data, _ = optionData(r, 65100)
+	assert.Equal(t, []byte{2}, data)
+	data, _ = optionData(req, 65100)
+	assert.Equal(t, []byte{9}, data)
+}
+
+func TestGroup_EDNSOptions(t *testing.T) {
+	// 上游记录实际收到的请求
+	received := make(chan *dns.Msg, 1)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		received <- req
+		_ = w.WriteMsg(answerA("1.1.1.1").SetReply(req))
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	group := &Group{Callers: []outbound.Caller{outbound.NewDNSCaller(conn.LocalAddr().String(), "udp", nil)},
+		EDNSOptions: []dns.EDNS0{&dns.EDNS0_LOCAL{Code: 65100, Data: []byte{0xde, 0xad, 0xbe, 0xef}}}}
+	r := group.CallDNS(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.NotNil(t, r)
+	data, ok := optionData(<-received, 65100)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, data)
+}
@@ -0,0 +1,57 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"sort"
+)
+
+// 非必需组（除clean、dirty及默认组外的组）内无上游时的处理方式
+const (
+	EmptyGroupServFail = "servfail" // 返回SERVFAIL，加载配置时输出警告
+	EmptyGroupSinkhole = "sinkhole" // 返回NXDOMAIN，可用于屏蔽匹配组规则的域名
+	EmptyGroupError    = "error"    // 视为配置错误，拒绝加载
+)
+
+// 检查非必需组内无上游时的处理方式，EmptyGroup为EmptyGroupError且存在空组时返回false
+func (handler *Handler) checkEmptyGroups() bool {
+	switch handler.EmptyGroup {
+	case "", EmptyGroupServFail, EmptyGroupSinkhole, EmptyGroupError:
+	default:
+		log.Errorf("unknown empty group behavior: %q", handler.EmptyGroup)
+		return false
+	}
+	required := map[string]bool{}
+	for _, name := range handler.requiredGroups() {
+		required[name] = true
+	}
+	var names []string
+	for name, group := range handler.Groups {
+		if !required[name] && group != nil && len(group.Callers) == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch handler.EmptyGroup {
+		case EmptyGroupError:
+			log.Errorf("dns of group %q cannot be empty", name)
+			return false
+		case EmptyGroupSinkhole:
+			log.Infof("group %q has no dns, matched queries will get NXDOMAIN", name)
+		default:
+			log.Warnf("group %q has no dns, matched queries will get SERVFAIL", name)
+		}
+	}
+	return true
+}
+
+// 组内无上游且EmptyGroup为EmptyGroupSinkhole时返回携带合成SOA的NXDOMAIN响应，否则返回nil
+func (handler *Handler) sinkhole(group *Group, request *dns.Msg) *dns.Msg {
+	if handler.EmptyGroup != EmptyGroupSinkhole || len(group.Callers) > 0 {
+		return nil
+	}
+	r := new(dns.Msg).SetRcode(request, dns.RcodeNameError)
+	r.Ns = []dns.RR{synthSOA(handler.soaOwner(request.Question[0].Name), negativeTTL)}
+	return r
+}
@@ -0,0 +1,62 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+)
+
+// 生成包含一个无上游的额外组的Handler
+func emptyGroupHandler(behavior string) *Handler {
+	caller := &staticCaller{resp: answerA("1.1.1.1")}
+	return &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(), EmptyGroup: behavior,
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{caller}},
+			"dirty": {Callers: []outbound.Caller{caller}},
+			"block": {Matcher: matcher.NewABPByText("||ads.example.com")},
+		}}
+}
+
+func TestHandler_EmptyGroup(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("ads.example.com.", dns.TypeA)
+	// 默认返回SERVFAIL
+	for _, behavior := range []string{"", EmptyGroupServFail} {
+		handler := emptyGroupHandler(behavior)
+		assert.True(t, handler.IsValid())
+		r, result := handler.Query(req)
+		assert.Equal(t, "block", result.Group)
+		assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	}
+	// sinkhole时返回携带SOA的NXDOMAIN
+	handler := emptyGroupHandler(EmptyGroupSinkhole)
+	assert.True(t, handler.IsValid())
+	r, result := handler.Query(req)
+	assert.Equal(t, "block", result.Group)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	assert.Equal(t, "ads.example.com.", r.Ns[0].Header().Name)
+	assert.Len(t, r.Ns, 1)
+	assert.Equal(t, uint16(dns.TypeSOA), r.Ns[0].Header().Rrtype)
+	// 包含上游的组不受影响
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// error时拒绝加载
+	assert.False(t, emptyGroupHandler(EmptyGroupError).IsValid())
+	assert.False(t, emptyGroupHandler("unknown").IsValid())
+	handler = emptyGroupHandler(EmptyGroupError)
+	handler.Groups["block"].Callers = []outbound.Caller{&staticCaller{}}
+	assert.True(t, handler.IsValid())
+
+	// rules-only模式下默认组为必需组，其余组同样按EmptyGroup处理
+	handler = emptyGroupHandler(EmptyGroupError)
+	handler.RoutingMode, handler.DefaultGroup = RoutingRulesOnly, "clean"
+	delete(handler.Groups, "dirty")
+	assert.False(t, handler.IsValid())
+	handler.EmptyGroup = EmptyGroupSinkhole
+	assert.True(t, handler.IsValid())
+}
@@ -0,0 +1,47 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"net"
+)
+
+// Fallback 所有上游均请求失败时返回的静态A/AAAA响应（如sinkhole、认证页面ip），为nil时返回SERVFAIL
+type Fallback struct {
+	A    net.IP // 为nil时A请求仍返回SERVFAIL
+	AAAA net.IP // 为nil时AAAA请求仍返回SERVFAIL
+	TTL  uint32
+}
+
+// Answer 生成request对应的静态响应，未配置对应类型或请求类非IN时返回nil
+func (fallback *Fallback) Answer(request *dns.Msg) *dns.Msg {
+	if fallback == nil || len(request.Question) == 0 || request.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := request.Question[0]
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: fallback.TTL}
+	var rr dns.RR
+	switch {
+	case question.Qtype == dns.TypeA && fallback.A != nil:
+		rr = &dns.A{Hdr: hdr, A: fallback.A}
+	case question.Qtype == dns.TypeAAAA && fallback.AAAA != nil:
+		rr = &dns.AAAA{Hdr: hdr, AAAA: fallback.AAAA}
+	default:
+		return nil
+	}
+	r := new(dns.Msg).SetReply(request)
+	r.Answer = []dns.RR{rr}
+	return r
+}
+
+// 如r为SERVFAIL且配置了对应类型的Fallback，则替换为静态响应。静态响应不写入IPSet
+func (handler *Handler) fallback(request, r *dns.Msg, result *QueryResult) *dns.Msg {
+	if r.Rcode != dns.RcodeServerFailure {
+		return r
+	}
+	if answer := handler.Fallback.Answer(request); answer != nil {
+		result.Reason += " (fallback)"
+		result.group = nil
+		return answer
+	}
+	return r
+}
@@ -0,0 +1,54 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestFallback_Answer(t *testing.T) {
+	var fallback *Fallback
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	assert.Nil(t, fallback.Answer(req))
+	fallback = &Fallback{A: net.IPv4(10, 0, 0, 1), TTL: 10}
+	r := fallback.Answer(req)
+	assert.Equal(t, req.Id, r.Id)
+	assert.Equal(t, "ip.cn.\t10\tIN\tA\t10.0.0.1", r.Answer[0].String())
+	// 未配置AAAA
+	assert.Nil(t, fallback.Answer(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeAAAA)))
+	fallback.AAAA = net.ParseIP("fd00::1")
+	r = fallback.Answer(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeAAAA))
+	assert.Equal(t, "fd00::1", r.Answer[0].(*dns.AAAA).AAAA.String())
+	assert.Nil(t, fallback.Answer(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeMX)))
+}
+
+func TestHandler_Fallback(t *testing.T) {
+	dnsCache := cache.NewDNSCache(10, 0, 0)
+	dnsCache.FailTTL = 60
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: dnsCache,
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+	}
+	group := &Group{Callers: []outbound.Caller{&countCaller{}}} // 总是请求失败
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	r, _ := handler.Query(req)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+
+	handler.Fallback = &Fallback{A: net.IPv4(10, 0, 0, 1), TTL: 10}
+	for i := 0; i < 2; i++ { // 第二次命中SERVFAIL缓存，同样返回静态响应
+		r, result := handler.Query(req)
+		assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+		assert.Equal(t, "10.0.0.1", r.Answer[0].(*dns.A).A.String())
+		assert.Contains(t, result.Reason, "(fallback)")
+	}
+	// 未配置AAAA时仍返回SERVFAIL
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeAAAA))
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+}
@@ -0,0 +1,153 @@
+package inbound
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// ResponseFilter 响应过滤器，在分组收到上游响应后对其进行加工，多个过滤器依次生效
+type ResponseFilter interface {
+	// Filter 返回加工后的响应，r可能为nil。实现不应修改传入的响应，需要修改时应先复制
+	Filter(r *dns.Msg) *dns.Msg
+}
+
+// ResponseFilterFunc 将普通函数包装为ResponseFilter
+type ResponseFilterFunc func(r *dns.Msg) *dns.Msg
+
+// Filter 实现ResponseFilter接口
+func (f ResponseFilterFunc) Filter(r *dns.Msg) *dns.Msg {
+	return f(r)
+}
+
+// StripIPv6Filter 移除响应中的所有AAAA记录
+type StripIPv6Filter struct{}
+
+// Filter 实现ResponseFilter接口
+func (StripIPv6Filter) Filter(r *dns.Msg) *dns.Msg {
+	if r == nil {
+		return nil
+	}
+	var answer []dns.RR
+	for _, rr := range r.Answer {
+		if _, ok := rr.(*dns.AAAA); !ok {
+			answer = append(answer, rr)
+		}
+	}
+	if len(answer) == len(r.Answer) {
+		return r
+	}
+	r = r.Copy()
+	r.Answer = answer
+	return r
+}
+
+// StripPrivateFilter 移除响应中指向私有地址的A/AAAA记录，同deny_private_answers
+type StripPrivateFilter struct{}
+
+// Filter 实现ResponseFilter接口
+func (StripPrivateFilter) Filter(r *dns.Msg) *dns.Msg {
+	return filterPrivate(r)
+}
+
+// TTLClampFilter 将响应中记录的TTL限制在[Min, Max]内，为0的一端不限制
+type TTLClampFilter struct {
+	Min, Max uint32
+}
+
+// Filter 实现ResponseFilter接口
+func (f TTLClampFilter) Filter(r *dns.Msg) *dns.Msg {
+	if r == nil {
+		return nil
+	}
+	r = r.Copy()
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if f.Min > 0 && header.Ttl < f.Min {
+				header.Ttl = f.Min
+			}
+			if f.Max > 0 && header.Ttl > f.Max {
+				header.Ttl = f.Max
+			}
+		}
+	}
+	return r
+}
+
+// ShuffleFilter 随机打乱响应中A/AAAA记录的顺序，其它记录（如CNAME）位置不变
+type ShuffleFilter struct{}
+
+// Filter 实现ResponseFilter接口
+func (ShuffleFilter) Filter(r *dns.Msg) *dns.Msg {
+	if r == nil {
+		return nil
+	}
+	var index []int
+	for i, rr := range r.Answer {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			index = append(index, i)
+		}
+	}
+	if len(index) < 2 {
+		return r
+	}
+	r = r.Copy()
+	rand.Shuffle(len(index), func(i, j int) {
+		r.Answer[index[i]], r.Answer[index[j]] = r.Answer[index[j]], r.Answer[index[i]]
+	})
+	return r
+}
+
+// NewResponseFilter 根据名称创建过滤器，可选"strip_ipv6"、"strip_private"、"shuffle"、"ttl_clamp:最小值-最大值"。
+// ttl_clamp的最小值或最大值可省略，如"ttl_clamp:60-"、"ttl_clamp:-3600"
+func NewResponseFilter(spec string) (ResponseFilter, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	switch name {
+	case "strip_ipv6":
+		return StripIPv6Filter{}, nil
+	case "strip_private":
+		return StripPrivateFilter{}, nil
+	case "shuffle":
+		return ShuffleFilter{}, nil
+	case "ttl_clamp":
+		parts := strings.Split(arg, "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid ttl_clamp filter: %q", spec)
+		}
+		var bounds [2]uint32
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			n, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ttl_clamp filter: %q", spec)
+			}
+			bounds[i] = uint32(n)
+		}
+		if bounds[1] > 0 && bounds[0] > bounds[1] {
+			return nil, fmt.Errorf("invalid ttl_clamp filter: %q", spec)
+		}
+		return TTLClampFilter{Min: bounds[0], Max: bounds[1]}, nil
+	default:
+		return nil, fmt.Errorf("unknown response filter: %q", spec)
+	}
+}
+
+// 依次使用filters加工响应
+func applyFilters(filters []ResponseFilter, r *dns.Msg) *dns.Msg {
+	for _, filter := range filters {
+		r = filter.Filter(r)
+	}
+	return r
+}
@@ -0,0 +1,84 @@
+package inbound
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"testing"
+)
+
+func TestNewResponseFilter(t *testing.T) {
+	for spec, expected := range map[string]ResponseFilter{
+		"strip_ipv6":          StripIPv6Filter{},
+		"strip_private":       StripPrivateFilter{},
+		"shuffle":             ShuffleFilter{},
+		"ttl_clamp:60-3600":   TTLClampFilter{Min: 60, Max: 3600},
+		"ttl_clamp:60-":       TTLClampFilter{Min: 60},
+		"ttl_clamp:-3600":     TTLClampFilter{Max: 3600},
+		"ttl_clamp:3600-60":   nil,
+		"ttl_clamp:60":        nil,
+		"ttl_clamp:a-b":       nil,
+		"ttl_clamp":           nil,
+		"unknown":             nil,
+		"strip_ipv6_and_more": nil,
+	} {
+		filter, err := NewResponseFilter(spec)
+		assert.Equal(t, expected, filter, spec)
+		assert.Equal(t, expected == nil, err != nil, spec)
+	}
+}
+
+func TestResponseFilters(t *testing.T) {
+	a := func(ip string, ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeA, Ttl: ttl}, A: net.ParseIP(ip)}
+	}
+	aaaa := &dns.AAAA{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeAAAA, Ttl: 10}, AAAA: net.ParseIP("2001:db8::1")}
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeCNAME, Ttl: 5000}, Target: "b.com."}
+	msg := &dns.Msg{Answer: []dns.RR{cname, a("1.1.1.1", 10), aaaa, a("10.0.0.1", 10)}}
+	msg.SetEdns0(4096, false)
+
+	for _, filter := range []ResponseFilter{StripIPv6Filter{}, StripPrivateFilter{}, TTLClampFilter{}, ShuffleFilter{}} {
+		assert.Nil(t, filter.Filter(nil))
+	}
+	// 移除AAAA记录，不修改原响应
+	r := StripIPv6Filter{}.Filter(msg)
+	assert.Equal(t, []dns.RR{cname, a("1.1.1.1", 10), a("10.0.0.1", 10)}, r.Answer)
+	assert.Equal(t, 4, len(msg.Answer))
+	// 限制TTL，OPT记录不受影响
+	r = TTLClampFilter{Min: 60, Max: 3600}.Filter(msg)
+	assert.Equal(t, []uint32{3600, 60, 60, 60}, []uint32{r.Answer[0].Header().Ttl, r.Answer[1].Header().Ttl,
+		r.Answer[2].Header().Ttl, r.Answer[3].Header().Ttl})
+	assert.Equal(t, uint32(10), msg.Answer[1].Header().Ttl)
+	assert.Equal(t, uint16(4096), r.IsEdns0().UDPSize())
+	// 打乱顺序时CNAME位置不变
+	for i := 0; i < 10; i++ {
+		r = ShuffleFilter{}.Filter(msg)
+		assert.Equal(t, cname, r.Answer[0])
+		assert.ElementsMatch(t, msg.Answer, r.Answer)
+	}
+
+	// 过滤器按顺序生效：先移除AAAA再追加时追加的记录保留，顺序相反时被移除
+	appendAAAA := ResponseFilterFunc(func(r *dns.Msg) *dns.Msg {
+		r = r.Copy()
+		r.Answer = append(r.Answer, aaaa)
+		return r
+	})
+	r = applyFilters([]ResponseFilter{StripIPv6Filter{}, appendAAAA}, msg)
+	assert.Equal(t, []dns.RR{cname, a("1.1.1.1", 10), a("10.0.0.1", 10), aaaa}, r.Answer)
+	r = applyFilters([]ResponseFilter{appendAAAA, StripIPv6Filter{}}, msg)
+	assert.Equal(t, []dns.RR{cname, a("1.1.1.1", 10), a("10.0.0.1", 10)}, r.Answer)
+	r = applyFilters([]ResponseFilter{StripPrivateFilter{}, TTLClampFilter{Max: 1}}, msg)
+	assert.Equal(t, []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeCNAME, Ttl: 1}, Target: "b.com."},
+		a("1.1.1.1", 1), &dns.AAAA{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeAAAA, Ttl: 1}, AAAA: aaaa.AAAA}}, r.Answer)
+	assert.Equal(t, msg, applyFilters(nil, msg))
+
+	// 分组按顺序应用过滤器
+	handler := &Handler{}
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: msg}}, DenyPrivate: true,
+		Filters: []ResponseFilter{StripIPv6Filter{}, TTLClampFilter{Min: 60}}}
+	r = handler.callGroup(context.Background(), group, new(dns.Msg).SetQuestion("a.com.", dns.TypeA))
+	assert.Equal(t, []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeCNAME, Ttl: 5000}, Target: "b.com."},
+		a("1.1.1.1", 60)}, r.Answer)
+}
@@ -0,0 +1,58 @@
+package inbound
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"strings"
+)
+
+// GeoLocator 根据ip查询所在国家/地区代码（ISO 3166-1，如"CN"），查询失败时返回空字符串
+type GeoLocator interface {
+	Country(ip net.IP) string
+}
+
+// MaxMindLocator 基于MaxMind GeoIP2/GeoLite2 Country格式数据库的GeoLocator
+type MaxMindLocator struct {
+	reader *maxminddb.Reader
+}
+
+// Country 查询ip所在国家/地区代码
+func (locator *MaxMindLocator) Country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if ip == nil || locator.reader.Lookup(ip, &record) != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// Close 关闭数据库文件
+func (locator *MaxMindLocator) Close() error {
+	return locator.reader.Close()
+}
+
+// NewMaxMindLocator 读取mmdb格式的数据库文件
+func NewMaxMindLocator(filename string) (*MaxMindLocator, error) {
+	reader, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindLocator{reader: reader}, nil
+}
+
+// MatchGeo 根据客户端ip所在国家/地区查找GeoGroups中对应的组，未启用geoip或未找到时返回nil
+func (handler *Handler) MatchGeo(client net.IP) (country string, name string, group *Group) {
+	if handler.Geo == nil || len(handler.GeoGroups) == 0 || client == nil {
+		return "", "", nil
+	}
+	if country = strings.ToUpper(handler.Geo.Country(client)); country == "" {
+		return "", "", nil
+	}
+	if name = handler.GeoGroups[country]; name == "" {
+		return country, "", nil
+	}
+	return country, name, handler.Groups[name]
+}
@@ -0,0 +1,98 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"sync"
+	"testing"
+)
+
+// 按ip字符串查表的GeoLocator
+type stubLocator map[string]string
+
+func (locator stubLocator) Country(ip net.IP) string {
+	return locator[ip.String()]
+}
+
+// 记录关闭次数的GeoLocator
+type closeLocator struct {
+	closed int
+}
+
+func (locator *closeLocator) Country(net.IP) string {
+	return ""
+}
+
+func (locator *closeLocator) Close() error {
+	locator.closed++
+	return nil
+}
+
+func TestHandler_GeoClose(t *testing.T) {
+	old, geo := &closeLocator{}, &closeLocator{}
+	handler := &Handler{Mux: new(sync.RWMutex), Geo: old}
+	// 刷新配置时geoip数据库不变则不关闭，改变时关闭旧数据库
+	handler.Refresh(&Handler{Geo: old})
+	assert.Equal(t, 0, old.closed)
+	handler.Refresh(&Handler{Geo: geo})
+	assert.Equal(t, 1, old.closed)
+	assert.Equal(t, GeoLocator(geo), handler.Geo)
+	// 不可关闭的GeoLocator
+	handler.Refresh(&Handler{Geo: stubLocator{}})
+	assert.Equal(t, 1, geo.closed)
+	last := &closeLocator{}
+	handler.Refresh(&Handler{Geo: last})
+	// 关闭服务时关闭geoip数据库
+	handler.Shutdown()
+	assert.Equal(t, 1, last.closed)
+	assert.Nil(t, handler.Geo)
+}
+
+func TestNewMaxMindLocator(t *testing.T) {
+	locator, err := NewMaxMindLocator("not-exist.mmdb")
+	assert.Nil(t, locator)
+	assert.NotNil(t, err)
+}
+
+func TestHandler_Geo(t *testing.T) {
+	newResp := func(ip string) *dns.Msg {
+		return &dns.Msg{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ip.cn.", Rrtype: dns.TypeA,
+			Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)}}}
+	}
+	clean := &Group{Callers: []outbound.Caller{&staticCaller{resp: newResp("1.1.1.1")}}}
+	us := &Group{Callers: []outbound.Caller{&staticCaller{resp: newResp("2.2.2.2")}}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, 0, 0),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")}, QueryLogger: log.New(),
+		Groups:    map[string]*Group{"clean": clean, "dirty": clean, "us": us},
+		Geo:       stubLocator{"127.0.0.1": "us", "10.0.0.1": "JP"},
+		GeoGroups: map[string]string{"US": "us"},
+	}
+	// MockRespWriter的客户端地址为127.0.0.1，对应us组
+	country, name, group := handler.MatchGeo(net.ParseIP("127.0.0.1"))
+	assert.Equal(t, "US", country)
+	assert.Equal(t, "us", name)
+	assert.Equal(t, us, group)
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	writer := &MockRespWriter{}
+	handler.ServeDNS(writer, req)
+	assert.Equal(t, "2.2.2.2", writer.r.Answer[0].(*dns.A).A.String())
+	// 所在地未指定分组、未知所在地时按原有流程处理
+	_, _, group = handler.MatchGeo(net.ParseIP("10.0.0.1"))
+	assert.Nil(t, group)
+	_, _, group = handler.MatchGeo(net.ParseIP("10.0.0.2"))
+	assert.Nil(t, group)
+	r, result := handler.Query(req)
+	assert.Equal(t, "clean", result.Group)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// 未启用geoip
+	handler.Geo = nil
+	_, _, group = handler.MatchGeo(net.ParseIP("127.0.0.1"))
+	assert.Nil(t, group)
+}
@@ -0,0 +1,51 @@
+package inbound
+
+import (
+	"fmt"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 组内上游的选择方式
+const (
+	ModeOrdered = ""     // 按配置顺序依次请求上游
+	ModeHash    = "hash" // 按域名的一致性哈希选择首选上游，其余上游按哈希顺序作为备用
+)
+
+// 计算上游对域名的权重（rendezvous hashing），上游增减时仅影响原先映射至该上游的域名
+func hashWeight(qname, key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(qname))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// 返回上游的哈希标识，优先使用上游地址，使配置中上游顺序变化不影响映射结果
+func callerKey(caller outbound.Caller, index int) string {
+	if s, ok := caller.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return strconv.Itoa(index)
+}
+
+// 按对域名的权重从大到小重排上游，同一域名总是得到相同的顺序。不修改原切片
+func hashOrder(qname string, callers []outbound.Caller) []outbound.Caller {
+	if len(callers) < 2 {
+		return callers
+	}
+	qname = strings.ToLower(qname)
+	indexes, weights := make([]int, len(callers)), make([]uint64, len(callers))
+	for i, caller := range callers {
+		indexes[i], weights[i] = i, hashWeight(qname, callerKey(caller, i))
+	}
+	sort.SliceStable(indexes, func(i, j int) bool { return weights[indexes[i]] > weights[indexes[j]] })
+	ordered := make([]outbound.Caller, len(callers))
+	for i, index := range indexes {
+		ordered[i] = callers[index]
+	}
+	return ordered
+}
@@ -0,0 +1,92 @@
+package inbound
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"testing"
+)
+
+// 记录被调用次数的Caller
+type namedCaller struct {
+	name  string
+	count int
+}
+
+func (caller *namedCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	caller.count++
+	rr, _ := dns.NewRR(request.Question[0].Name + " 60 IN A 1.1.1.1")
+	r = new(dns.Msg).SetReply(request)
+	r.Answer = []dns.RR{rr}
+	return r, nil
+}
+
+func (caller *namedCaller) String() string {
+	return caller.name
+}
+
+func TestHashOrder(t *testing.T) {
+	callers := make([]outbound.Caller, 4)
+	for i := range callers {
+		callers[i] = &namedCaller{name: fmt.Sprintf("udp://10.0.0.%d:53", i)}
+	}
+	original := append([]outbound.Caller{}, callers...)
+	// 同一域名总是得到相同的顺序，且与大小写及配置顺序无关
+	first := hashOrder("www.example.com.", callers)
+	assert.Len(t, first, 4)
+	assert.ElementsMatch(t, callers, first)
+	assert.Equal(t, first, hashOrder("WWW.Example.com.", callers))
+	reversed := []outbound.Caller{callers[3], callers[2], callers[1], callers[0]}
+	assert.Equal(t, first, hashOrder("www.example.com.", reversed))
+	assert.Equal(t, original, callers) // 不修改原切片
+	// 移除上游时，原先映射至其余上游的域名不受影响
+	for i := 0; i < 100; i++ {
+		qname := fmt.Sprintf("host%d.example.com.", i)
+		before := hashOrder(qname, callers)[0]
+		if before == callers[3] {
+			continue
+		}
+		assert.Equal(t, before, hashOrder(qname, callers[:3])[0], qname)
+	}
+	// 单个上游时原样返回
+	assert.Equal(t, callers[:1], hashOrder("a.com.", callers[:1]))
+}
+
+func TestGroup_HashMode(t *testing.T) {
+	callers := make([]outbound.Caller, 4)
+	for i := range callers {
+		callers[i] = &namedCaller{name: fmt.Sprintf("udp://10.0.0.%d:53", i)}
+	}
+	group := &Group{Callers: callers, Mode: ModeHash}
+	// 同一域名总是请求同一上游
+	req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		assert.NotNil(t, group.CallDNS(req))
+	}
+	hit := 0
+	for _, caller := range callers {
+		if count := caller.(*namedCaller).count; count > 0 {
+			assert.Equal(t, 10, count)
+			hit++
+		}
+	}
+	assert.Equal(t, 1, hit)
+	// 不同域名大致均匀地分布在各上游
+	for _, caller := range callers {
+		caller.(*namedCaller).count = 0
+	}
+	total := 4000
+	for i := 0; i < total; i++ {
+		group.CallDNS(new(dns.Msg).SetQuestion(fmt.Sprintf("host%d.example.com.", i), dns.TypeA))
+	}
+	for _, caller := range callers {
+		count := caller.(*namedCaller).count
+		assert.True(t, count > total/4*8/10 && count < total/4*12/10, "%s: %d", caller, count)
+	}
+	// 默认按配置顺序请求
+	group.Mode = ModeOrdered
+	callers[0].(*namedCaller).count = 0
+	group.CallDNS(req)
+	assert.Equal(t, 1, callers[0].(*namedCaller).count)
+}
@@ -0,0 +1,96 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"net"
+	"strings"
+)
+
+// hosts中别名记录链的最大长度，超出时视为存在循环
+const maxHostsCNAME = 8
+
+// 依次在各hosts中查找name（先带末尾的根域名，再去掉后查找），返回首个非空结果
+func (handler *Handler) lookupHosts(name string, get func(reader hosts.Reader, hostname string) string) string {
+	for _, reader := range handler.HostsReaders {
+		if val := get(reader, name); val != "" {
+			return val
+		}
+		if val := get(reader, strings.TrimSuffix(name, ".")); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// 根据hosts生成A/AAAA/CNAME请求的响应：只返回与请求类型相同的记录，hostname为别名时返回别名链及目标的记录。
+// hostname仅有另一类型的地址时返回无应答记录的NOERROR响应（NODATA），避免请求被转发至上游；hosts中无相关记录时返回nil
+func (handler *Handler) hostsAnswer(question dns.Question) *dns.Msg {
+	ipv6 := question.Qtype == dns.TypeAAAA
+	record := func(reader hosts.Reader, hostname string) string { return reader.Record(hostname, ipv6) }
+	other := func(reader hosts.Reader, hostname string) string { return reader.IP(hostname, !ipv6) }
+	cname := func(reader hosts.Reader, hostname string) string { return reader.CNAME(hostname) }
+
+	var answer []dns.RR // 只在命中hosts时生成响应，未命中时不分配
+	name := question.Name
+	for i := 0; ; i++ {
+		if target := handler.lookupHosts(name, cname); target != "" {
+			if i >= maxHostsCNAME {
+				log.WithField("domain", question.Name).Warnln("hosts cname chain too long")
+				return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}, Answer: answer}
+			}
+			hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: handler.HostsTTL}
+			answer = append(answer, &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(target)})
+			if question.Qtype == dns.TypeCNAME {
+				return &dns.Msg{Answer: answer}
+			}
+			name = dns.Fqdn(target)
+			continue
+		}
+		if question.Qtype != dns.TypeCNAME {
+			if value := handler.lookupHosts(name, record); value != "" {
+				rr, err := dns.NewRR(value)
+				if err != nil {
+					log.Errorf("make DNS.RR error: %v", err)
+					return nil
+				}
+				rr.Header().Name, rr.Header().Ttl = name, handler.HostsTTL
+				return &dns.Msg{Answer: append(answer, rr)}
+			}
+		}
+		if len(answer) > 0 {
+			return &dns.Msg{Answer: answer} // 别名目标不在hosts中，由danglingCNAME交给上游解析
+		}
+		if question.Qtype != dns.TypeCNAME && handler.lookupHosts(name, other) != "" {
+			return new(dns.Msg)
+		}
+		return nil
+	}
+}
+
+// 返回响应末尾未解析的CNAME目标，响应以请求类型的记录结尾或请求类型为CNAME时返回空串
+func danglingCNAME(r *dns.Msg, qtype uint16) string {
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) == 0 || qtype == dns.TypeCNAME {
+		return ""
+	}
+	if cname, ok := r.Answer[len(r.Answer)-1].(*dns.CNAME); ok {
+		return cname.Target
+	}
+	return ""
+}
+
+// 通过常规流程（缓存、分组等）解析hosts别名链的目标，将结果追加至别名链之后
+func (handler *Handler) chaseHostsCNAME(request, r *dns.Msg, target string, client net.IP) *dns.Msg {
+	sub := request.Copy()
+	sub.Question[0].Name = target
+	resp, _ := handler.query(sub, client)
+	if resp == nil {
+		return servFail(request)
+	}
+	r = r.Copy()
+	r.Rcode = resp.Rcode
+	r.Answer = append(r.Answer, resp.Answer...)
+	r.Ns = resp.Ns
+	return r
+}
@@ -0,0 +1,78 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+)
+
+func TestHandler_HostsTypes(t *testing.T) {
+	upstream := &countCaller{resp: answerA("9.9.9.9")}
+	upstream.resp.Answer[0].Header().Name = "cdn.example.net."
+	reader := hosts.NewReaderByText("1.1.1.1 both\n::1 both\n2.2.2.2 v4only\n::ffff:3.3.3.3 mapped")
+	reader.AddCNAME("alias", "both")
+	reader.AddCNAME("www", "alias")
+	reader.AddCNAME("cdn", "cdn.example.net")
+	reader.AddCNAME("loop1", "loop2")
+	reader.AddCNAME("loop2", "loop1")
+	group := &Group{Callers: []outbound.Caller{upstream}, Matcher: matcher.NewABPByText("")}
+	handler := &Handler{Mux: new(sync.RWMutex), HostsReaders: []hosts.Reader{reader},
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups: map[string]*Group{"clean": group, "dirty": group}}
+	query := func(name string, qtype uint16) *dns.Msg {
+		r, result := handler.Query(new(dns.Msg).SetQuestion(name, qtype))
+		assert.Equal(t, "hit hosts", result.Reason, name)
+		return r
+	}
+
+	// A、AAAA请求只返回对应类型的记录
+	r := query("both.", dns.TypeA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	r = query("both.", dns.TypeAAAA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "::1", r.Answer[0].(*dns.AAAA).AAAA.String())
+	// 仅有A记录时AAAA请求返回NODATA，不转发至上游
+	r = query("v4only.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Empty(t, r.Answer)
+	assert.IsType(t, &dns.SOA{}, r.Ns[0])
+	// ipv4映射的ipv6地址不作为A记录返回
+	r = query("mapped.", dns.TypeA)
+	assert.Empty(t, r.Answer)
+	r = query("mapped.", dns.TypeAAAA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, 0, upstream.count)
+
+	// 别名链及目标记录按请求类型返回
+	r = query("www.", dns.TypeA)
+	assert.Len(t, r.Answer, 3)
+	assert.Equal(t, "alias.", r.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "both.", r.Answer[1].(*dns.CNAME).Target)
+	assert.Equal(t, "1.1.1.1", r.Answer[2].(*dns.A).A.String())
+	r = query("alias.", dns.TypeAAAA)
+	assert.Len(t, r.Answer, 2)
+	assert.Equal(t, "::1", r.Answer[1].(*dns.AAAA).AAAA.String())
+	r = query("www.", dns.TypeCNAME)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "alias.", r.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, 0, upstream.count)
+	// 目标不在hosts中时由上游解析
+	r = query("cdn.", dns.TypeA)
+	assert.Equal(t, 1, upstream.count)
+	assert.Len(t, r.Answer, 2)
+	assert.Equal(t, "cdn.example.net.", r.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "9.9.9.9", r.Answer[1].(*dns.A).A.String())
+	// 别名循环
+	r = query("loop1.", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	// 不在hosts中的域名不受影响
+	_, result := handler.Query(new(dns.Msg).SetQuestion("other.", dns.TypeAAAA))
+	assert.NotEqual(t, "hit hosts", result.Reason)
+}
@@ -0,0 +1,71 @@
+package inbound
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter 限制同时进行的上游请求数量，为nil时不限制
+type Limiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// NewLimiter 创建最多允许size个并发请求的Limiter，名额已满时最多等待wait。size<=0时返回nil
+func NewLimiter(size int, wait time.Duration) *Limiter {
+	if size <= 0 {
+		return nil
+	}
+	return &Limiter{slots: make(chan struct{}, size), wait: wait}
+}
+
+// Acquire 获取一个请求名额，等待超时返回false。成功获取后须调用Release归还
+func (limiter *Limiter) Acquire() bool {
+	if limiter == nil {
+		return true
+	}
+	select {
+	case limiter.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if limiter.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(limiter.wait)
+	defer timer.Stop()
+	select {
+	case limiter.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Release 归还一个请求名额
+func (limiter *Limiter) Release() {
+	if limiter != nil {
+		<-limiter.slots
+	}
+}
+
+type overflowKey struct{}
+
+// 返回可记录组内上游并发超限的ctx，超限时CallDNSContext在其中记录，之后的响应不写入缓存
+func withOverflow(ctx context.Context) context.Context {
+	return context.WithValue(ctx, overflowKey{}, new(int32))
+}
+
+// 若ctx可记录组内上游并发超限，则记录一次超限
+func markOverflow(ctx context.Context) {
+	if flag, _ := ctx.Value(overflowKey{}).(*int32); flag != nil {
+		atomic.StoreInt32(flag, 1)
+	}
+}
+
+// 判断ctx中是否记录了组内上游并发超限
+func overflowed(ctx context.Context) bool {
+	flag, _ := ctx.Value(overflowKey{}).(*int32)
+	return flag != nil && atomic.LoadInt32(flag) != 0
+}
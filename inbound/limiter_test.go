@@ -0,0 +1,134 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 阻塞直至release关闭的Caller，记录同时进行的最大调用数
+type blockCaller struct {
+	mux      sync.Mutex
+	inflight int
+	max      int
+	release  chan struct{}
+}
+
+func (caller *blockCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	caller.mux.Lock()
+	caller.inflight++
+	if caller.inflight > caller.max {
+		caller.max = caller.inflight
+	}
+	caller.mux.Unlock()
+	<-caller.release
+	caller.mux.Lock()
+	caller.inflight--
+	caller.mux.Unlock()
+	return new(dns.Msg).SetReply(request), nil
+}
+
+func TestLimiter(t *testing.T) {
+	// nil代表不限制
+	var limiter *Limiter
+	assert.Nil(t, NewLimiter(0, time.Second))
+	assert.True(t, limiter.Acquire())
+	limiter.Release()
+
+	limiter = NewLimiter(1, 0)
+	assert.True(t, limiter.Acquire())
+	assert.False(t, limiter.Acquire()) // 不等待
+	limiter.Release()
+	assert.True(t, limiter.Acquire())
+	limiter.Release()
+
+	limiter = NewLimiter(1, time.Second)
+	assert.True(t, limiter.Acquire())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		limiter.Release()
+	}()
+	assert.True(t, limiter.Acquire()) // 等待期间名额被归还
+	limiter = NewLimiter(1, 10*time.Millisecond)
+	assert.True(t, limiter.Acquire())
+	assert.False(t, limiter.Acquire()) // 等待超时
+}
+
+// 并发发起n个请求，等待所有请求返回后返回其中SERVFAIL的数量
+func concurrentCall(n int, call func() *dns.Msg, caller *blockCaller) (failed int) {
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r := call(); r == nil || r.Rcode == dns.RcodeServerFailure {
+				mux.Lock()
+				failed++
+				mux.Unlock()
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(caller.release)
+	wg.Wait()
+	return
+}
+
+func TestGroup_Limiter(t *testing.T) {
+	caller := &blockCaller{release: make(chan struct{})}
+	group := &Group{Callers: []outbound.Caller{caller}, Limiter: NewLimiter(2, 10*time.Millisecond)}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	failed := concurrentCall(5, func() *dns.Msg { return group.CallDNS(req) }, caller)
+	assert.Equal(t, 2, caller.max)
+	assert.Equal(t, 3, failed)
+}
+
+func TestHandler_Limiter(t *testing.T) {
+	caller := &blockCaller{release: make(chan struct{})}
+	handler := &Handler{Mux: new(sync.RWMutex), Limiter: NewLimiter(3, 10*time.Millisecond),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+	}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	failed := concurrentCall(5, func() *dns.Msg {
+		r, _ := handler.Query(req)
+		return r
+	}, caller)
+	assert.Equal(t, 3, caller.max)
+	assert.Equal(t, 2, failed)
+}
+
+func TestHandler_GroupLimiter(t *testing.T) {
+	dnsCache := cache.NewDNSCache(10, time.Minute, time.Hour)
+	dnsCache.FailTTL = time.Minute
+	caller := &countCaller{resp: answerA("1.1.1.1")}
+	group := &Group{Callers: []outbound.Caller{caller}, Limiter: NewLimiter(1, 0)}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: dnsCache,
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+		Groups:       map[string]*Group{"clean": group, "dirty": group},
+	}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	// 组内并发超限时返回SERVFAIL且不缓存
+	assert.True(t, group.Limiter.Acquire())
+	r, result := handler.Query(req)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	assert.Equal(t, "too many queries", result.Reason)
+	assert.Equal(t, 0, caller.count)
+	assert.Equal(t, 0, dnsCache.Len())
+	// 名额归还后的请求转发至上游
+	group.Limiter.Release()
+	r, result = handler.Query(req)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, "cn/empty ipv4", result.Reason)
+	assert.Equal(t, 1, caller.count)
+}
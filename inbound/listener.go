@@ -0,0 +1,44 @@
+package inbound
+
+import (
+	"context"
+	"github.com/miekg/dns"
+)
+
+type listenerKey struct{}
+
+// 返回携带监听地址的ctx，供按接收请求的监听地址分组
+func withListener(ctx context.Context, listen string) context.Context {
+	if listen == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, listenerKey{}, listen)
+}
+
+// 返回ctx携带的监听地址，未携带时返回空串
+func listenerFrom(ctx context.Context) string {
+	listen, _ := ctx.Value(listenerKey{}).(string)
+	return listen
+}
+
+// MatchListener 查找监听地址在ListenerGroups中指定的组，未指定时返回nil
+func (handler *Handler) MatchListener(listen string) (name string, group *Group) {
+	if listen == "" || len(handler.ListenerGroups) == 0 {
+		return "", nil
+	}
+	if name = handler.ListenerGroups[listen]; name == "" {
+		return "", nil
+	}
+	return name, handler.Groups[name]
+}
+
+// 单个监听地址上的dns服务使用的处理器，处理请求时记录监听地址
+type listenerHandler struct {
+	handler *Handler
+	listen  string
+}
+
+// ServeDNS 同Handler.ServeDNS，ListenerGroups为监听地址指定了组时使用该组
+func (l *listenerHandler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
+	l.handler.serve(resp, request, l.listen)
+}
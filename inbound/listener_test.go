@@ -0,0 +1,62 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandler_ListenerGroups(t *testing.T) {
+	clean := &countCaller{resp: answerA("1.1.1.1")}
+	dirty := &countCaller{resp: answerA("8.8.8.8")}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText("||example.com"), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		QueryLogger: log.New(), ListenerGroups: map[string]string{"127.0.0.1:53": "clean"},
+		Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{clean}},
+			"dirty": {Callers: []outbound.Caller{dirty}, Matcher: matcher.NewABPByText("||example.com")},
+		}}
+	lan := &listenerHandler{handler: handler, listen: "192.168.1.1:53"}
+	local := &listenerHandler{handler: handler, listen: "127.0.0.1:53"}
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+	// 局域网地址按组规则使用dirty组
+	writer := &MockRespWriter{}
+	lan.ServeDNS(writer, req)
+	assert.Equal(t, "8.8.8.8", writer.r.Answer[0].(*dns.A).A.String())
+	// 本地地址强制使用clean组，且不使用其它监听地址写入的缓存
+	writer = &MockRespWriter{}
+	local.ServeDNS(writer, req)
+	assert.Equal(t, "1.1.1.1", writer.r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 1, clean.count)
+	// 按监听地址分组的响应不写入缓存
+	lan.ServeDNS(writer, req)
+	assert.Equal(t, "8.8.8.8", writer.r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 1, dirty.count)
+	local.ServeDNS(writer, req)
+	assert.Equal(t, 2, clean.count)
+	// 未经监听地址接收的请求按原有流程处理
+	handler.ServeDNS(writer, req)
+	assert.Equal(t, "8.8.8.8", writer.r.Answer[0].(*dns.A).A.String())
+
+	name, group := handler.MatchListener("127.0.0.1:53")
+	assert.Equal(t, "clean", name)
+	assert.Equal(t, handler.Groups["clean"], group)
+	_, group = handler.MatchListener("192.168.1.1:53")
+	assert.Nil(t, group)
+	_, group = handler.MatchListener("")
+	assert.Nil(t, group)
+
+	// 去重时区分监听地址
+	handler.DedupWindow = time.Second
+	lan.ServeDNS(writer, req)
+	local.ServeDNS(writer, req)
+	assert.Equal(t, "1.1.1.1", writer.r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 3, clean.count)
+}
@@ -0,0 +1,106 @@
+package inbound
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"os/exec"
+	"strings"
+)
+
+// nft命令路径，方便单测替换
+var nftBin = "nft"
+
+// NFTMap 写入组内A/AAAA解析结果的nftables map，元素为ip -> Value，供策略路由等规则按ip查找mark、verdict等。
+// map需预先创建，键类型分别为ipv4_addr、ipv6_addr，设置Timeout时map需带有timeout标志
+type NFTMap struct {
+	Family  string // 表的地址族，如"inet"、"ip"
+	Table   string
+	Map     string // ipv4地址写入的map，为空时不写入ipv4地址
+	Map6    string // ipv6地址写入的map，为空时不写入ipv6地址
+	Value   string // 元素的值，如"0x00000001"（mark）、"accept"（verdict）
+	Timeout int    // 元素的超时时间（秒），为0时不超时
+}
+
+// NewNFTMap 从"family table map"格式的map名称（ipv4、ipv6各一个，可为空但不能均为空）及元素的值生成NFTMap
+func NewNFTMap(map4, map6, value string, timeout int) (*NFTMap, error) {
+	nftMap := &NFTMap{Value: strings.TrimSpace(value), Timeout: timeout}
+	if nftMap.Value == "" || strings.ContainsAny(nftMap.Value, "{},;\n") {
+		return nil, fmt.Errorf("invalid nft map value: %q", value)
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("invalid nft map timeout: %d", timeout)
+	}
+	for i, name := range []string{map4, map6} {
+		if name == "" {
+			continue
+		}
+		fields := strings.Fields(name)
+		if len(fields) != 3 || strings.ContainsAny(name, "{},;") {
+			return nil, fmt.Errorf("invalid nft map %q, should be \"family table map\"", name)
+		}
+		if nftMap.Family != "" && (fields[0] != nftMap.Family || fields[1] != nftMap.Table) {
+			return nil, fmt.Errorf("nft maps %q and %q must be in the same table", map4, map6)
+		}
+		nftMap.Family, nftMap.Table = fields[0], fields[1]
+		if i == 0 {
+			nftMap.Map = fields[2]
+		} else {
+			nftMap.Map6 = fields[2]
+		}
+	}
+	if nftMap.Map == "" && nftMap.Map6 == "" {
+		return nil, fmt.Errorf("nft map name cannot be empty")
+	}
+	return nftMap, nil
+}
+
+// 生成将ips写入map的nft命令，ips为空时返回空字符串
+func (nftMap *NFTMap) element(name string, ips []string) string {
+	if name == "" || len(ips) == 0 {
+		return ""
+	}
+	var elements []string
+	for _, ip := range ips {
+		if nftMap.Timeout > 0 {
+			ip += fmt.Sprintf(" timeout %ds", nftMap.Timeout)
+		}
+		elements = append(elements, ip+" : "+nftMap.Value)
+	}
+	return fmt.Sprintf("add element %s %s %s { %s }\n", nftMap.Family, nftMap.Table, name,
+		strings.Join(elements, ", "))
+}
+
+// Add 将dns响应中的A/AAAA记录一次性写入map
+func (nftMap *NFTMap) Add(r *dns.Msg) error {
+	if nftMap == nil || r == nil {
+		return nil
+	}
+	var ips, ips6 []string
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A.String())
+		case *dns.AAAA:
+			ips6 = append(ips6, rr.AAAA.String())
+		}
+	}
+	script := nftMap.element(nftMap.Map, ips) + nftMap.element(nftMap.Map6, ips6)
+	if script == "" {
+		return nil
+	}
+	cmd := exec.Command(nftBin, "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding %d entries: %v (%s)", len(ips)+len(ips6), err, out)
+	}
+	return nil
+}
+
+// AddNFTMap 将dns响应中的A/AAAA记录写入组的nftables map，group.NFTMap为nil时不做任何操作
+func (group *Group) AddNFTMap(r *dns.Msg) {
+	if err := group.NFTMap.Add(r); err != nil {
+		log.Errorf("add nft map error: %v", err)
+	}
+}
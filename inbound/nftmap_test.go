@@ -0,0 +1,78 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 生成一个记录stdin内容的假nft命令，返回记录文件路径
+func fakeNFTBin() (dir, output string) {
+	dir, _ = ioutil.TempDir("", "ts-dns-nft")
+	output = filepath.Join(dir, "output")
+	script := "#!/bin/sh\ncat >> " + output + "\n"
+	_ = ioutil.WriteFile(filepath.Join(dir, "nft"), []byte(script), 0755)
+	nftBin = filepath.Join(dir, "nft")
+	return
+}
+
+func TestNewNFTMap(t *testing.T) {
+	nftMap, err := NewNFTMap("inet mangle route_v4", "inet mangle route_v6", " 0x1 ", 60)
+	assert.Nil(t, err)
+	assert.Equal(t, &NFTMap{Family: "inet", Table: "mangle", Map: "route_v4", Map6: "route_v6",
+		Value: "0x1", Timeout: 60}, nftMap)
+	nftMap, err = NewNFTMap("", "ip6 filter route", "accept", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "", nftMap.Map)
+	assert.Equal(t, "route", nftMap.Map6)
+
+	for _, args := range [][3]string{
+		{"", "", "0x1"},                           // 未指定map
+		{"inet mangle", "", "0x1"},                // 格式错误
+		{"inet mangle a", "inet filter b", "0x1"}, // 不在同一个表
+		{"inet mangle a", "", ""},                 // 未指定值
+		{"inet mangle a", "", "0x1 }; flush ruleset; {"},
+	} {
+		_, err = NewNFTMap(args[0], args[1], args[2], 0)
+		assert.NotNil(t, err, args)
+	}
+	_, err = NewNFTMap("inet mangle a", "", "0x1", -1)
+	assert.NotNil(t, err)
+}
+
+func TestGroup_AddNFTMap(t *testing.T) {
+	dir, output := fakeNFTBin()
+	defer func() { nftBin = "nft"; _ = os.RemoveAll(dir) }()
+
+	nftMap, _ := NewNFTMap("inet mangle route_v4", "inet mangle route_v6", "0x1", 60)
+	group := &Group{NFTMap: nftMap}
+	resp := &dns.Msg{Answer: []dns.RR{
+		&dns.A{A: net.IPv4(1, 1, 1, 1)}, &dns.AAAA{AAAA: net.ParseIP("2001:db8::1")},
+		&dns.CNAME{Target: "example.com."}, &dns.A{A: net.IPv4(1, 1, 1, 2)},
+	}}
+	group.AddNFTMap(resp) // ipv4、ipv6地址分别写入对应的map
+	raw, err := ioutil.ReadFile(output)
+	assert.Nil(t, err)
+	assert.Equal(t, "add element inet mangle route_v4 { 1.1.1.1 timeout 60s : 0x1, 1.1.1.2 timeout 60s : 0x1 }\n"+
+		"add element inet mangle route_v6 { 2001:db8::1 timeout 60s : 0x1 }\n", string(raw))
+
+	// 未配置ipv6 map或无地址时不写入
+	_ = os.Remove(output)
+	group.NFTMap, _ = NewNFTMap("inet mangle route_v4", "", "accept", 0)
+	group.AddNFTMap(&dns.Msg{Answer: []dns.RR{&dns.AAAA{AAAA: net.ParseIP("::1")}}})
+	group.AddNFTMap(nil)
+	_, err = os.Stat(output)
+	assert.True(t, os.IsNotExist(err))
+	group.AddNFTMap(&dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}})
+	raw, _ = ioutil.ReadFile(output)
+	assert.Equal(t, "add element inet mangle route_v4 { 1.1.1.1 : accept }\n", string(raw))
+
+	// 未配置时不做任何操作，nft执行失败时返回错误
+	(&Group{}).AddNFTMap(resp)
+	nftBin = filepath.Join(dir, "ne")
+	assert.NotNil(t, group.NFTMap.Add(resp))
+}
@@ -0,0 +1,76 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// 合成的NODATA响应中SOA记录的TTL（秒），即客户端缓存否定结果的时长（RFC 2308）
+const negativeTTL = 60
+
+// 生成以origin为所有者的SOA记录，ttl同时作为MINIMUM字段，参数均为合成值
+func synthSOA(origin string, ttl uint32) *dns.SOA {
+	origin = dns.Fqdn(origin)
+	return &dns.SOA{Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns: "ns." + origin, Mbox: "hostmaster." + origin, Serial: 1,
+		Refresh: 3600, Retry: 600, Expire: 86400, Minttl: ttl}
+}
+
+// 判断记录中是否包含SOA记录
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.SOA); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 为缺少SOA记录的NODATA响应（NOERROR且无应答记录，如经strip_ipv6、deny_private_answers过滤后的响应）补充以owner返回的名称为
+// 所有者的SOA记录，使客户端能够缓存否定结果。需要修改时返回副本
+func ensureSOA(question dns.Question, r *dns.Msg, owner func(name string) string) *dns.Msg {
+	if question.Qclass != dns.ClassINET || r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 || r.Truncated ||
+		hasSOA(r.Ns) {
+		return r
+	}
+	r = r.Copy() // r可能与缓存共享记录
+	r.Ns = append(r.Ns, synthSOA(owner(question.Name), negativeTTL))
+	return r
+}
+
+// 返回为name合成SOA记录时使用的所有者名称：依次为命中的rcode_overrides、存根区域、forward后缀及组规则、gfwlist规则中的域名，
+// 均未命中时为name。调用前需持有读锁
+func (handler *Handler) soaOwner(name string) string {
+	if suffix, _, ok := handler.MatchRcodeOverride(name); ok {
+		return suffix
+	}
+	if zone, stub := handler.MatchStubZone(name); stub != nil {
+		return zone
+	}
+	if suffix, caller := handler.MatchForward(name); caller != nil {
+		return suffix
+	}
+	if _, rule, _, decided := handler.priorityMatcher().Match(name); decided {
+		if suffix := ruleSuffix(rule); suffix != "" && dns.IsSubDomain(dns.Fqdn(suffix), dns.Fqdn(name)) {
+			return suffix
+		}
+	}
+	return name
+}
+
+// 返回ABP规则中的域名（如"||google.com^"中的"google.com"），含通配符等无法提取时返回空字符串
+func ruleSuffix(rule string) string {
+	rule = strings.TrimPrefix(rule, "@@")
+	rule = strings.TrimPrefix(strings.TrimPrefix(rule, "||"), "|")
+	if i := strings.Index(rule, "://"); i != -1 {
+		rule = rule[i+3:]
+	}
+	if i := strings.IndexAny(rule, "/^"); i != -1 {
+		rule = rule[:i]
+	}
+	rule = strings.TrimPrefix(rule, ".")
+	if _, ok := dns.IsDomainName(rule); !ok || rule == "" || strings.Contains(rule, "*") {
+		return ""
+	}
+	return rule
+}
@@ -0,0 +1,80 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEnsureSOA(t *testing.T) {
+	question := dns.Question{Name: "ip.cn.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	nodata := new(dns.Msg)
+	owner := func(name string) string { return name }
+	r := ensureSOA(question, nodata, owner)
+	assert.Len(t, nodata.Ns, 0) // 不修改原响应
+	soa := r.Ns[0].(*dns.SOA)
+	assert.Equal(t, "ip.cn.", soa.Hdr.Name)
+	assert.Equal(t, uint32(negativeTTL), soa.Hdr.Ttl)
+	assert.Equal(t, uint32(negativeTTL), soa.Minttl)
+	// 已有SOA、有应答记录、非NOERROR、被截断及非IN类的响应不做修改
+	assert.Equal(t, r, ensureSOA(question, r, owner))
+	for _, msg := range []*dns.Msg{answerA("1.1.1.1"), {MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}},
+		{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}, {MsgHdr: dns.MsgHdr{Truncated: true}}} {
+		assert.Equal(t, msg, ensureSOA(question, msg, owner))
+	}
+	chaos := dns.Question{Name: "version.bind.", Qtype: dns.TypeTXT, Qclass: dns.ClassCHAOS}
+	assert.Equal(t, nodata, ensureSOA(chaos, nodata, owner))
+}
+
+func TestHandler_NODATASOA(t *testing.T) {
+	rr, _ := dns.NewRR("ip.cn. 600 IN AAAA 2001:db8::1")
+	caller := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	group := &Group{Callers: []outbound.Caller{caller}, Filters: []ResponseFilter{StripIPv6Filter{}}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups: map[string]*Group{"clean": group, "dirty": group}}
+	// 经过滤器移除所有记录后的NODATA响应携带合成的SOA
+	r, _ := handler.Query(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeAAAA))
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Len(t, r.Answer, 0)
+	assert.Equal(t, "ip.cn.", r.Ns[0].(*dns.SOA).Hdr.Name)
+	// deny_private_answers同理
+	group.Filters, group.DenyPrivate = nil, true
+	caller.resp = answerA("192.168.1.1")
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+	assert.Len(t, r.Answer, 0)
+	assert.Len(t, r.Ns, 1)
+	// 上游NODATA响应已携带SOA时保持不变
+	upstream, _ := dns.NewRR("cn. 300 IN SOA a.dns.cn. root.cnnic.cn. 1 7200 3600 2419200 21600")
+	caller.resp = &dns.Msg{Ns: []dns.RR{upstream}}
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeMX))
+	assert.Len(t, r.Ns, 1)
+	assert.Equal(t, "cn.", r.Ns[0].Header().Name)
+	// 上游NODATA响应缺少SOA时补充
+	caller.resp = new(dns.Msg)
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeTXT))
+	assert.Equal(t, "ip.cn.", r.Ns[0].Header().Name)
+	// 命中组规则、forward等时以其中的域名后缀为所有者，缓存命中时相同
+	group.SetMatcher(matcher.NewABPByText("||example.com"))
+	handler.Forward = map[string]outbound.Caller{"lan": caller}
+	for name, owner := range map[string]string{"www.example.com.": "example.com.", "host.lan.": "lan.",
+		"www.ip.cn.": "www.ip.cn."} {
+		for i := 0; i < 2; i++ {
+			r, _ = handler.Query(new(dns.Msg).SetQuestion(name, dns.TypeTXT))
+			assert.Equal(t, owner, r.Ns[0].Header().Name)
+		}
+	}
+}
+
+func TestRuleSuffix(t *testing.T) {
+	for rule, suffix := range map[string]string{"||google.com": "google.com", "@@||baidu.com^": "baidu.com",
+		"|https://a.com/path": "a.com", ".b.com": "b.com", "c.com": "c.com", "||*.d.com": "", "": ""} {
+		assert.Equal(t, suffix, ruleSuffix(rule), rule)
+	}
+}
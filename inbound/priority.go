@@ -0,0 +1,78 @@
+package inbound
+
+import (
+	"sort"
+)
+
+// GFWListSource PriorityMatcher中gfwlist来源的名称
+const GFWListSource = "gfwlist"
+
+// RuleMatcher 域名规则匹配器，*matcher.ABPlus及*Group均实现了该接口
+type RuleMatcher interface {
+	MatchRule(domain string) (rule string, matched bool, ok bool)
+}
+
+// PrioritySource PriorityMatcher中的一个规则来源
+type PrioritySource struct {
+	Name     string // 组名或GFWListSource
+	Priority int    // 数值越大越先查询
+	Matcher  RuleMatcher
+}
+
+// PriorityMatcher 按优先级从高到低依次查询多个规则来源，优先级相同时按加入顺序查询
+type PriorityMatcher []PrioritySource
+
+// NewPriorityMatcher 按优先级对sources排序并生成PriorityMatcher，不修改sources
+func NewPriorityMatcher(sources ...PrioritySource) PriorityMatcher {
+	m := append(PriorityMatcher{}, sources...)
+	sort.SliceStable(m, func(i, j int) bool { return m[i].Priority > m[j].Priority })
+	return m
+}
+
+// Match 返回第一个有决定性结果的来源：matched为true代表命中规则，为false代表命中@@例外规则。均未命中时ok为false
+func (m PriorityMatcher) Match(domain string) (source, rule string, matched, ok bool) {
+	for _, s := range m {
+		if s.Matcher == nil {
+			continue
+		}
+		if rule, matched, ok = s.Matcher.MatchRule(domain); ok {
+			return s.Name, rule, matched, true
+		}
+	}
+	return "", "", false, false
+}
+
+// BuildPriority 根据各组规则及gfwlist生成并保存处理请求时使用的PriorityMatcher，避免每个请求重新排序。
+// 修改Groups、组的Priority、GFWMatcher、GFWPriority或RoutingMode后需重新调用（Refresh、UpdateLists会自动调用），
+// 调用前需持有写锁或尚未开始处理请求。未调用时每个请求重新生成
+func (handler *Handler) BuildPriority() {
+	handler.priority = handler.newPriorityMatcher()
+}
+
+// 返回处理请求时使用的PriorityMatcher，调用前需持有读锁
+func (handler *Handler) priorityMatcher() PriorityMatcher {
+	if handler.priority != nil {
+		return handler.priority
+	}
+	return handler.newPriorityMatcher()
+}
+
+// 生成由各组规则及gfwlist组成的PriorityMatcher。优先级相同时组规则先于gfwlist，组之间按组名排序。
+// RoutingRulesOnly模式下不包含gfwlist
+func (handler *Handler) newPriorityMatcher() PriorityMatcher {
+	names := make([]string, 0, len(handler.Groups))
+	for name := range handler.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sources := make([]PrioritySource, 0, len(names)+1)
+	for _, name := range names {
+		group := handler.Groups[name]
+		sources = append(sources, PrioritySource{Name: name, Priority: group.Priority, Matcher: group})
+	}
+	if handler.GFWMatcher != nil && handler.RoutingMode != RoutingRulesOnly {
+		sources = append(sources, PrioritySource{Name: GFWListSource, Priority: handler.GFWPriority,
+			Matcher: handler.GFWMatcher})
+	}
+	return NewPriorityMatcher(sources...)
+}
@@ -0,0 +1,126 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestPriorityMatcher(t *testing.T) {
+	low := PrioritySource{Name: "low", Priority: -1, Matcher: matcher.NewABPByText("google.com")}
+	gfw := PrioritySource{Name: GFWListSource, Matcher: matcher.NewABPByText("google.com\nyoutube.com")}
+	high := PrioritySource{Name: "high", Priority: 10, Matcher: matcher.NewABPByText("@@||google.com")}
+	empty := PrioritySource{Name: "empty", Priority: 20}
+	sources := []PrioritySource{low, gfw, high, empty}
+	m := NewPriorityMatcher(sources...)
+	assert.Equal(t, []PrioritySource{empty, high, gfw, low}, []PrioritySource(m))
+	assert.Equal(t, "low", sources[0].Name) // 不修改原列表
+
+	source, rule, matched, ok := m.Match("www.google.com.")
+	assert.Equal(t, []interface{}{"high", "@@||google.com", false, true}, []interface{}{source, rule, matched, ok})
+	source, _, matched, ok = m.Match("youtube.com")
+	assert.Equal(t, []interface{}{GFWListSource, true, true}, []interface{}{source, matched, ok})
+	_, _, _, ok = m.Match("baidu.com")
+	assert.False(t, ok)
+	// 优先级相同时按加入顺序查询
+	gfw.Priority = 10
+	source, _, matched, _ = NewPriorityMatcher(gfw, high).Match("google.com")
+	assert.Equal(t, GFWListSource, source)
+	assert.True(t, matched)
+}
+
+func TestHandler_Priority(t *testing.T) {
+	newResp := func(ip string) *dns.Msg {
+		return &dns.Msg{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: net.ParseIP(ip)}}}
+	}
+	clean := &Group{Callers: []outbound.Caller{&staticCaller{resp: newResp("1.1.1.1")}}, Matcher: matcher.NewABPByText("")}
+	dirty := &Group{Callers: []outbound.Caller{&staticCaller{resp: newResp("2.2.2.2")}}, Matcher: matcher.NewABPByText("")}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText("google.com"), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+		Groups:       map[string]*Group{"clean": clean, "dirty": dirty},
+	}
+	req := new(dns.Msg).SetQuestion("www.google.com.", dns.TypeA)
+	// gfwlist命中时转发至dirty组
+	_, result := handler.Query(req)
+	assert.Equal(t, "dirty", result.Group)
+	assert.Equal(t, "match gfwlist", result.Reason)
+	// clean组的例外规则优先级高于gfwlist时，强制使用clean组结果
+	clean.Matcher, clean.Priority = matcher.NewABPByText("@@||google.com"), 1
+	r, result := handler.Query(req)
+	assert.Equal(t, "clean", result.Group)
+	assert.Equal(t, "allowed by rules of clean", result.Reason)
+	assert.Equal(t, "@@||google.com", result.Rule)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// gfwlist优先级更高时仍以gfwlist为准
+	handler.GFWPriority = 2
+	_, result = handler.Query(req)
+	assert.Equal(t, "dirty", result.Group)
+	// 多个组的规则均命中时按优先级选择，与map遍历顺序无关
+	handler.GFWPriority = 0
+	clean.Matcher, dirty.Matcher = matcher.NewABPByText("google.com"), matcher.NewABPByText("google.com")
+	for i := 0; i < 10; i++ {
+		_, result = handler.Query(req)
+		assert.Equal(t, "clean", result.Group)
+		assert.Equal(t, "match by rules", result.Reason)
+	}
+	dirty.Priority = 2
+	_, result = handler.Query(req)
+	assert.Equal(t, "dirty", result.Group)
+}
+
+func TestHandler_BuildPriority(t *testing.T) {
+	clean := &Group{Callers: []outbound.Caller{&staticCaller{resp: answerA("1.1.1.1")}}, Matcher: matcher.NewABPByText("")}
+	dirty := &Group{Callers: []outbound.Caller{&staticCaller{resp: answerA("2.2.2.2")}}, Matcher: matcher.NewABPByText("")}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText("google.com"), GFWPriority: 1, CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+		Groups:       map[string]*Group{"clean": clean, "dirty": dirty},
+	}
+	req := new(dns.Msg).SetQuestion("www.google.com.", dns.TypeA)
+	handler.BuildPriority()
+	first := handler.priorityMatcher()
+	assert.Equal(t, &first[0], &handler.priorityMatcher()[0]) // 不再每个请求重新生成
+	// 组内规则可通过SetMatcher直接生效，修改优先级后需重新生成
+	clean.SetMatcher(matcher.NewABPByText("@@||google.com"))
+	clean.Priority = 2
+	_, result := handler.Query(req)
+	assert.Equal(t, "dirty", result.Group)
+	handler.BuildPriority()
+	_, result = handler.Query(req)
+	assert.Equal(t, "clean", result.Group)
+	// UpdateLists、Refresh时自动重新生成
+	handler.UpdateLists(matcher.NewABPByText("@@||google.com"), nil)
+	handler.Refresh(&Handler{GFWMatcher: matcher.NewABPByText("google.com"), GFWPriority: 3, Groups: handler.Groups})
+	_, result = handler.Query(req)
+	assert.Equal(t, "dirty", result.Group)
+	assert.Equal(t, "match gfwlist", result.Reason)
+}
+
+func TestHandler_PriorityIDN(t *testing.T) {
+	clean := &Group{Callers: []outbound.Caller{&staticCaller{resp: answerA("1.1.1.1")}}, Matcher: matcher.NewABPByText("")}
+	dirty := &Group{Callers: []outbound.Caller{&staticCaller{resp: answerA("2.2.2.2")}},
+		Matcher: matcher.NewABPByText("||xn--fsqu00a.xn--0zwm56d")}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText("||bücher.de"), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+		Groups:       map[string]*Group{"clean": clean, "dirty": dirty},
+	}
+	// 经线路传输的UTF-8域名以\DDD转义形式出现，归一化后匹配punycode规则
+	buf, _ := new(dns.Msg).SetQuestion("www.例子.测试.", dns.TypeA).Pack()
+	req := new(dns.Msg)
+	assert.Nil(t, req.Unpack(buf))
+	_, result := handler.Query(req)
+	assert.Equal(t, "dirty", result.Group)
+	assert.Equal(t, "||xn--fsqu00a.xn--0zwm56d", result.Rule)
+	// punycode域名匹配国际化域名规则
+	_, result = handler.Query(new(dns.Msg).SetQuestion("xn--bcher-kva.de.", dns.TypeA))
+	assert.Equal(t, "dirty", result.Group)
+	assert.Equal(t, "match gfwlist", result.Reason)
+}
@@ -0,0 +1,103 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 判断域名是否位于arpa.下（不区分大小写）
+func isARPA(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	return len(name) > len(".arpa") && strings.EqualFold(name[len(name)-len(".arpa"):], ".arpa")
+}
+
+// 将反向解析域名转换为对应的ip及前缀长度，如"1.168.192.in-addr.arpa."对应192.168.1.0、24。非反向解析域名时ok为false
+func reverseIP(name string) (ip net.IP, bits int, ok bool) {
+	if !isARPA(name) { // 每个请求都会经过该检查，先排除arpa.以外的域名，避免拆分标签
+		return nil, 0, false
+	}
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	n := len(labels) - 2
+	if n < 1 {
+		return nil, 0, false
+	}
+	switch suffix := strings.Join(labels[n:], "."); {
+	case suffix == "in-addr.arpa" && n <= net.IPv4len:
+		ip = make(net.IP, net.IPv4len)
+		for i, label := range labels[:n] {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil, 0, false
+			}
+			ip[n-1-i] = byte(octet)
+		}
+		return ip, 8 * n, true
+	case suffix == "ip6.arpa" && n <= net.IPv6len*2:
+		ip = make(net.IP, net.IPv6len)
+		for i, label := range labels[:n] {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil, 0, false
+			}
+			pos := n - 1 - i // 第pos个半字节
+			ip[pos/2] |= byte(nibble) << uint(4*(1-pos%2))
+		}
+		return ip, 4 * n, true
+	}
+	return nil, 0, false
+}
+
+// 判断域名是否属于私有及回环地址的反向解析区域（RFC 6303），返回区域名，如"168.192.in-addr.arpa."
+func privatePTRZone(name string) (zone string, ok bool) {
+	ip, bits, ok := reverseIP(name)
+	if !ok {
+		return "", false
+	}
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for _, subnet := range privateNets {
+		ones, total := subnet.Mask.Size()
+		if bits < ones || len(ip) != len(subnet.IP) || !subnet.Contains(ip) {
+			continue
+		}
+		// 区域按标签边界对齐，如172.16.0.0/12内的地址分属16~31.172.in-addr.arpa.
+		width := 8
+		if total == 128 {
+			width = 4
+		}
+		count := (ones+width-1)/width + 2
+		return strings.Join(labels[len(labels)-count:], ".") + ".", true
+	}
+	return "", false
+}
+
+// 在本地应答私有及回环地址的反向解析请求，不转发至上游：区域顶点返回SOA，其余域名返回NXDOMAIN
+func localPTR(request *dns.Msg, zone string) *dns.Msg {
+	r := new(dns.Msg).SetReply(request)
+	r.Authoritative = true
+	question := request.Question[0]
+	if !strings.EqualFold(question.Name, zone) {
+		r.Rcode = dns.RcodeNameError
+	} else if question.Qtype == dns.TypeSOA {
+		r.Answer = []dns.RR{stubSOA(zone)}
+		return r
+	}
+	r.Ns = []dns.RR{stubSOA(zone)}
+	return r
+}
+
+// 根据hosts生成PTR请求的响应，仅适用于完整的ip地址。未命中时返回nil
+func (handler *Handler) hostsPTR(question dns.Question) *dns.Msg {
+	ip, bits, ok := reverseIP(question.Name)
+	if !ok || bits != len(ip)*8 {
+		return nil
+	}
+	for _, reader := range handler.HostsReaders {
+		if hostname := reader.Hostname(ip.String()); hostname != "" {
+			hdr := dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: handler.HostsTTL}
+			return &dns.Msg{Answer: []dns.RR{&dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(hostname)}}}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReverseIP(t *testing.T) {
+	ip, bits, ok := reverseIP("1.0.0.127.In-Addr.Arpa.")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", ip.String())
+	assert.Equal(t, 32, bits)
+	ip, bits, ok = reverseIP("168.192.in-addr.arpa.")
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.0.0", ip.String())
+	assert.Equal(t, 16, bits)
+	ip, bits, ok = reverseIP("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.")
+	assert.True(t, ok)
+	assert.Equal(t, "::1", ip.String())
+	assert.Equal(t, 128, bits)
+	ip, bits, ok = reverseIP("d.f.ip6.arpa.")
+	assert.True(t, ok)
+	assert.Equal(t, "fd00::", ip.String())
+	assert.Equal(t, 8, bits)
+	ip, _, ok = reverseIP("1.0.0.127.in-addr.arpa") // 不含末尾的点
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", ip.String())
+	for _, name := range []string{"in-addr.arpa.", "256.in-addr.arpa.", "1.1.1.1.1.in-addr.arpa.",
+		"10.ip6.arpa.", "g.ip6.arpa.", "example.com.", "arpa.", "1.0.0.127.in-addr.arpa.example.com."} {
+		_, _, ok = reverseIP(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestPrivatePTRZone(t *testing.T) {
+	zones := map[string]string{
+		"1.0.0.127.in-addr.arpa.":   "127.in-addr.arpa.",
+		"5.4.20.172.in-addr.arpa.":  "20.172.in-addr.arpa.",
+		"168.192.in-addr.arpa.":     "168.192.in-addr.arpa.",
+		"1.10.IN-ADDR.ARPA.":        "10.in-addr.arpa.",
+		"0.0.0.0.d.f.ip6.arpa.":     "d.f.ip6.arpa.",
+		"1.0.0.0.0.8.e.f.ip6.arpa.": "8.e.f.ip6.arpa.",
+	}
+	for name, expect := range zones {
+		zone, ok := privatePTRZone(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, expect, zone, name)
+	}
+	for _, name := range []string{"8.8.8.8.in-addr.arpa.", "1.32.172.in-addr.arpa.", "172.in-addr.arpa.",
+		"192.in-addr.arpa.", "f.ip6.arpa.", "1.0.0.2.ip6.arpa."} {
+		_, ok := privatePTRZone(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestHandler_LocalPTR(t *testing.T) {
+	caller := &countCaller{resp: new(dns.Msg)}
+	group := &Group{Callers: []outbound.Caller{caller}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("192.168.1.1 router.lan\n8.8.8.8 dns.google")},
+		Groups:       map[string]*Group{"clean": group, "dirty": group}}
+
+	// 回环地址的反向解析在本地返回NXDOMAIN，不转发至上游
+	r, result := handler.Query(new(dns.Msg).SetQuestion("1.0.0.127.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, "local ptr zone 127.in-addr.arpa.", result.Reason)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	assert.Equal(t, "127.in-addr.arpa.", r.Ns[0].(*dns.SOA).Hdr.Name)
+	assert.Equal(t, 0, caller.count)
+	// 区域顶点的SOA请求
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("168.192.in-addr.arpa.", dns.TypeSOA))
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, "168.192.in-addr.arpa.", r.Answer[0].Header().Name)
+	// hosts中的记录优先，公网地址同样可由hosts应答
+	r, result = handler.Query(new(dns.Msg).SetQuestion("1.1.168.192.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, "hit hosts", result.Reason)
+	assert.Equal(t, "router.lan.", r.Answer[0].(*dns.PTR).Ptr)
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("8.8.8.8.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, "dns.google.", r.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, 0, caller.count)
+	// 公网地址转发至上游
+	handler.Query(new(dns.Msg).SetQuestion("1.1.1.1.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, 1, caller.count)
+	// 关闭后转发至上游
+	handler.ForwardPTR = true
+	handler.Query(new(dns.Msg).SetQuestion("2.0.0.127.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, 2, caller.count)
+}
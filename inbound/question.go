@@ -0,0 +1,44 @@
+package inbound
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"strings"
+)
+
+// 判断响应的question section是否与请求一致（域名不区分大小写，类型及类别须相同），不一致的响应可能是伪造的或上游存在缺陷。
+// 未携带question section的错误响应（如部分上游的FORMERR、REFUSED响应，且不含应答记录）视为一致，
+// 未携带question section的NOERROR、NXDOMAIN响应或包含应答记录的响应视为不一致
+func questionMatches(request, r *dns.Msg) bool {
+	if len(r.Question) == 0 && len(request.Question) > 0 {
+		return r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError && len(r.Answer) == 0
+	}
+	if len(request.Question) != len(r.Question) {
+		return false
+	}
+	for i, q := range request.Question {
+		if a := r.Question[i]; a.Qtype != q.Qtype || a.Qclass != q.Qclass || !strings.EqualFold(a.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// 检查上游响应的question section，不一致时丢弃响应并返回错误
+func checkQuestion(caller outbound.Caller, request, r *dns.Msg) (*dns.Msg, error) {
+	if r == nil || questionMatches(request, r) {
+		return r, nil
+	}
+	return nil, fmt.Errorf("discard response from %s: question %s does not match request %s",
+		callerName(caller), questionString(r), questionString(request))
+}
+
+// 返回question section的简要描述，如"example.com. IN A"
+func questionString(msg *dns.Msg) string {
+	if len(msg.Question) == 0 {
+		return "<empty>"
+	}
+	q := msg.Question[0]
+	return fmt.Sprintf("%s %s %s", q.Name, dns.Class(q.Qclass), dns.Type(q.Qtype))
+}
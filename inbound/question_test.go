@@ -0,0 +1,80 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+)
+
+func TestQuestionMatches(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("Example.com.", dns.TypeA)
+	assert.True(t, questionMatches(req, new(dns.Msg).SetReply(req)))
+	assert.True(t, questionMatches(req, new(dns.Msg).SetQuestion("example.COM.", dns.TypeA)))
+	// 未携带question section的错误响应视为一致，NOERROR、NXDOMAIN或包含应答记录的响应视为不一致
+	assert.True(t, questionMatches(req, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeRefused}}))
+	assert.True(t, questionMatches(req, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeFormatError}}))
+	assert.False(t, questionMatches(req, &dns.Msg{}))
+	assert.False(t, questionMatches(req, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}))
+	assert.False(t, questionMatches(req, answerA("6.6.6.6")))
+	servFail := answerA("6.6.6.6")
+	servFail.Rcode = dns.RcodeServerFailure
+	assert.False(t, questionMatches(req, servFail))
+	assert.True(t, questionMatches(&dns.Msg{}, &dns.Msg{}))
+	assert.False(t, questionMatches(req, new(dns.Msg).SetQuestion("evil.com.", dns.TypeA)))
+	assert.False(t, questionMatches(req, new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA)))
+	chaos := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+	assert.False(t, questionMatches(req, chaos))
+	two := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	two.Question = append(two.Question, two.Question[0])
+	assert.False(t, questionMatches(req, two))
+
+	_, err := checkQuestion(&staticCaller{}, req, chaos)
+	assert.EqualError(t, err, "discard response from *inbound.staticCaller: "+
+		"question example.com. CH A does not match request Example.com. IN A")
+}
+
+// 原样返回响应的Caller，不补全question section
+type rawCaller struct {
+	resp *dns.Msg
+}
+
+func (caller *rawCaller) Call(*dns.Msg) (*dns.Msg, error) {
+	return caller.resp.Copy(), nil
+}
+
+func TestGroup_QuestionMismatch(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	spoofed := answerA("6.6.6.6")
+	spoofed.SetQuestion("evil.com.", dns.TypeA)
+	valid := answerA("1.1.1.1")
+	valid.SetQuestion("example.com.", dns.TypeA)
+	next := &countCaller{resp: valid}
+
+	// 丢弃question不一致的响应并尝试下一个上游
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: spoofed}, next}}
+	r := group.CallDNS(req)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 1, next.count)
+	// 并发模式下同样丢弃
+	group.Concurrent = true
+	r = group.CallDNS(req)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// 未携带question section但包含应答记录的响应同样丢弃
+	group = &Group{Callers: []outbound.Caller{&rawCaller{resp: answerA("6.6.6.6")}, next}}
+	r = group.CallDNS(req)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// 所有上游均不一致时视为请求失败，不写入缓存
+	group = &Group{Callers: []outbound.Caller{&staticCaller{resp: spoofed}}}
+	assert.Nil(t, group.CallDNS(req))
+
+	// forward规则的上游同样检查
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(),
+		Forward: map[string]outbound.Caller{"example.com": &staticCaller{resp: spoofed}}}
+	r, result := handler.Query(req)
+	assert.Equal(t, "match forward example.com", result.Reason)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+}
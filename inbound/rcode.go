@@ -0,0 +1,28 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// MatchRcodeOverride 查找域名（或其上级域名）在RcodeOverrides中对应的响应码，未找到时ok为false
+func (handler *Handler) MatchRcodeOverride(name string) (suffix string, rcode int, ok bool) {
+	if len(handler.RcodeOverrides) == 0 {
+		return "", 0, false
+	}
+	for _, suffix = range domainSuffixes(strings.ToLower(name)) {
+		if rcode, ok = handler.RcodeOverrides[suffix]; ok {
+			return suffix, rcode, true
+		}
+	}
+	return "", 0, false
+}
+
+// 生成指定响应码的响应，NXDOMAIN时附带以匹配的域名后缀为所有者的合成SOA，便于客户端缓存否定结果（RFC 2308）
+func rcodeOverride(request *dns.Msg, suffix string, rcode int) *dns.Msg {
+	r := new(dns.Msg).SetRcode(request, rcode)
+	if rcode == dns.RcodeNameError {
+		r.Ns = []dns.RR{synthSOA(suffix, negativeTTL)}
+	}
+	return r
+}
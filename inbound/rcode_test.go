@@ -0,0 +1,57 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandler_RcodeOverrides(t *testing.T) {
+	caller := &countCaller{resp: answerA("1.1.1.1")}
+	group := &Group{Callers: []outbound.Caller{caller}}
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("10.0.0.1 blocked.example.com")},
+		Cache:        cache.NewDNSCache(10, 0, time.Hour),
+		Groups:       map[string]*Group{"clean": group, "dirty": group},
+		RcodeOverrides: map[string]int{"blocked.example.com": dns.RcodeNameError, "refused.test": dns.RcodeRefused,
+			"broken.test": dns.RcodeServerFailure}}
+
+	suffix, rcode, ok := handler.MatchRcodeOverride("A.Blocked.Example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, "blocked.example.com", suffix)
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	_, _, ok = handler.MatchRcodeOverride("example.com.")
+	assert.False(t, ok)
+
+	// 命中的域名（及子域名）直接返回指定响应码，优先于hosts，不请求上游
+	cases := map[string]int{"blocked.example.com.": dns.RcodeNameError, "www.refused.test.": dns.RcodeRefused,
+		"broken.test.": dns.RcodeServerFailure}
+	for name, rcode := range cases {
+		writer := &MockRespWriter{}
+		handler.ServeDNS(writer, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		assert.Equal(t, rcode, writer.r.Rcode, name)
+		assert.Empty(t, writer.r.Answer, name)
+	}
+	assert.Equal(t, 0, caller.count)
+	// NXDOMAIN附带以匹配后缀为所有者的SOA
+	r, result := handler.Query(new(dns.Msg).SetQuestion("a.blocked.example.com.", dns.TypeAAAA))
+	assert.Equal(t, "rcode override blocked.example.com", result.Reason)
+	assert.Equal(t, "blocked.example.com.", r.Ns[0].(*dns.SOA).Hdr.Name)
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("refused.test.", dns.TypeA))
+	assert.Empty(t, r.Ns)
+
+	// 其它域名正常解析
+	r, result = handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.NotContains(t, result.Reason, "rcode override")
+	assert.Equal(t, 1, caller.count)
+}
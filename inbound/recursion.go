@@ -0,0 +1,32 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// 客户端请求未设置RD（期望递归）标志时的处理方式
+const (
+	NonRecursiveRecurse = "recurse" // 同设置RD的请求，按需转发至上游
+	NonRecursiveLocal   = "local"   // 只使用hosts、缓存等本地数据应答，需要转发至上游时返回REFUSED。按所在地或监听地址分组的请求不读取缓存
+)
+
+// 判断请求是否应只使用本地数据应答
+func (handler *Handler) localOnly(request *dns.Msg) bool {
+	return !request.RecursionDesired && handler.NonRecursive == NonRecursiveLocal
+}
+
+// 生成拒绝递归的响应：REFUSED，且不设置RA标志
+func refuseRecursion(request *dns.Msg) *dns.Msg {
+	return new(dns.Msg).SetRcode(request, dns.RcodeRefused)
+}
+
+// 检查NonRecursive是否有效
+func (handler *Handler) checkNonRecursive() bool {
+	switch handler.NonRecursive {
+	case "", NonRecursiveRecurse, NonRecursiveLocal:
+		return true
+	}
+	log.Errorf("unknown non_recursive: %q", handler.NonRecursive)
+	return false
+}
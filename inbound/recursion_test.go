@@ -0,0 +1,86 @@
+package inbound
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 生成未设置RD标志的请求
+func nonRecursive(name string) *dns.Msg {
+	req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	req.RecursionDesired = false
+	return req
+}
+
+func TestHandler_NonRecursive(t *testing.T) {
+	newHandler := func(behavior string) (*Handler, *countCaller) {
+		caller := &countCaller{resp: answerA("1.1.1.1")}
+		return &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+			GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"), QueryLogger: log.New(),
+			HostsReaders: []hosts.Reader{hosts.NewReaderByText("2.2.2.2 local.example")},
+			Groups:       map[string]*Group{"clean": {Callers: []outbound.Caller{caller}}}, NonRecursive: behavior,
+		}, caller
+	}
+	// 默认及recurse时与设置RD的请求相同，响应保留请求的RD标志
+	for _, behavior := range []string{"", NonRecursiveRecurse} {
+		handler, caller := newHandler(behavior)
+		handler.Groups["dirty"] = handler.Groups["clean"]
+		assert.True(t, handler.IsValid())
+		r, result := handler.Query(nonRecursive("example.com."))
+		assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+		assert.NotEqual(t, "non-recursive query", result.Reason)
+		assert.False(t, r.RecursionDesired)
+		assert.Equal(t, 1, caller.count)
+	}
+
+	// local时未命中本地数据的请求返回REFUSED，不转发至上游
+	handler, caller := newHandler(NonRecursiveLocal)
+	handler.Groups["dirty"] = handler.Groups["clean"]
+	assert.True(t, handler.IsValid())
+	writer := &MockRespWriter{}
+	handler.ServeDNS(writer, nonRecursive("example.com."))
+	assert.Equal(t, dns.RcodeRefused, writer.r.Rcode)
+	assert.False(t, writer.r.RecursionDesired)
+	assert.Equal(t, 0, caller.count)
+	// hosts及本地反向解析区域正常应答
+	r, result := handler.Query(nonRecursive("local.example."))
+	assert.Equal(t, "hit hosts", result.Reason)
+	assert.Equal(t, "2.2.2.2", r.Answer[0].(*dns.A).A.String())
+	ptr := new(dns.Msg).SetQuestion("1.0.0.127.in-addr.arpa.", dns.TypePTR)
+	ptr.RecursionDesired = false
+	r, _ = handler.Query(ptr)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	// 设置RD的请求正常转发，之后RD=0的请求可命中缓存
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	r, result = handler.Query(nonRecursive("example.com."))
+	assert.Equal(t, "hit cache", result.Reason)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 1, caller.count)
+	// REFUSED响应不写入缓存
+	_, result = handler.Query(nonRecursive("other.com."))
+	assert.Equal(t, "non-recursive query", result.Reason)
+	_, result = handler.Query(new(dns.Msg).SetQuestion("other.com.", dns.TypeA))
+	assert.NotEqual(t, "hit cache", result.Reason)
+
+	// 按监听地址分组的请求不读取缓存，即使已缓存同一域名也返回REFUSED
+	handler.ListenerGroups = map[string]string{"127.0.0.1:53": "clean"}
+	ctx, count := withListener(context.Background(), "127.0.0.1:53"), caller.count
+	r, result = handler.queryContext(ctx, nonRecursive("example.com."), nil)
+	assert.Equal(t, "non-recursive query", result.Reason)
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+	assert.Equal(t, count, caller.count)
+
+	// 未知值时拒绝加载
+	handler.NonRecursive = "drop"
+	assert.False(t, handler.IsValid())
+}
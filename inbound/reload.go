@@ -0,0 +1,75 @@
+package inbound
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// 重载配置失败时的处理方式
+const (
+	ReloadFailureKeep     = "keep"     // 保持原有配置，就绪状态不受影响
+	ReloadFailureDegraded = "degraded" // 保持原有配置，但进入降级状态（Ready返回错误），直至下次重载成功
+)
+
+// ReloadStatus 配置重载的统计及最近一次重载的结果
+type ReloadStatus struct {
+	Time      time.Time `json:"time"`            // 最近一次重载的时间，从未重载时为零值
+	Success   bool      `json:"success"`         // 最近一次重载是否成功
+	Error     string    `json:"error,omitempty"` // 最近一次重载失败的原因
+	Successes uint64    `json:"successes"`       // 重载成功的次数
+	Failures  uint64    `json:"failures"`        // 重载失败的次数
+	Degraded  bool      `json:"degraded"`        // 是否因重载失败处于降级状态
+}
+
+// Reload 调用load载入新配置，载入成功时通过Refresh更新现有配置，失败时保持原有配置并按ReloadFailure处理。
+// 返回load的结果，重载状态可通过ReloadStatus查看
+func (handler *Handler) Reload(load func() (*Handler, error)) (*Handler, error) {
+	target, err := load()
+	if err == nil && target == nil {
+		err = fmt.Errorf("empty config")
+	}
+	if err == nil {
+		handler.Refresh(target)
+	}
+	handler.recordReload(err)
+	return target, err
+}
+
+// 记录重载结果，失败且ReloadFailure为ReloadFailureDegraded时进入降级状态，成功时退出降级状态
+func (handler *Handler) recordReload(err error) {
+	handler.Mux.RLock()
+	degraded := handler.ReloadFailure == ReloadFailureDegraded
+	handler.Mux.RUnlock()
+
+	handler.reloadMux.Lock()
+	defer handler.reloadMux.Unlock()
+	status := &handler.reloadStatus
+	status.Time, status.Success, status.Error = time.Now(), err == nil, ""
+	if err == nil {
+		status.Successes++
+		status.Degraded = false
+		return
+	}
+	status.Failures++
+	status.Error = err.Error()
+	status.Degraded = status.Degraded || degraded
+	log.Errorf("reload config failed, keep serving old config (degraded: %v): %s", status.Degraded, status.Error)
+}
+
+// ReloadStatus 返回配置重载的状态
+func (handler *Handler) ReloadStatus() ReloadStatus {
+	handler.reloadMux.Lock()
+	defer handler.reloadMux.Unlock()
+	return handler.reloadStatus
+}
+
+// 检查ReloadFailure是否有效
+func (handler *Handler) checkReloadFailure() bool {
+	switch handler.ReloadFailure {
+	case "", ReloadFailureKeep, ReloadFailureDegraded:
+		return true
+	}
+	log.Errorf("unknown reload_failure: %q", handler.ReloadFailure)
+	return false
+}
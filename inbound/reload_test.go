@@ -0,0 +1,97 @@
+package inbound
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// 生成clean、dirty组均使用指定上游的Handler
+func reloadHandler(ip string) *Handler {
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: answerA(ip)}}}
+	return &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		Groups: map[string]*Group{"clean": group, "dirty": group}}
+}
+
+func TestHandler_Reload(t *testing.T) {
+	for _, behavior := range []string{"", ReloadFailureKeep, ReloadFailureDegraded} {
+		handler := reloadHandler("1.1.1.1")
+		handler.ReloadFailure = behavior
+		assert.True(t, handler.IsValid())
+		admin := handler.AdminHandler()
+		get := func(url string) (int, *ReloadStatus) {
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+			status := new(ReloadStatus)
+			_ = json.Unmarshal(w.Body.Bytes(), status)
+			return w.Code, status
+		}
+		resolve := func() string {
+			r, _ := handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			return r.Answer[0].(*dns.A).A.String()
+		}
+		// 从未重载
+		_, status := get("/reload/status")
+		assert.True(t, status.Time.IsZero())
+		assert.Equal(t, uint64(0), status.Successes+status.Failures)
+
+		// 重载失败时保持原有配置并记录失败原因
+		_, err := handler.Reload(func() (*Handler, error) { return nil, fmt.Errorf("invalid config") })
+		assert.EqualError(t, err, "invalid config")
+		assert.Equal(t, "1.1.1.1", resolve())
+		_, status = get("/reload/status")
+		assert.False(t, status.Time.IsZero())
+		assert.False(t, status.Success)
+		assert.Equal(t, "invalid config", status.Error)
+		assert.Equal(t, uint64(1), status.Failures)
+		// 仅degraded时进入降级状态，/readyz返回503
+		code, _ := get("/readyz")
+		if behavior == ReloadFailureDegraded {
+			assert.True(t, status.Degraded)
+			assert.Equal(t, http.StatusServiceUnavailable, code)
+			assert.Contains(t, handler.Ready().Error(), "invalid config")
+		} else {
+			assert.False(t, status.Degraded)
+			assert.Equal(t, http.StatusOK, code)
+		}
+
+		// 重载成功后使用新配置并退出降级状态
+		target := reloadHandler("2.2.2.2")
+		target.ReloadFailure = behavior
+		_, err = handler.Reload(func() (*Handler, error) { return target, nil })
+		assert.Nil(t, err)
+		assert.Equal(t, "2.2.2.2", resolve())
+		_, status = get("/reload/status")
+		assert.True(t, status.Success)
+		assert.Empty(t, status.Error)
+		assert.False(t, status.Degraded)
+		assert.Equal(t, uint64(1), status.Successes)
+		assert.Equal(t, uint64(1), status.Failures)
+		code, _ = get("/readyz")
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = get("/reload/status")
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	// 未返回配置时同样视为失败
+	handler := reloadHandler("1.1.1.1")
+	_, err := handler.Reload(func() (*Handler, error) { return nil, nil })
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(1), handler.ReloadStatus().Failures)
+	// 未知值时拒绝加载
+	handler.ReloadFailure = "unknown"
+	assert.False(t, handler.IsValid())
+	w := httptest.NewRecorder()
+	handler.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reload/status", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,27 @@
+package inbound
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+)
+
+// Resolve 按Handler的配置处理dns请求并返回完整的响应，供嵌入本程序的调用方使用。处理流程同Query（不做访问控制、
+// 不写入IPSet），ctx结束时不再尝试后续上游并返回ctx的错误。请求为nil或不包含question时返回错误。
+// 返回的响应为副本，不与缓存共享记录，可被调用方修改
+func (handler *Handler) Resolve(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	if request == nil || len(request.Question) == 0 {
+		return nil, errors.New("request has no question")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	handler.Mux.RLock()
+	defer handler.Mux.RUnlock()
+	r, result := handler.queryContext(ctx, request, nil)
+	r = handler.fallback(request, r, result)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return handler.reply(request, r).Copy(), nil // r可能与缓存共享记录
+}
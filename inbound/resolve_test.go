@@ -0,0 +1,86 @@
+package inbound
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandler_ResolveMsg(t *testing.T) {
+	caller := &countCaller{resp: answerA("1.1.1.1")}
+	slow := &delayCaller{delay: time.Second, resp: answerA("9.9.9.9")}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"), QueryLogger: log.New(),
+		Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{caller}},
+			"dirty": {Callers: []outbound.Caller{caller}},
+			"slow":  {Callers: []outbound.Caller{slow}, Matcher: matcher.NewABPByText("||slow.com")},
+		}}
+
+	// 返回经分组、缓存处理的完整响应
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	r, err := handler.Resolve(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, req.Id, r.Id)
+	assert.True(t, r.Response)
+	assert.Equal(t, req.Question, r.Question)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	r, err = handler.Resolve(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 1, caller.count) // 命中缓存
+	// 修改返回的响应不影响缓存
+	r.Answer[0].(*dns.A).A[3] = 2
+	r.Question[0].Name = "modified.com."
+	r, err = handler.Resolve(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, "example.com.", r.Question[0].Name)
+	r, _ = handler.Query(req)
+	r.Answer[0].(*dns.A).A[3] = 3
+	r, _ = handler.Query(req)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+
+	// ctx超时后立即返回错误
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	r, err = handler.Resolve(ctx, new(dns.Msg).SetQuestion("slow.com.", dns.TypeA))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, r)
+	assert.True(t, time.Since(begin) < 500*time.Millisecond)
+	// ctx已结束或请求无效时返回错误
+	_, err = handler.Resolve(ctx, req)
+	assert.NotNil(t, err)
+	_, err = handler.Resolve(context.Background(), new(dns.Msg))
+	assert.NotNil(t, err)
+	_, err = handler.Resolve(context.Background(), nil)
+	assert.NotNil(t, err)
+}
+
+func TestHandler_ResolveCanceled(t *testing.T) {
+	slow := &delayCaller{delay: 200 * time.Millisecond, resp: answerA("9.9.9.9")}
+	group := &Group{Callers: []outbound.Caller{slow}}
+	c := cache.NewDNSCache(10, time.Minute, time.Hour)
+	c.FailTTL = time.Minute
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: c,
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups: map[string]*Group{"clean": group, "dirty": group}}
+	req := new(dns.Msg).SetQuestion("slow.com.", dns.TypeA)
+	// ctx超时导致的SERVFAIL不写入缓存，之后的请求仍转发至上游
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := handler.Resolve(ctx, req)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, handler.Cache.Len())
+	r, result := handler.Query(req)
+	assert.NotEqual(t, "hit cache", result.Reason)
+	assert.Equal(t, "9.9.9.9", r.Answer[0].(*dns.A).A.String())
+}
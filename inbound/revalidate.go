@@ -0,0 +1,112 @@
+package inbound
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/cache"
+	"time"
+)
+
+const (
+	cnipCleanTick  = time.Minute // cnipGroups清除过期对象的频率
+	cnipDefaultTTL = time.Minute // 响应中没有记录时判定结果的有效期
+)
+
+// DefaultRevalidateInterval AsyncCNIP模式下同一缓存条目两次重新判定之间的默认最小间隔
+const DefaultRevalidateInterval = time.Minute
+
+// cnipGroups中记录的判定结果
+type cnipEntry struct {
+	group   string
+	decided time.Time // 判定（或重新判定）的时间
+}
+
+// 返回同一缓存条目两次重新判定之间的最小间隔
+func (handler *Handler) revalidateInterval() time.Duration {
+	if handler.CNIPInterval > 0 {
+		return handler.CNIPInterval
+	}
+	return DefaultRevalidateInterval
+}
+
+// 返回cnipGroups，首次调用时初始化
+func (handler *Handler) cnipMap() *cache.TTLMap {
+	handler.cnipOnce.Do(func() {
+		handler.cnipGroups = cache.NewTTLMap(cnipCleanTick)
+	})
+	return handler.cnipGroups
+}
+
+// 记录经CN IP判定后写入缓存的响应所属的组，有效期与缓存一致。未启用AsyncCNIP或缓存时不做任何操作
+func (handler *Handler) recordCNIP(request, r *dns.Msg, group string) {
+	if !handler.AsyncCNIP || handler.Cache == nil {
+		return
+	}
+	ex := cnipDefaultTTL
+	if len(r.Answer) > 0 { // 写入缓存后记录的TTL即缓存时长
+		ex = time.Duration(r.Answer[0].Header().Ttl) * time.Second
+	}
+	handler.cnipMap().Set(cache.Key(request), &cnipEntry{group: group, decided: time.Now()}, ex)
+}
+
+// 返回缓存的响应经CN IP判定的结果，未经判定时返回nil
+func (handler *Handler) cnipRecord(request *dns.Msg) *cnipEntry {
+	value, ok := handler.cnipMap().Get(cache.Key(request))
+	if !ok {
+		return nil
+	}
+	return value.(*cnipEntry)
+}
+
+// 返回缓存的响应经CN IP判定所属的组，未经判定时ok为false
+func (handler *Handler) cnipGroup(request *dns.Msg) (group string, ok bool) {
+	if entry := handler.cnipRecord(request); entry != nil {
+		return entry.group, true
+	}
+	return "", false
+}
+
+// 命中的缓存如经过CN IP判定，且距上次判定已超出revalidateInterval，则异步重新判定并更新缓存，供下次请求使用。
+// 同一请求同时只进行一次重新判定，避免热点域名的每次缓存命中都请求上游
+func (handler *Handler) revalidateCNIP(request *dns.Msg) {
+	if !handler.AsyncCNIP || handler.RoutingMode == RoutingRulesOnly {
+		return
+	}
+	entry := handler.cnipRecord(request)
+	if entry == nil || time.Since(entry.decided) < handler.revalidateInterval() {
+		return
+	}
+	key := cache.Key(request)
+	if _, loaded := handler.revalidating.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	request = request.Copy() // 请求处理完毕后request可能被复用
+	go func() {
+		defer handler.revalidating.Delete(key)
+		handler.Mux.RLock()
+		defer handler.Mux.RUnlock()
+		if !handler.Limiter.Acquire() {
+			return
+		}
+		defer handler.Limiter.Release()
+
+		old, _ := handler.cnipGroup(request)
+		source, rule, matched, decided := handler.priorityMatcher().Match(request.Question[0].Name)
+		if decided && matched && source != GFWListSource {
+			return // 规则变动后已不再经过CN IP判定，等待缓存过期
+		}
+		ctx, cancel := handler.budgetContext(withOverflow(context.Background()))
+		defer cancel()
+		r, result := handler.verifyCNIP(ctx, request, source, rule, matched, decided)
+		if r == nil || overflowed(ctx) { // 上游均请求失败或组内并发超限时保留原缓存
+			return
+		}
+		handler.setCache(ctx, request, r, result.group)
+		handler.recordCNIP(request, r, result.Group)
+		if result.Group != old {
+			log.Infof("revalidate %s: group changed from %s to %s (%s)",
+				request.Question[0].Name, old, result.Group, result.Reason)
+		}
+	}()
+}
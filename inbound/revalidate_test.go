@@ -0,0 +1,136 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 可在请求期间替换响应的Caller
+type swapCaller struct {
+	mux   sync.Mutex
+	delay time.Duration
+	resp  *dns.Msg
+	count int
+}
+
+func (caller *swapCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	caller.mux.Lock()
+	delay, resp := caller.delay, caller.resp.Copy()
+	caller.count++
+	caller.mux.Unlock()
+	time.Sleep(delay)
+	return withQuestion(request, resp), nil
+}
+
+func (caller *swapCaller) swap(resp *dns.Msg, delay time.Duration) {
+	caller.mux.Lock()
+	defer caller.mux.Unlock()
+	caller.resp, caller.delay = resp, delay
+}
+
+func (caller *swapCaller) calls() int {
+	caller.mux.Lock()
+	defer caller.mux.Unlock()
+	return caller.count
+}
+
+func answerA(ip string) *dns.Msg {
+	rr, _ := dns.NewRR("example.com. 600 IN A " + ip)
+	return &dns.Msg{Answer: []dns.RR{rr}}
+}
+
+func TestHandler_AsyncCNIP(t *testing.T) {
+	clean, dirty := &swapCaller{resp: answerA("1.1.1.1")}, &swapCaller{resp: answerA("8.8.8.8")}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText("||example.com"), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		QueryLogger: log.New(), AsyncCNIP: true, CNIPInterval: 50 * time.Millisecond, Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{clean}},
+			"dirty": {Callers: []outbound.Caller{dirty}},
+		}}
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+	r, result := handler.Query(req)
+	assert.Equal(t, "cn/empty ipv4", result.Reason)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	group, ok := handler.cnipGroup(req)
+	assert.True(t, ok)
+	assert.Equal(t, "clean", group)
+
+	// clean组开始返回非cn ip：超出重新判定间隔后，命中缓存时立即返回旧响应，不等待上游
+	clean.swap(answerA("9.9.9.9"), 200*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	start := time.Now()
+	r, result = handler.Query(req)
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.Equal(t, "hit cache", result.Reason)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// 后台重新判定后改用dirty组的响应
+	assert.Eventually(t, func() bool {
+		group, _ := handler.cnipGroup(req)
+		return group == "dirty"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, dirty.calls())
+	r, result = handler.Query(req)
+	assert.Equal(t, "hit cache", result.Reason)
+	assert.Equal(t, "8.8.8.8", r.Answer[0].(*dns.A).A.String())
+}
+
+func TestHandler_AsyncCNIPDisabled(t *testing.T) {
+	clean := &swapCaller{resp: answerA("1.1.1.1")}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		QueryLogger: log.New(), Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{clean}},
+			"dirty": {Callers: []outbound.Caller{clean}},
+		}}
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	handler.Query(req)
+	_, ok := handler.cnipGroup(req)
+	assert.False(t, ok)
+	// 未启用时命中缓存不会重新请求上游
+	_, result := handler.Query(req)
+	assert.Equal(t, "hit cache", result.Reason)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, clean.calls())
+}
+
+func TestHandler_AsyncCNIPInterval(t *testing.T) {
+	clean := &swapCaller{resp: answerA("1.1.1.1")}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		QueryLogger: log.New(), AsyncCNIP: true, CNIPInterval: 100 * time.Millisecond, Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{clean}},
+			"dirty": {Callers: []outbound.Caller{clean}},
+		}}
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	handler.Query(req)
+	assert.Equal(t, 1, clean.calls())
+	hit := func(n int) {
+		for i := 0; i < n; i++ {
+			_, result := handler.Query(req)
+			assert.Equal(t, "hit cache", result.Reason)
+		}
+	}
+	// 间隔内的缓存命中不重新判定
+	hit(100)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, clean.calls())
+	// 超出间隔后，重复命中只触发一次重新判定
+	time.Sleep(100 * time.Millisecond)
+	clean.swap(answerA("1.1.1.2"), 20*time.Millisecond)
+	hit(100)
+	assert.Eventually(t, func() bool {
+		r := handler.Cache.Get(req)
+		return r != nil && r.Answer[0].(*dns.A).A.String() == "1.1.1.2"
+	}, time.Second, 5*time.Millisecond)
+	hit(100)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2, clean.calls())
+}
@@ -1,6 +1,10 @@
 package inbound
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/janeczku/go-ipset/ipset"
 	"github.com/miekg/dns"
@@ -8,172 +12,785 @@ import (
 	"github.com/wolf-joe/ts-dns/hosts"
 	"github.com/wolf-joe/ts-dns/matcher"
 	"github.com/wolf-joe/ts-dns/outbound"
+	"io"
+	"io/ioutil"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Group 各域名组相关配置
 type Group struct {
-	Callers    []outbound.Caller
-	Matcher    *matcher.ABPlus
-	IPSet      *ipset.IPSet
-	Concurrent bool
-	FastestV4  bool
+	noCallers     uint64 // 因上游均不可用（如熔断）而未发出请求的次数，置于首位以保证32位平台上原子操作的对齐
+	probed        int64  // Reachable最近一次探测的时间（UnixNano），同样需要对齐
+	probeOK       int32  // Reachable最近一次探测的结果，为1时可用
+	Callers       []outbound.Caller
+	DirectCallers []outbound.Caller // 不使用代理的Caller，与ProxyMatcher配合使用
+	ProxyMatcher  *matcher.ABPlus   // 匹配的域名使用Callers，其余域名使用DirectCallers
+	Matcher       *matcher.ABPlus   // 处理请求期间需通过SetMatcher修改
+	IPSet         *ipset.IPSet
+	NFTMap        *NFTMap // 写入解析结果的nftables map，为nil时不写入
+	Concurrent    bool
+	FastestV4     bool
+	Limiter       *Limiter         // 组内上游并发限制，为nil时不限制
+	DenyPrivate   bool             // 移除响应中的私有ip，防范dns重绑定
+	ForceRD       bool             // 向上游发送请求时总是设置RD（期望递归）标志
+	EDNSOptions   []dns.EDNS0      // 向上游发送请求时附加的EDNS0选项（如实验性或厂商私有选项），替换请求中的同代码选项
+	Filters       []ResponseFilter // 依次对上游响应生效的过滤器，在DenyPrivate之后生效
+	Priority      int              // 组内规则的优先级，数值越大越先于其它组规则及gfwlist生效
+	Mode          string           // 上游选择方式，可选ModeOrdered、ModeHash，仅在非并发模式下生效
+	FailoverCodes []int            // 视为失败并尝试下一个上游的响应码，为nil时仅包括SERVFAIL
+	RetryNoData   bool             // 为true时无应答记录的NOERROR响应（NODATA）同样视为失败，默认直接使用
+	MinAnswers    int              // A/AAAA响应中同类型记录少于该值时视为失败（疑似污染），为0时不限制
+	Strategy      string           // 并发模式下的响应选择方式，可选StrategyFirst、StrategyMerge、StrategyQuorum
+	Quorum        int              // StrategyQuorum模式下需返回相同应答记录的上游数，为0时为过半数
+	MinTTL        time.Duration    // 组内响应的最小缓存时长，覆盖缓存的全局配置，为0时沿用全局配置
+	MaxTTL        time.Duration    // 组内响应的最大缓存时长，覆盖缓存的全局配置，为0时沿用全局配置
+	matcherMux    sync.RWMutex
+}
+
+// SelectCallers 根据域名选择使用代理的Callers或直连的DirectCallers
+func (group *Group) SelectCallers(domain string) []outbound.Caller {
+	if group.ProxyMatcher == nil || len(group.DirectCallers) == 0 {
+		return group.Callers
+	}
+	if matched, ok := group.ProxyMatcher.Match(domain); ok && matched {
+		return group.Callers
+	}
+	return group.DirectCallers
+}
+
+// SetMatcher 替换组内的域名匹配规则，可在处理请求期间并发调用
+func (group *Group) SetMatcher(m *matcher.ABPlus) {
+	group.matcherMux.Lock()
+	defer group.matcherMux.Unlock()
+	group.Matcher = m
+}
+
+// MatchRules 判断域名是否匹配组内规则，可与SetMatcher并发调用
+func (group *Group) MatchRules(domain string) (matched bool, ok bool) {
+	_, matched, ok = group.MatchRule(domain)
+	return
+}
+
+// MatchRule 同MatchRules，并返回命中的组内规则
+func (group *Group) MatchRule(domain string) (rule string, matched bool, ok bool) {
+	group.matcherMux.RLock()
+	m := group.Matcher
+	group.matcherMux.RUnlock()
+	if m == nil {
+		return "", false, false
+	}
+	return m.MatchRule(domain)
 }
 
 // CallDNS 向组内的dns服务器转发请求
 func (group *Group) CallDNS(request *dns.Msg) *dns.Msg {
+	return group.CallDNSContext(context.Background(), request)
+}
+
+// CallDNSContext 同CallDNS，ctx结束（如超出请求的耗时预算）时不再尝试后续上游，返回已收到的首个失败响应或nil
+func (group *Group) CallDNSContext(parent context.Context, request *dns.Msg) *dns.Msg {
 	if len(group.Callers) == 0 || request == nil {
 		return nil
 	}
+	if group.ForceRD && !request.RecursionDesired {
+		request = request.Copy()
+		request.RecursionDesired = true
+	}
+	request = injectOptions(request, group.EDNSOptions)
+	if !group.Limiter.Acquire() {
+		log.Warnln("too many concurrent queries in group")
+		markOverflow(parent)
+		return nil
+	}
+	defer group.Limiter.Release()
+	callers := group.Callers
+	if len(request.Question) > 0 {
+		callers = group.SelectCallers(request.Question[0].Name)
+		if group.Mode == ModeHash && !group.Concurrent && !group.FastestV4 {
+			callers = hashOrder(request.Question[0].Name, callers)
+		}
+	}
+	// 上游均熔断时直接返回，计数并输出警告以便发现上游故障
+	available := availableCallers(callers)
+	if len(available) == 0 {
+		atomic.AddUint64(&group.noCallers, 1)
+		log.Warnf("no available dns in group, all %d upstreams are circuit open", len(callers))
+		return nil
+	}
+	callers = available
 	// 并发用的channel
-	ch := make(chan *dns.Msg, len(group.Callers))
+	ch := make(chan *dns.Msg, len(callers))
+	// 函数返回时取消仍在进行的并发请求
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
 	// 包裹Caller.Call，方便实现并发
 	call := func(caller outbound.Caller, request *dns.Msg) *dns.Msg {
-		r, err := caller.Call(request)
-		if err != nil {
+		var r *dns.Msg
+		var err error
+		begin := time.Now()
+		if group.Concurrent || group.FastestV4 {
+			r, err = callWithin(ctx, caller, request)
+		} else {
+			r, err = callWithin(parent, caller, request)
+		}
+		if err == nil {
+			r, err = checkQuestion(caller, request, r)
+		}
+		recordCall(parent, caller, time.Since(begin), err)
+		if err != nil && !errors.Is(err, outbound.ErrCanceled) {
 			log.Errorf("query dns error: %v", err)
 		}
 		ch <- r
 		return r
 	}
+	// 所有上游均失败时返回首个失败的响应（如SERVFAIL），而非直接丢弃
+	var failed *dns.Msg
+	accept := func(r *dns.Msg) bool {
+		if r == nil {
+			return false
+		}
+		if group.retriable(request, r) {
+			if failed == nil {
+				failed = r
+			}
+			return false
+		}
+		return true
+	}
 	// 遍历DNS服务器
-	for _, caller := range group.Callers {
+	for _, caller := range callers {
+		if ctx.Err() != nil {
+			log.Warnln("query budget exceeded, skip remaining upstreams in group")
+			return failed
+		}
 		if group.Concurrent || group.FastestV4 {
 			go call(caller, request)
-		} else if r := call(caller, request); r != nil {
+		} else if r := call(caller, request); accept(r) {
 			return r
 		}
 	}
 	// 并发情况下依次提取channel中的返回值
 	if group.Concurrent && !group.FastestV4 {
-		for i := 0; i < len(group.Callers); i++ {
-			if r := <-ch; r != nil {
+		switch group.Strategy {
+		case StrategyMerge:
+			if r := mergeAnswers(ch, len(callers), accept); r != nil {
+				return r
+			}
+			return failed
+		case StrategyQuorum:
+			quorum := group.Quorum
+			if quorum <= 0 {
+				quorum = len(callers)/2 + 1
+			}
+			if r := quorumAnswer(ch, len(callers), quorum, accept); r != nil {
+				return r
+			}
+			log.Warnf("less than %d of %d upstreams returned consistent answers", quorum, len(callers))
+			return failed
+		}
+		for i := 0; i < len(callers); i++ {
+			if r := <-ch; accept(r) {
 				return r
 			}
 		}
 	} else if group.FastestV4 { // 选择ping值最低的IPv4地址作为返回值
-		return fastestA(ch, len(group.Callers))
+		return fastestA(ch, len(callers))
 	}
-	return nil
+	return failed
+}
+
+// 判断上游响应是否应视为失败并尝试下一个上游：响应码属于FailoverCodes，启用RetryNoData时响应码为NOERROR但无应答记录，
+// 或A/AAAA响应中同类型记录少于MinAnswers
+func (group *Group) retriable(request, r *dns.Msg) bool {
+	if r.Rcode == dns.RcodeSuccess {
+		if len(r.Answer) == 0 {
+			return group.RetryNoData
+		}
+		return group.tooFewAnswers(request, r)
+	}
+	codes := group.FailoverCodes
+	if codes == nil {
+		codes = []int{dns.RcodeServerFailure}
+	}
+	for _, code := range codes {
+		if r.Rcode == code {
+			return true
+		}
+	}
+	return false
 }
 
-// AddIPSet 将dns响应中所有的ipv4地址加入group指定的ipset
+// 判断A/AAAA响应中与请求类型相同的记录数是否少于MinAnswers，被污染的响应通常仅包含单个伪造的ip
+func (group *Group) tooFewAnswers(request, r *dns.Msg) bool {
+	if group.MinAnswers <= 1 || len(request.Question) == 0 {
+		return false
+	}
+	qtype := request.Question[0].Qtype
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return false
+	}
+	count := 0
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == qtype {
+			count++
+		}
+	}
+	return count < group.MinAnswers
+}
+
+// NoCallers 返回因组内上游均不可用（如熔断）而直接返回SERVFAIL的请求次数
+func (group *Group) NoCallers() uint64 {
+	return atomic.LoadUint64(&group.noCallers)
+}
+
+// 过滤掉当前不可用（熔断中）的上游，均可用时返回原切片
+func availableCallers(callers []outbound.Caller) []outbound.Caller {
+	for i, caller := range callers {
+		if outbound.Available(caller) {
+			continue
+		}
+		available := append([]outbound.Caller{}, callers[:i]...)
+		for _, caller = range callers[i+1:] {
+			if outbound.Available(caller) {
+				available = append(available, caller)
+			}
+		}
+		return available
+	}
+	return callers
+}
+
+// Reachable探测结果的缓存时长，避免频繁的就绪检测（如/readyz）每次都向上游发送探测请求
+var reachableTTL = 5 * time.Second
+
+// Reachable 向组内上游依次发送探测请求，只要有一个上游正常响应即返回true。探测结果缓存reachableTTL
+func (group *Group) Reachable() bool {
+	if time.Now().UnixNano()-atomic.LoadInt64(&group.probed) < int64(reachableTTL) {
+		return atomic.LoadInt32(&group.probeOK) == 1
+	}
+	ok := group.probe()
+	var value int32
+	if ok {
+		value = 1
+	}
+	atomic.StoreInt32(&group.probeOK, value)
+	atomic.StoreInt64(&group.probed, time.Now().UnixNano())
+	return ok
+}
+
+// 向组内上游依次发送探测请求，只要有一个上游正常响应即返回true
+func (group *Group) probe() bool {
+	probe := probeRequest()
+	for _, callers := range [][]outbound.Caller{group.Callers, group.DirectCallers} {
+		for _, caller := range callers {
+			if r, err := caller.Call(probe); err == nil && r != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddIPSet 将dns响应中所有的ipv4地址加入group指定的ipset。多个地址时通过ipset restore批量添加
 func (group *Group) AddIPSet(r *dns.Msg) {
 	if group.IPSet == nil || r == nil {
 		return
 	}
+	var ips []string
 	for _, a := range extractA(r) {
-		if err := group.IPSet.Add(a.A.String(), group.IPSet.Timeout); err != nil {
-			log.Errorf("add ipset error: %v", err)
-		}
+		ips = append(ips, a.A.String())
+	}
+	var err error
+	switch len(ips) {
+	case 0:
+		return
+	case 1:
+		err = group.IPSet.Add(ips[0], group.IPSet.Timeout)
+	default:
+		err = addIPSetBatch(group.IPSet, ips)
+	}
+	if err != nil {
+		log.Errorf("add ipset error: %v", err)
 	}
-	return
 }
 
+// 分流模式
+const (
+	RoutingGFWList   = "gfwlist"    // 未匹配组规则的域名按CN IP+GFWList在clean、dirty组间分流
+	RoutingRulesOnly = "rules-only" // 仅按组规则分流，未匹配的域名使用DefaultGroup
+)
+
 // Handler 存储主要配置的dns请求处理器，程序核心
 type Handler struct {
-	Mux          *sync.RWMutex
-	Listen       string
-	Cache        *cache.DNSCache
-	GFWMatcher   *matcher.ABPlus
-	CNIP         *cache.RamSet
-	HostsReaders []hosts.Reader
-	Groups       map[string]*Group
-	QueryLogger  *log.Logger
+	Mux            *sync.RWMutex
+	Listen         []string
+	ListenTCP      bool          // 是否同时在Listen地址上监听TCP
+	DoTListen      string        // DoT监听地址，需同时设置TLSConfig
+	TLSConfig      *tls.Config   // DoT服务使用的证书
+	TCPKeepalive   time.Duration // TCP/DoT连接的空闲超时，客户端请求携带EDNS0 TCP Keepalive时告知客户端，为0时使用默认超时
+	MaxTCPSize     int           // TCP/DoT请求的长度上限（字节），超出时关闭连接，为0时不超过65535
+	Compress       bool          // 始终压缩响应中的域名（RFC 1035 4.1.4），否则只在响应超出UDP缓冲区或65535字节时压缩
+	AdminListen    string
+	ACL            *ACL        // 为nil时允许所有客户端访问
+	Cache          cache.Cache // 为nil时禁用缓存
+	GFWMatcher     *matcher.ABPlus
+	GFWPriority    int // gfwlist的优先级，与组的Priority相同时组内规则优先
+	CNIP           *cache.RamSet
+	CNIP6          *cache.RamSet // 中国ipv6网段，为nil时不检查AAAA记录
+	HostsReaders   []hosts.Reader
+	HostsTTL       uint32                     // hosts记录及其反向解析响应的TTL（秒），为0时客户端每次都重新查询
+	Forward        map[string]outbound.Caller // 域名后缀（小写） -> 指定上游，优先于分组规则和gfwlist
+	StubZones      map[string]*StubZone       // 区域名（小写，不含末尾的点） -> 存根区域，优先于Forward
+	Groups         map[string]*Group
+	RoutingMode    string            // 分流模式，为空时同RoutingGFWList
+	EmptyGroup     string            // 非必需组内无上游时的处理方式，为空时同EmptyGroupServFail
+	ReloadFailure  string            // 重载配置失败时的处理方式，为空时同ReloadFailureKeep
+	NonRecursive   string            // 客户端请求未设置RD标志时的处理方式，为空时同NonRecursiveRecurse
+	DefaultGroup   string            // RoutingRulesOnly模式下未匹配组规则的域名使用的组
+	RuleFiles      []string          // 各组引用的规则文件，自动重载配置时一并监测
+	Geo            GeoLocator        // 为nil时不根据客户端所在地选择分组
+	GeoGroups      map[string]string // 国家/地区代码 -> 组名
+	ListenerGroups map[string]string // 监听地址（Listen、DoTListen中的值） -> 组名，该地址接收的请求均使用指定的组
+	Limiter        *Limiter          // 全局上游并发限制，为nil时不限制
+	Fallback       *Fallback         // 所有上游均请求失败时返回的静态响应，为nil时返回SERVFAIL
+	ForceRA        bool              // 所有响应均设置RA（支持递归）标志，否则沿用上游响应中的RA
+	MinimalAny     bool              // 对ANY请求直接返回RFC 8482的最小HINFO响应，不转发至上游
+	ForwardPTR     bool              // 将私有及回环地址的反向解析请求转发至上游，否则在本地应答（RFC 6303）
+	TTLOverrides   map[string]uint32 // 域名后缀（小写） -> 强制返回给客户端的TTL（秒）
+	RcodeOverrides map[string]int    // 域名后缀（小写） -> 直接返回的响应码（如NXDOMAIN、REFUSED、SERVFAIL），优先于hosts及缓存，不转发至上游
+	ClientMaxTTL   uint32            // 返回给客户端的最大TTL（秒），与缓存时长无关，为0时不限制
+	AsyncCNIP      bool              // 命中经CN IP判定的缓存时立即返回，并异步重新判定、更新缓存
+	CNIPInterval   time.Duration     // AsyncCNIP模式下同一缓存条目两次重新判定的最小间隔，为0时使用DefaultRevalidateInterval
+	QueryBudget    time.Duration     // 单个请求向上游转发的总耗时上限（包括failover及clean、dirty组的先后请求），超出时返回已收到的响应，为0时不限制
+	SlowQuery      time.Duration     // 请求处理耗时超出该值时以warn级别记录详情（组、上游及耗时），为0时不记录
+	DedupWindow    time.Duration     // 同一客户端的相同请求在该时长内只处理一次，重复请求复用首个请求的响应，为0时不去重
+	ECSMaxPrefix   uint8             // 转发客户端请求中的IPv4 ECS时的最大前缀长度，超出时截断，为0时不截断
+	ECSMaxPrefix6  uint8             // 同ECSMaxPrefix，用于IPv6 ECS
+	CNAMELimit     int               // 上游响应中CNAME链的最大长度，出现循环或超出时视为请求失败，为0时使用DefaultCNAMELimit
+	TraceToken     string            // 请求携带内容为该令牌的TraceOptionCode选项时在响应中附加处理过程，为空时不启用
+	NormalizeNames bool              // 将响应中记录的所有者名称统一为请求域名的大小写，其余名称转为小写
+	Canary         *Canary           // 启动自检的配置，为nil时不自检
+	QueryLogger    *log.Logger
+	priority       PriorityMatcher // 由BuildPriority生成，为nil时每个请求重新生成
+	servers        []*dns.Server
+	cnipGroups     *cache.TTLMap // 缓存key -> 经CN IP判定的组名，由cnipOnce初始化
+	cnipOnce       sync.Once
+	revalidating   sync.Map // 正在异步重新判定的缓存key
+	dedupMux       sync.Mutex
+	dedupMap       map[string]*dedupEntry // 监听地址+客户端+缓存key -> DedupWindow内的请求，由dedupQuery初始化
+	draining       int32                  // 是否处于排空模式，通过SetDraining原子地修改
+	reloadMux      sync.Mutex
+	reloadStatus   ReloadStatus // 配置重载状态，由Reload更新
+}
+
+// MatchForward 查找域名（或其上级域名，不区分大小写）在Forward中对应的上游，未找到时返回nil
+func (handler *Handler) MatchForward(name string) (suffix string, caller outbound.Caller) {
+	if len(handler.Forward) == 0 {
+		return "", nil
+	}
+	for _, suffix = range domainSuffixes(strings.ToLower(name)) {
+		if caller = handler.Forward[suffix]; caller != nil {
+			return suffix, caller
+		}
+	}
+	return "", nil
+}
+
+// MatchTTLOverride 查找域名（或其上级域名，不区分大小写）在TTLOverrides中对应的TTL，未找到时ok为false
+func (handler *Handler) MatchTTLOverride(name string) (ttl uint32, ok bool) {
+	if len(handler.TTLOverrides) == 0 {
+		return 0, false
+	}
+	for _, suffix := range domainSuffixes(strings.ToLower(name)) {
+		if ttl, ok = handler.TTLOverrides[suffix]; ok {
+			return ttl, true
+		}
+	}
+	return 0, false
 }
 
 // HitHosts 如dns请求匹配hosts，则生成对应dns记录并返回。否则返回nil
 func (handler *Handler) HitHosts(request *dns.Msg) *dns.Msg {
 	question := request.Question[0]
-	if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
-		ipv6 := question.Qtype == dns.TypeAAAA
-		for _, reader := range handler.HostsReaders {
-			record, hostname := "", question.Name
-			if record = reader.Record(hostname, ipv6); record == "" {
-				// 去掉末尾的根域名再找一次
-				record = reader.Record(hostname[:len(hostname)-1], ipv6)
-			}
-			if record != "" {
-				if ret, err := dns.NewRR(record); err != nil {
-					log.Errorf("make DNS.RR error: %v", err)
-				} else {
-					r := new(dns.Msg)
-					r.Answer = append(r.Answer, ret)
-					return r
-				}
-			}
-		}
+	if question.Qclass != dns.ClassINET { // hosts记录仅适用于IN类请求
+		return nil
+	}
+	switch question.Qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME:
+		return handler.hostsAnswer(question)
+	}
+	if question.Qtype == dns.TypePTR {
+		return handler.hostsPTR(question)
 	}
 	return nil
 }
 
-// LogQuery 记录请求日志
-func (handler *Handler) LogQuery(resp dns.ResponseWriter, question dns.Question, msg, group string) {
-	fields := log.Fields{"domain": question.Name, "type": dns.Type(question.Qtype).String()}
-	src := resp.RemoteAddr().String()
-	fields["src"] = src[:strings.LastIndex(src, ":")]
-	if group != "" {
-		fields["group"] = group
+// LogQuery 记录请求日志，src为客户端地址
+func (handler *Handler) LogQuery(src string, question dns.Question, result *QueryResult) {
+	if !handler.logEnabled() {
+		return
+	}
+	fields := log.Fields{"domain": question.Name, "type": dns.Type(question.Qtype).String(), "src": src}
+	if result.Group != "" {
+		fields["group"] = result.Group
+	}
+	if result.Rule != "" {
+		fields["rule"] = result.Rule
+	}
+	handler.QueryLogger.WithFields(fields).Info(result.Reason)
+}
+
+// 判断请求日志是否会被输出：未启用info级别，或输出至ioutil.Discard（query_log.file为/dev/null）且无hook时不输出，
+// 可跳过日志的格式化
+func (handler *Handler) logEnabled() bool {
+	logger := handler.QueryLogger
+	if !logger.IsLevelEnabled(log.InfoLevel) {
+		return false
 	}
-	handler.QueryLogger.WithFields(fields).Info(msg)
+	return logger.Out != ioutil.Discard || len(logger.Hooks) > 0
+}
+
+// QueryResult 单次dns请求的处理结果
+type QueryResult struct {
+	Reason  string // 处理方式，如"hit hosts"、"match gfwlist"
+	Group   string // 处理请求的组名，未经过分组（如命中hosts、缓存）时为空
+	Rule    string // 命中的组内规则或gfwlist规则，如"||google.com"
+	Callers string // 请求期间调用的上游及耗时，仅在启用SlowQuery时记录
+	group   *Group
 }
 
-// ServeDNS 处理dns请求，程序核心函数
+// ServeDNS 处理dns请求，程序核心函数。处理流程见Query
 func (handler *Handler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
+	handler.serve(resp, request, "")
+}
+
+// 同ServeDNS，listen为接收请求的监听地址，为空时不按监听地址分组
+func (handler *Handler) serve(resp dns.ResponseWriter, request *dns.Msg, listen string) {
 	handler.Mux.RLock() // 申请读锁，持续整个请求
 	var r *dns.Msg
-	var group *Group
+	var result *QueryResult
+	addr := resp.RemoteAddr()
 	defer func() {
 		if r != nil {
-			r.SetReply(request) // 写入响应
-			_ = resp.WriteMsg(r)
+			r = handler.reply(request, r)
+			w := r
+			if handler.Compress { // 默认只在响应超出缓冲区时压缩
+				w = compressed(w)
+			}
+			if network := addr.Network(); network == "udp" {
+				w = truncateUDP(request, w) // 超出客户端缓冲区时压缩、截断并设置TC
+			} else {
+				if handler.TCPKeepalive > 0 && network == "tcp" && hasKeepalive(request) {
+					w = setKeepalive(w, handler.TCPKeepalive)
+				}
+				w = truncateTCP(w)
+			}
+			_ = resp.WriteMsg(w) // 写入响应
 		}
-		if group != nil {
-			group.AddIPSet(r) // 写入IPSet
+		if result != nil && result.group != nil {
+			result.group.AddIPSet(r)  // 写入IPSet
+			result.group.AddNFTMap(r) // 写入nftables map
 		}
 		handler.Mux.RUnlock() // 读锁解除
 		_ = resp.Close()      // 结束连接
 	}()
 
-	question := request.Question[0]
-	// 检测是否命中hosts
-	if r = handler.HitHosts(request); r != nil {
-		handler.LogQuery(resp, question, "hit hosts", "")
+	question, client, src := request.Question[0], remoteIP(addr), ""
+	if handler.logEnabled() || handler.SlowQuery > 0 { // 客户端地址只用于日志，不输出日志时跳过格式化
+		src = addr.String()
+		src = src[:strings.LastIndex(src, ":")]
+	}
+	// 检测客户端是否允许访问
+	if handler.ACL != nil && !handler.ACL.Allow(client) {
+		r = handler.ACL.Deny(request)
+		handler.LogQuery(src, question, &QueryResult{Reason: "denied by acl"})
+		return
+	}
+	trace, begin := handler.traceRequested(request), time.Now()
+	if trace {
+		request = stripTrace(request)
+	}
+	r, result = handler.dedupQuery(withListener(context.Background(), listen), request, client)
+	r = handler.fallback(request, r, result)
+	elapsed := time.Since(begin)
+	if trace {
+		r = appendTrace(r, question, result, elapsed)
+	}
+	handler.LogQuery(src, question, result)
+	handler.logSlowQuery(src, question, result, elapsed)
+}
+
+// Query 按Handler的配置处理dns请求（不做访问控制、不写入IPSet、不按客户端所在地及监听地址分组），返回响应及处理结果，可用于调试分组。
+// 返回的响应为副本，不与缓存共享记录，可被调用方修改
+func (handler *Handler) Query(request *dns.Msg) (*dns.Msg, *QueryResult) {
+	handler.Mux.RLock()
+	defer handler.Mux.RUnlock()
+	r, result := handler.query(request, nil)
+	r = handler.fallback(request, r, result)
+	return handler.reply(request, r).Copy(), result // r可能与缓存共享记录
+}
+
+// 将r设置为request的响应，并按配置设置RA标志
+func (handler *Handler) reply(request, r *dns.Msg) *dns.Msg {
+	r = reply(request, restoreECS(request, r))
+	if handler.ForceRA {
+		r.RecursionAvailable = true
+	}
+	// 按域名强制设置响应TTL，优先于缓存的min_ttl、max_ttl
+	if ttl, ok := handler.MatchTTLOverride(request.Question[0].Name); ok && len(r.Answer) > 0 {
+		r = r.Copy() // r可能与缓存共享记录
+		for _, rr := range r.Answer {
+			rr.Header().Ttl = ttl
+		}
+	} else if handler.ClientMaxTTL > 0 {
+		r = capTTL(r, handler.ClientMaxTTL)
+	}
+	if handler.NormalizeNames {
+		r = normalizeNames(r, request.Question[0].Name)
+	}
+	return ensureSOA(request.Question[0], r, handler.soaOwner)
+}
+
+// 将响应各section中记录的所有者名称统一为qname的大小写（与qname不同的名称，如CNAME目标，转为小写），需要修改时返回副本
+func normalizeNames(r *dns.Msg, qname string) *dns.Msg {
+	normalize := func(name string) string {
+		if strings.EqualFold(name, qname) {
+			return qname
+		}
+		return strings.ToLower(name)
+	}
+	changed := func(rrs []dns.RR) bool {
+		for _, rr := range rrs {
+			if normalize(rr.Header().Name) != rr.Header().Name {
+				return true
+			}
+		}
+		return false
+	}
+	if !changed(r.Answer) && !changed(r.Ns) && !changed(r.Extra) {
+		return r
+	}
+	r = r.Copy() // r可能与缓存共享记录
+	for _, rrs := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range rrs {
+			rr.Header().Name = normalize(rr.Header().Name)
+		}
+	}
+	return r
+}
+
+// 将响应中记录的TTL限制为不超过max，需要修改时返回副本
+func capTTL(r *dns.Msg, max uint32) *dns.Msg {
+	copied := false
+	for i, rr := range r.Answer {
+		if rr.Header().Ttl <= max {
+			continue
+		}
+		if !copied {
+			r, copied = r.Copy(), true // r可能与缓存共享记录
+		}
+		r.Answer[i].Header().Ttl = max
+	}
+	return r
+}
+
+// 读取dns缓存，Cache为nil时始终返回nil
+func (handler *Handler) getCache(request *dns.Msg) *dns.Msg {
+	if handler.Cache == nil {
+		return nil
+	}
+	return handler.Cache.Get(request)
+}
+
+// 写入dns缓存，group不为nil且设置了MinTTL、MaxTTL时按组的范围计算缓存时长。Cache为nil或ctx已结束时不做任何操作，
+// 避免调用方取消请求导致的SERVFAIL被缓存
+func (handler *Handler) setCache(ctx context.Context, request, r *dns.Msg, group *Group) {
+	if handler.Cache == nil || ctx.Err() != nil || overflowed(ctx) {
 		return
 	}
-	// 检测是否命中dns缓存
-	if r = handler.Cache.Get(request); r != nil {
-		handler.LogQuery(resp, question, "hit cache", "")
+	if setter, ok := handler.Cache.(cache.TTLSetter); ok && group != nil && (group.MinTTL > 0 || group.MaxTTL > 0) {
+		setter.SetTTL(request, r, group.MinTTL, group.MaxTTL)
 		return
 	}
+	handler.Cache.Set(request, r)
+}
+
+// 向指定组转发dns请求（组内无上游时按EmptyGroup处理），拒绝CNAME链过长的响应，组内启用DenyPrivate时过滤响应中的私有ip
+func (handler *Handler) callGroup(ctx context.Context, group *Group, request *dns.Msg) *dns.Msg {
+	if r := handler.sinkhole(group, request); r != nil {
+		return r
+	}
+	r := handler.checkChain(request, group.CallDNSContext(ctx, request))
+	if group.DenyPrivate {
+		r = filterPrivate(r)
+	}
+	return applyFilters(group.Filters, r)
+}
 
-	// 判断域名是否匹配指定规则
-	var name string
-	for name, group = range handler.Groups {
-		if match, ok := group.Matcher.Match(question.Name); ok && match {
-			handler.LogQuery(resp, question, "match by rules", name)
-			r = group.CallDNS(request)
-			// 设置dns缓存
-			handler.Cache.Set(request, r)
-			return
+// 处理dns请求，调用前需持有读锁，client为客户端ip（可为nil）。处理优先级依次为：ANY请求、hosts、私有地址反向解析、缓存、存根区域、forward、分组规则、
+// 客户端所在地、CN IP+GFWList（RoutingRulesOnly模式下为默认组）。hosts记录始终优先于缓存，因此hosts变动后无需等待缓存过期即可生效。
+// 按客户端所在地分组时响应因客户端而异，因此不读写缓存
+func (handler *Handler) query(request *dns.Msg, client net.IP) (r *dns.Msg, result *QueryResult) {
+	return handler.queryContext(context.Background(), request, client)
+}
+
+// 同query，parent结束时不再尝试后续上游
+func (handler *Handler) queryContext(parent context.Context, request *dns.Msg, client net.IP) (r *dns.Msg, result *QueryResult) {
+	question := request.Question[0]
+	request = handler.clampECS(request)
+	// 命中rcode_overrides的域名直接返回指定的响应码
+	if suffix, rcode, ok := handler.MatchRcodeOverride(question.Name); ok {
+		return rcodeOverride(request, suffix, rcode), &QueryResult{Reason: "rcode override " + suffix}
+	}
+	// ANY请求易被用于放大攻击，直接返回最小响应
+	if handler.MinimalAny && question.Qtype == dns.TypeANY {
+		return minimalAny(request), &QueryResult{Reason: "minimal any"}
+	}
+	// 检测是否命中hosts，须在检测缓存之前
+	if r = handler.HitHosts(request); r != nil {
+		if target := danglingCNAME(r, question.Qtype); target != "" {
+			r = handler.chaseHostsCNAME(request, r, target, client)
+		}
+		return r, &QueryResult{Reason: "hit hosts"}
+	}
+	// 私有及回环地址的反向解析请求不应泄露至上游
+	if zone, ok := privatePTRZone(question.Name); ok && !handler.ForwardPTR && question.Qclass == dns.ClassINET {
+		return localPTR(request, zone), &QueryResult{Reason: "local ptr zone " + zone}
+	}
+	country, geoName, geoGroup := handler.MatchGeo(client)
+	listen := listenerFrom(parent)
+	listenName, listenGroup := handler.MatchListener(listen)
+	// 检测是否命中dns缓存，按所在地或监听地址分组的请求不使用缓存
+	if geoGroup == nil && listenGroup == nil {
+		if r = handler.getCache(request); r != nil {
+			handler.revalidateCNIP(request)
+			return r, &QueryResult{Reason: "hit cache"}
+		}
+	}
+	// 未设置RD标志的请求不转发至上游
+	if handler.localOnly(request) {
+		return refuseRecursion(request), &QueryResult{Reason: "non-recursive query"}
+	}
+	// 限制同时进行的上游请求数量，超出时直接返回SERVFAIL且不缓存
+	if !handler.Limiter.Acquire() {
+		return servFail(request), &QueryResult{Reason: "too many queries"}
+	}
+	defer handler.Limiter.Release()
+	// 组内上游并发超限时同样不缓存响应
+	parent = withOverflow(parent)
+	defer func() {
+		if overflowed(parent) && r.Rcode == dns.RcodeServerFailure {
+			result.Reason = "too many queries"
+		}
+	}()
+	ctx, cancel := handler.budgetContext(parent)
+	defer cancel()
+	ctx, calls := handler.withCallLog(ctx)
+	if calls != nil {
+		defer func() {
+			if result != nil {
+				result.Callers = calls.String()
+			}
+		}()
+	}
+
+	// 判断域名是否属于存根区域
+	if zone, stub := handler.MatchStubZone(question.Name); stub != nil {
+		if r = handler.checkChain(request, stub.ResolveContext(ctx, zone, request)); r == nil {
+			r = servFail(request)
 		}
+		handler.setCache(parent, request, r, nil)
+		return r, &QueryResult{Reason: "stub zone " + zone}
+	}
+	// 判断域名是否匹配转发规则
+	if suffix, caller := handler.MatchForward(question.Name); caller != nil {
+		var err error
+		begin := time.Now()
+		if r, err = callWithin(ctx, caller, request); err == nil {
+			r, err = checkQuestion(caller, request, r)
+		}
+		recordCall(ctx, caller, time.Since(begin), err)
+		if err != nil {
+			log.Errorf("query dns error: %v", err)
+			r = servFail(request)
+		} else if r = handler.checkChain(request, r); r == nil {
+			r = servFail(request)
+		}
+		handler.setCache(parent, request, r, nil)
+		return r, &QueryResult{Reason: "match forward " + suffix}
+	}
+	// 判断监听地址是否指定了分组，优先于组规则及gfwlist
+	if listenGroup != nil {
+		if r = handler.callGroup(ctx, listenGroup, request); r == nil {
+			r = servFail(request)
+		}
+		return r, &QueryResult{Reason: "match listener " + listen, Group: listenName, group: listenGroup}
+	}
+	// 按优先级判断域名是否匹配各组规则及gfwlist
+	source, rule, matched, decided := handler.priorityMatcher().Match(question.Name)
+	if decided && matched && source != GFWListSource {
+		group := handler.Groups[source]
+		if r = handler.callGroup(ctx, group, request); r == nil {
+			r = servFail(request)
+		}
+		// 设置dns缓存
+		handler.setCache(parent, request, r, group)
+		return r, &QueryResult{Reason: "match by rules", Group: source, Rule: rule, group: group}
+	}
+	// 判断客户端所在地是否指定了分组
+	if geoGroup != nil {
+		if r = handler.callGroup(ctx, geoGroup, request); r == nil {
+			r = servFail(request)
+		}
+		return r, &QueryResult{Reason: "match geoip " + country, Group: geoName, group: geoGroup}
+	}
+	// 仅按组规则分流时，未匹配的域名使用默认组
+	if handler.RoutingMode == RoutingRulesOnly {
+		result = &QueryResult{Reason: "default group", Group: handler.DefaultGroup,
+			group: handler.Groups[handler.DefaultGroup]}
+		if r = handler.callGroup(ctx, result.group, request); r == nil {
+			r = servFail(request)
+		}
+		handler.setCache(parent, request, r, result.group)
+		return r, result
+	}
+	// 先用clean组dns解析，必要时再用dirty组解析
+	r, result = handler.verifyCNIP(ctx, request, source, rule, matched, decided)
+	if r == nil { // 所有上游均请求失败
+		r = servFail(request)
+	}
+	// 设置dns缓存
+	handler.setCache(parent, request, r, result.group)
+	if parent.Err() == nil && !overflowed(parent) {
+		handler.recordCNIP(request, r, result.Group)
 	}
-	// 先用clean组dns解析
-	r = handler.Groups["clean"].CallDNS(request)
-	if allInRange(r, handler.CNIP) {
+	return r, result
+}
+
+// 先用clean组解析，出现非cn ip且域名匹配gfwlist时再用dirty组解析。source等参数为priorityMatcher的匹配结果，
+// 所有上游均请求失败时r为nil
+func (handler *Handler) verifyCNIP(ctx context.Context, request *dns.Msg, source, rule string, matched, decided bool) (r *dns.Msg, result *QueryResult) {
+	result = &QueryResult{Group: "clean", group: handler.Groups["clean"]}
+	r = handler.callGroup(ctx, result.group, request)
+	if allInRange(r, handler.CNIP, handler.CNIP6) {
 		// 未出现非cn ip，流程结束
-		handler.LogQuery(resp, question, "cn/empty ipv4", "clean")
-	} else if blocked, ok := handler.GFWMatcher.Match(question.Name); !ok || !blocked {
-		// 出现非cn ip但域名不匹配gfwlist，流程结束
-		handler.LogQuery(resp, question, "not match gfwlist", "clean")
+		result.Reason = "cn/empty ipv4"
+	} else if !decided || !matched {
+		// 出现非cn ip但域名不匹配gfwlist（或优先匹配了白名单规则），流程结束
+		result.Reason, result.Rule = "not match gfwlist", rule
+		if decided && source != GFWListSource {
+			result.Reason = "allowed by rules of " + source
+		}
 	} else {
 		// 出现非cn ip且域名匹配gfwlist，用dirty组dns再次解析
-		handler.LogQuery(resp, question, "match gfwlist", "dirty")
-		r = handler.Groups["dirty"].CallDNS(request)
+		result = &QueryResult{Reason: "match gfwlist", Group: "dirty", Rule: rule, group: handler.Groups["dirty"]}
+		r = handler.callGroup(ctx, result.group, request)
 	}
-	// 设置dns缓存
-	handler.Cache.Set(request, r)
+	return r, result
 }
 
 // ResolveDoH 为DoHCaller解析域名，只需要调用一次。考虑到回环解析，建议在ServerDNS开始后异步调用
@@ -198,38 +815,96 @@ func (handler *Handler) ResolveDoH() {
 		}
 		log.Infof("resolve doh (%s): %v", caller.Host, caller.Servers)
 	}
-	// 遍历所有DoHCaller解析host
+	// 遍历所有DoHCaller解析host，多个组共享的DoHCaller只解析一次
+	resolved := map[*outbound.DoHCaller]bool{}
 	for _, group := range handler.Groups {
-		for _, caller := range group.Callers {
-			switch v := caller.(type) {
-			case *outbound.DoHCaller:
-				resolveDoH(v)
-			default:
-				continue
+		for _, callers := range [][]outbound.Caller{group.Callers, group.DirectCallers} {
+			for _, caller := range callers {
+				switch v := outbound.Unwrap(caller).(type) {
+				case *outbound.DoHCaller:
+					if !resolved[v] {
+						resolved[v] = true
+						resolveDoH(v)
+					}
+				default:
+					continue
+				}
 			}
 		}
 	}
 }
 
-// Refresh 刷新配置，复制target中除Mux、Listen之外的值
+// Refresh 刷新配置，复制target中除Mux、Listen、AdminListen之外的值。Cache、ACL会被直接覆盖，其余字段为nil时不覆盖
 func (handler *Handler) Refresh(target *Handler) {
 	handler.Mux.Lock()
 	defer handler.Mux.Unlock()
 
-	if target.Cache != nil {
-		handler.Cache = target.Cache
+	if closer, ok := handler.Cache.(io.Closer); ok && handler.Cache != target.Cache {
+		_ = closer.Close() // 关闭旧缓存的外部连接
 	}
+	handler.Cache = target.Cache // Cache为nil代表禁用缓存，需要直接覆盖
 	if target.GFWMatcher != nil {
 		handler.GFWMatcher = target.GFWMatcher
 	}
+	handler.GFWPriority = target.GFWPriority
 	if target.CNIP != nil {
 		handler.CNIP = target.CNIP
 	}
+	if closer, ok := handler.Geo.(io.Closer); ok && handler.Geo != target.Geo {
+		_ = closer.Close() // 关闭旧geoip数据库
+	}
+	handler.CNIP6 = target.CNIP6                                  // CNIP6为nil代表不检查AAAA记录，需要直接覆盖
+	handler.Geo, handler.GeoGroups = target.Geo, target.GeoGroups // Geo为nil代表不按所在地分组
+	handler.ListenerGroups = target.ListenerGroups
 	if target.HostsReaders != nil {
+		closeHostsReaders(handler.HostsReaders, target.HostsReaders)
 		handler.HostsReaders = target.HostsReaders
 	}
+	handler.HostsTTL = target.HostsTTL
+	handler.Forward = target.Forward // Forward为nil代表未配置转发规则，需要直接覆盖
+	handler.ACL = target.ACL         // ACL为nil代表不限制访问，需要直接覆盖
+	handler.Limiter = target.Limiter // Limiter为nil代表不限制并发，同样直接覆盖
+	handler.ForceRA, handler.MinimalAny = target.ForceRA, target.MinimalAny
+	handler.Compress = target.Compress
+	handler.ForwardPTR = target.ForwardPTR
+	handler.AsyncCNIP, handler.CNIPInterval = target.AsyncCNIP, target.CNIPInterval
+	handler.QueryBudget = target.QueryBudget
+	handler.SlowQuery = target.SlowQuery
+	handler.DedupWindow = target.DedupWindow
+	handler.ECSMaxPrefix, handler.ECSMaxPrefix6 = target.ECSMaxPrefix, target.ECSMaxPrefix6
+	handler.TTLOverrides = target.TTLOverrides // TTLOverrides为nil代表不覆盖TTL，需要直接覆盖
+	handler.Fallback = target.Fallback         // Fallback为nil代表返回SERVFAIL，需要直接覆盖
+	handler.RcodeOverrides = target.RcodeOverrides
+	handler.ClientMaxTTL = target.ClientMaxTTL
+	handler.CNAMELimit = target.CNAMELimit
+	handler.TraceToken = target.TraceToken
+	handler.NormalizeNames = target.NormalizeNames
+	handler.StubZones = target.StubZones // StubZones为nil代表未配置存根区域，需要直接覆盖
 	if target.Groups != nil {
 		handler.Groups = target.Groups
+		handler.RuleFiles = target.RuleFiles
+		handler.RoutingMode, handler.DefaultGroup = target.RoutingMode, target.DefaultGroup
+		handler.EmptyGroup = target.EmptyGroup
+	}
+	handler.ReloadFailure = target.ReloadFailure
+	handler.NonRecursive = target.NonRecursive
+	handler.Canary = target.Canary
+	handler.BuildPriority()
+}
+
+// UpdateLists 替换gfwlist及cnip，参数为nil时保持原有列表不变。可在处理请求期间调用
+func (handler *Handler) UpdateLists(gfw *matcher.ABPlus, cnip *cache.RamSet) {
+	if gfw == nil && cnip == nil {
+		return
+	}
+	handler.Mux.Lock()
+	defer handler.Mux.Unlock()
+	if gfw != nil {
+		handler.GFWMatcher = gfw
+		handler.BuildPriority()
+	}
+	if cnip != nil {
+		handler.CNIP = cnip
 	}
 }
 
@@ -238,10 +913,154 @@ func (handler *Handler) IsValid() bool {
 	if handler.Groups == nil {
 		return false
 	}
+	switch handler.RoutingMode {
+	case "", RoutingGFWList:
+	case RoutingRulesOnly:
+		if group := handler.Groups[handler.DefaultGroup]; group == nil || len(group.Callers) <= 0 {
+			log.Errorf("dns of default group %q cannot be empty", handler.DefaultGroup)
+			return false
+		}
+		return handler.checkBehaviors()
+	default:
+		log.Errorf("unknown routing mode: %q", handler.RoutingMode)
+		return false
+	}
 	clean, dirty := handler.Groups["clean"], handler.Groups["dirty"]
 	if clean == nil || len(clean.Callers) <= 0 || dirty == nil || len(dirty.Callers) <= 0 {
 		log.Errorf("dns of clean/dirty group cannot be empty")
 		return false
 	}
-	return true
+	return handler.checkBehaviors()
+}
+
+// 检查EmptyGroup、ReloadFailure、NonRecursive等处理方式及Canary的配置是否有效
+func (handler *Handler) checkBehaviors() bool {
+	return handler.checkEmptyGroups() && handler.checkReloadFailure() && handler.checkNonRecursive() &&
+		handler.checkCanary()
+}
+
+// 返回分流模式下必须可用的组名：默认为clean、dirty，RoutingRulesOnly模式下为DefaultGroup
+func (handler *Handler) requiredGroups() []string {
+	if handler.RoutingMode == RoutingRulesOnly {
+		return []string{handler.DefaultGroup}
+	}
+	return []string{"clean", "dirty"}
+}
+
+// Ready 判断Handler是否就绪：未处于排空模式及降级状态，配置有效，且clean、dirty组（RoutingRulesOnly模式下为默认组）均至少有一个上游可用
+func (handler *Handler) Ready() error {
+	if handler.Draining() {
+		return fmt.Errorf("draining")
+	}
+	if status := handler.ReloadStatus(); status.Degraded {
+		return fmt.Errorf("degraded: last reload failed: %s", status.Error)
+	}
+	handler.Mux.RLock()
+	valid := handler.IsValid()
+	var names []string
+	var required []*Group
+	if valid {
+		names = handler.requiredGroups()
+		for _, name := range names {
+			required = append(required, handler.Groups[name])
+		}
+	}
+	handler.Mux.RUnlock() // 探测上游耗时较长，不持有读锁
+	if !valid {
+		return fmt.Errorf("invalid config")
+	}
+	for i, name := range names {
+		if !required[i].Reachable() {
+			return fmt.Errorf("no reachable dns in group %s", name)
+		}
+	}
+	return nil
+}
+
+// SetDraining 进入或退出排空模式。排空模式下Ready返回错误（/readyz返回503），使负载均衡停止分配新流量，
+// 但仍正常处理所有请求。配置重载不影响排空状态
+func (handler *Handler) SetDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&handler.draining, value)
+}
+
+// Draining 判断是否处于排空模式
+func (handler *Handler) Draining() bool {
+	return atomic.LoadInt32(&handler.draining) == 1
+}
+
+// ListenAndServe 在Listen中的每个地址上启动UDP（及TCP）dns服务，设置DoTListen时同时启动DoT服务，任一服务退出时返回错误
+func (handler *Handler) ListenAndServe() error {
+	if len(handler.Listen) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	var servers []*dns.Server
+	for _, addr := range handler.Listen {
+		servers = append(servers, &dns.Server{Addr: addr, Net: "udp"})
+		if handler.ListenTCP {
+			servers = append(servers, &dns.Server{Addr: addr, Net: "tcp"})
+		}
+	}
+	if handler.DoTListen != "" && handler.TLSConfig != nil {
+		servers = append(servers, &dns.Server{Addr: handler.DoTListen, Net: "tcp-tls", TLSConfig: handler.TLSConfig})
+	}
+	errCh := make(chan error, len(servers))
+	handler.Mux.Lock()
+	for _, srv := range servers {
+		srv.Handler = &listenerHandler{handler: handler, listen: srv.Addr}
+		if srv.Net != "udp" {
+			srv.DecorateReader = handler.decorateReader // 校验长度前缀并限制读取耗时
+		}
+		if handler.TCPKeepalive > 0 {
+			srv.IdleTimeout = func() time.Duration { return handler.TCPKeepalive }
+		}
+		handler.servers = append(handler.servers, srv)
+		go func(srv *dns.Server) {
+			log.Warnf("listen on %s/%s", srv.Addr, srv.Net)
+			errCh <- fmt.Errorf("listen %s/%s error: %v", srv.Addr, srv.Net, srv.ListenAndServe())
+		}(srv)
+	}
+	handler.Mux.Unlock()
+	return <-errCh
+}
+
+// Shutdown 关闭ListenAndServe启动的所有dns服务，停止hosts文件的自动重载，并关闭geoip数据库
+func (handler *Handler) Shutdown() {
+	handler.Mux.Lock()
+	servers := handler.servers
+	handler.servers = nil
+	closeHostsReaders(handler.HostsReaders, nil)
+	handler.Mux.Unlock()
+	for _, srv := range servers {
+		if err := srv.Shutdown(); err != nil {
+			log.Errorf("shutdown %s/%s error: %v", srv.Addr, srv.Net, err)
+		}
+	}
+	// 服务关闭后再关闭geoip数据库，避免处理中的请求访问已关闭的数据库
+	handler.Mux.Lock()
+	if closer, ok := handler.Geo.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Errorf("close geoip error: %v", err)
+		}
+	}
+	handler.Geo = nil
+	handler.Mux.Unlock()
+}
+
+// 停止readers中不在keep里的hosts文件的自动重载，已加载的记录仍可读取
+func closeHostsReaders(readers, keep []hosts.Reader) {
+next:
+	for _, reader := range readers {
+		for _, r := range keep {
+			if r == reader {
+				continue next
+			}
+		}
+		if err := reader.Close(); err != nil {
+			log.Errorf("close hosts reader error: %v", err)
+		}
+	}
 }
@@ -1,6 +1,9 @@
 package inbound
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/agiledragon/gomonkey"
@@ -12,9 +15,15 @@ import (
 	"github.com/wolf-joe/ts-dns/matcher"
 	"github.com/wolf-joe/ts-dns/mock"
 	"github.com/wolf-joe/ts-dns/outbound"
+	"io/ioutil"
 	"net"
+	"net/http/httptest"
+	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type MockRespWriter struct {
@@ -110,8 +119,8 @@ func TestHandler(t *testing.T) {
 		{false, false}, {false, false}, {false, false},
 		{false, false}, {false, false}, {true, true},
 	})
-	// 规则匹配后mock CallDNS
-	mocker.MethodSeq(group, "CallDNS", []gomonkey.Params{
+	// 规则匹配后mock CallDNSContext
+	mocker.MethodSeq(group, "CallDNSContext", []gomonkey.Params{
 		{resp}, // 前半部分用
 		{resp}, {resp}, {resp}, {resp},
 	})
@@ -152,6 +161,9 @@ func TestGroup(t *testing.T) {
 	assert.Nil(t, group.CallDNS(nil))
 	mocker.MethodSeq(callers[0], "Call", []gomonkey.Params{
 		{nil, fmt.Errorf("err")}, {resp, nil},
+	})
+	// 并发时使用CallContext
+	mocker.MethodSeq(callers[0], "CallContext", []gomonkey.Params{
 		{nil, fmt.Errorf("err")}, {resp, nil},
 		{nil, fmt.Errorf("err")}, {resp, nil},
 	})
@@ -173,3 +185,1118 @@ func TestGroup(t *testing.T) {
 	group.AddIPSet(resp) // Add返回error
 	group.AddIPSet(resp) // Add正常返回
 }
+
+// 返回固定响应的Caller，可并发调用
+type staticCaller struct {
+	resp *dns.Msg
+}
+
+func (caller *staticCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	return withQuestion(request, caller.resp.Copy()), nil
+}
+
+// 同真实的上游，为未设置question section的响应补全请求的question
+func withQuestion(request, r *dns.Msg) *dns.Msg {
+	if r != nil && len(r.Question) == 0 {
+		r.Question = request.Question
+	}
+	return r
+}
+
+// 统计调用次数的Caller
+type countCaller struct {
+	count int
+	resp  *dns.Msg
+}
+
+func (caller *countCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	caller.count++
+	if caller.resp == nil {
+		return nil, fmt.Errorf("err")
+	}
+	return withQuestion(request, caller.resp.Copy()), nil
+}
+
+func TestHandler_ServFail(t *testing.T) {
+	dnsCache := cache.NewDNSCache(10, time.Minute, time.Hour)
+	dnsCache.FailTTL = time.Minute
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: dnsCache,
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		QueryLogger: log.New(),
+	}
+	caller := &countCaller{}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	writer, req := &MockRespWriter{}, &dns.Msg{}
+	req.SetQuestion("ip.cn.", dns.TypeA)
+
+	// 上游请求失败，返回SERVFAIL
+	handler.ServeDNS(writer, req)
+	assert.Equal(t, writer.r.Rcode, dns.RcodeServerFailure)
+	assert.Equal(t, caller.count, 1)
+	// 缓存期内再次请求直接返回缓存的SERVFAIL，不请求上游
+	writer.r = nil
+	handler.ServeDNS(writer, req)
+	assert.Equal(t, writer.r.Rcode, dns.RcodeServerFailure)
+	assert.Equal(t, caller.count, 1)
+}
+
+func TestHandler_SRVPassthrough(t *testing.T) {
+	resp := &dns.Msg{}
+	for _, s := range []string{"_sip._tcp.ip.cn. 300 IN SRV 10 60 5060 b.ip.cn.",
+		"_sip._tcp.ip.cn. 300 IN SRV 10 20 5060 a.ip.cn.", "_sip._tcp.ip.cn. 300 IN SRV 20 0 5061 c.ip.cn."} {
+		rr, _ := dns.NewRR(s)
+		resp.Answer = append(resp.Answer, rr)
+	}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+	}
+	caller := &countCaller{resp: resp.Copy()}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	writer, req := &MockRespWriter{}, new(dns.Msg).SetQuestion("_sip._tcp.ip.cn.", dns.TypeSRV)
+
+	for i := 0; i < 3; i++ { // 首次请求上游，之后命中缓存
+		handler.ServeDNS(writer, req)
+		assert.Len(t, writer.r.Answer, 3)
+		for j, rr := range writer.r.Answer {
+			expect := resp.Answer[j].(*dns.SRV)
+			srv := rr.(*dns.SRV)
+			assert.Equal(t, []interface{}{srv.Priority, srv.Weight, srv.Port, srv.Target},
+				[]interface{}{expect.Priority, expect.Weight, expect.Port, expect.Target})
+		}
+	}
+	assert.Equal(t, caller.count, 1)
+}
+
+func TestHandler_Forward(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+	}
+	rr, _ := dns.NewRR("a.corp.example. 60 IN A 10.0.0.1")
+	corp := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	rr, _ = dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	clean := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	handler.Forward = map[string]outbound.Caller{"corp.example": corp}
+	group := &Group{Callers: []outbound.Caller{clean}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+
+	suffix, caller := handler.MatchForward("a.b.corp.example.")
+	assert.Equal(t, suffix, "corp.example")
+	assert.Equal(t, caller, corp)
+	_, caller = handler.MatchForward("example.")
+	assert.Nil(t, caller)
+	// 不区分大小写（如0x20随机化的请求）
+	suffix, caller = handler.MatchForward("A.Corp.EXAMPLE.")
+	assert.Equal(t, suffix, "corp.example")
+	assert.Equal(t, caller, corp)
+	// 命中转发规则的域名请求对应上游
+	writer := &MockRespWriter{}
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("a.corp.example.", dns.TypeA))
+	assert.Equal(t, writer.r.Answer[0].(*dns.A).A.String(), "10.0.0.1")
+	assert.Equal(t, []int{corp.count, clean.count}, []int{1, 0})
+	// 其它域名按原流程处理
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+	assert.Equal(t, writer.r.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	assert.Equal(t, []int{corp.count, clean.count}, []int{1, 1})
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("B.cOrP.example.", dns.TypeA))
+	assert.Equal(t, []int{corp.count, clean.count}, []int{2, 1})
+	// 上游请求失败时返回SERVFAIL
+	corp.resp = nil
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("b.corp.example.", dns.TypeA))
+	assert.Equal(t, writer.r.Rcode, dns.RcodeServerFailure)
+}
+
+func TestHandler_HostsOverCache(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+	}
+	rr, _ := dns.NewRR("ip.cn. 600 IN A 1.1.1.1")
+	caller := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	writer, req := &MockRespWriter{}, new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	handler.ServeDNS(writer, req) // 上游响应写入缓存
+	assert.Equal(t, writer.r.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	assert.NotNil(t, handler.Cache.Get(req))
+	// 新增hosts记录后立即生效，不受已有缓存影响
+	handler.Refresh(&Handler{Cache: handler.Cache, GFWMatcher: handler.GFWMatcher, CNIP: handler.CNIP,
+		Groups: handler.Groups, HostsReaders: []hosts.Reader{hosts.NewReaderByText("2.2.2.2 ip.cn")}})
+	handler.ServeDNS(writer, req)
+	assert.Equal(t, writer.r.Answer[0].(*dns.A).A.String(), "2.2.2.2")
+	assert.Equal(t, caller.count, 1)
+}
+
+// 记录是否被关闭的hosts.Reader
+type closeReader struct {
+	hosts.Reader
+	closed bool
+}
+
+func (r *closeReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestHandler_CloseHostsReaders(t *testing.T) {
+	old, kept, added := &closeReader{}, &closeReader{}, &closeReader{}
+	handler := &Handler{Mux: new(sync.RWMutex), HostsReaders: []hosts.Reader{old, kept}}
+	// 重载时关闭不再使用的reader
+	handler.Refresh(&Handler{HostsReaders: []hosts.Reader{kept, added}})
+	assert.True(t, old.closed)
+	assert.False(t, kept.closed)
+	assert.False(t, added.closed)
+	handler.Refresh(handler)
+	assert.False(t, kept.closed)
+	// 关闭服务时关闭所有reader
+	handler.Shutdown()
+	assert.True(t, kept.closed)
+	assert.True(t, added.closed)
+}
+
+func TestGroup_SetMatcher(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(0, 0, 0),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+	}
+	handler.QueryLogger.SetOutput(ioutil.Discard)
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	resp := &dns.Msg{Answer: []dns.RR{rr}}
+	clean := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}}
+	work := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}}
+	handler.Groups = map[string]*Group{"clean": clean, "dirty": clean, "work": work}
+
+	_, ok := work.MatchRules("ip.cn.") // 未设置规则
+	assert.False(t, ok)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ { // 并发请求
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				handler.ServeDNS(&MockRespWriter{}, new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ { // 同时替换规则
+		if i%2 == 0 {
+			work.SetMatcher(matcher.NewABPByText("ip.cn"))
+		} else {
+			work.SetMatcher(matcher.NewABPByText(""))
+		}
+	}
+	wg.Wait()
+	work.SetMatcher(matcher.NewABPByText("ip.cn"))
+	matched, ok := work.MatchRules("ip.cn.")
+	assert.True(t, matched)
+	assert.True(t, ok)
+}
+
+func TestGroup_SelectCallers(t *testing.T) {
+	rr, _ := dns.NewRR("www.google.com. 60 IN A 1.1.1.1")
+	proxied := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	direct := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	group := &Group{Callers: []outbound.Caller{proxied}}
+	assert.Equal(t, group.SelectCallers("ip.cn."), group.Callers) // 未设置代理规则
+	group.DirectCallers = []outbound.Caller{direct}
+	group.ProxyMatcher = matcher.NewABPByText("google.com")
+
+	// 匹配代理规则的域名使用代理
+	assert.NotNil(t, group.CallDNS(new(dns.Msg).SetQuestion("www.google.com.", dns.TypeA)))
+	assert.Equal(t, []int{proxied.count, direct.count}, []int{1, 0})
+	// 其余域名直连
+	assert.NotNil(t, group.CallDNS(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)))
+	assert.Equal(t, []int{proxied.count, direct.count}, []int{1, 1})
+}
+
+func TestHandler_NoCache(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), GFWMatcher: matcher.NewABPByText(""),
+		CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+	}
+	rr, _ := dns.NewRR("ip.cn. 600 IN A 1.1.1.1")
+	caller := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	handler.Forward = map[string]outbound.Caller{"corp.example": caller}
+	// 禁用缓存时每次请求都转发至上游
+	for i, name := range []string{"ip.cn.", "ip.cn.", "a.corp.example.", "a.corp.example."} {
+		writer := &MockRespWriter{}
+		handler.ServeDNS(writer, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		assert.NotNil(t, writer.r)
+		assert.Equal(t, caller.count, i+1)
+	}
+	caller.resp = nil // 上游请求失败
+	handler.ServeDNS(&MockRespWriter{}, new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+	assert.Nil(t, handler.getCache(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)))
+}
+
+// 记录最后一次请求的Caller
+type recordCaller struct {
+	request *dns.Msg
+	resp    *dns.Msg
+}
+
+func (caller *recordCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	caller.request = request
+	return withQuestion(request, caller.resp.Copy()), nil
+}
+
+func TestHandler_CheckingDisabled(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+	}
+	rr, _ := dns.NewRR("ip.cn. 600 IN A 1.1.1.1")
+	caller := &recordCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+
+	// CD标志位原样转发至上游，并保留在响应中
+	writer, req := &MockRespWriter{}, new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	req.CheckingDisabled = true
+	handler.ServeDNS(writer, req)
+	assert.True(t, caller.request.CheckingDisabled)
+	assert.True(t, writer.r.CheckingDisabled)
+	assert.Len(t, writer.r.Answer, 1)
+	// 未设置CD的请求不命中CD请求的缓存
+	caller.request = nil
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+	assert.NotNil(t, caller.request)
+	assert.False(t, caller.request.CheckingDisabled)
+	assert.False(t, writer.r.CheckingDisabled)
+	// CD请求命中自身缓存
+	caller.request = nil
+	handler.ServeDNS(writer, req)
+	assert.Nil(t, caller.request)
+	assert.True(t, writer.r.CheckingDisabled)
+}
+
+func TestHandler_ChaosClass(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("1.1.1.1 version.bind")},
+		Fallback:     &Fallback{A: net.IPv4(2, 2, 2, 2)},
+	}
+	rr, _ := dns.NewRR(`version.bind. 0 CH TXT "9.16"`)
+	caller := &recordCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	group := &Group{Callers: []outbound.Caller{caller}}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+
+	// CH类请求原样转发至上游，并按请求类缓存
+	writer, req := &MockRespWriter{}, new(dns.Msg).SetQuestion("version.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	handler.ServeDNS(writer, req)
+	assert.Equal(t, uint16(dns.ClassCHAOS), caller.request.Question[0].Qclass)
+	assert.Equal(t, uint16(dns.ClassCHAOS), writer.r.Question[0].Qclass)
+	assert.Equal(t, uint16(dns.ClassCHAOS), writer.r.Answer[0].Header().Class)
+	caller.request = nil
+	handler.ServeDNS(writer, req)
+	assert.Nil(t, caller.request) // 命中缓存
+	assert.Equal(t, uint16(dns.ClassCHAOS), writer.r.Answer[0].Header().Class)
+	// IN类请求不命中CH类请求的缓存
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("version.bind.", dns.TypeTXT))
+	assert.NotNil(t, caller.request)
+	assert.Equal(t, uint16(dns.ClassINET), caller.request.Question[0].Qclass)
+
+	// CH类A请求不命中hosts，上游失败时也不返回IN类的fallback
+	chA := new(dns.Msg).SetQuestion("version.bind.", dns.TypeA)
+	chA.Question[0].Qclass = dns.ClassCHAOS
+	assert.Nil(t, handler.HitHosts(chA))
+	assert.Nil(t, handler.Fallback.Answer(chA))
+}
+
+// 获取一个空闲的本地udp地址
+func freeUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = conn.Close() }()
+	return conn.LocalAddr().String()
+}
+
+// 向指定地址发送dns请求，等待服务启动
+func queryUntilReady(addr string, req *dns.Msg) (r *dns.Msg, err error) {
+	return exchangeUntilReady(&dns.Client{}, addr, req)
+}
+
+// 使用指定client向目标地址发送dns请求，等待服务启动
+func exchangeUntilReady(client *dns.Client, addr string, req *dns.Msg) (r *dns.Msg, err error) {
+	client.Timeout = time.Millisecond * 100
+	for i := 0; i < 20; i++ {
+		if r, _, err = client.Exchange(req, addr); err == nil {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return
+}
+
+func TestHandler_ListenAndServe(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("1.1.1.1 ip.cn")},
+	}
+	assert.NotNil(t, handler.ListenAndServe()) // 无监听地址
+	handler.Listen = []string{freeUDPAddr(t), freeUDPAddr(t)}
+	errCh := make(chan error, 1)
+	go func() { errCh <- handler.ListenAndServe() }()
+	// 两个地址均可正常响应
+	for _, addr := range handler.Listen {
+		r, err := queryUntilReady(addr, new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+		assert.Nil(t, err)
+		assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	}
+	handler.Shutdown()
+	assert.NotNil(t, <-errCh)
+}
+
+// 从响应中读取EDNS0 TCP Keepalive的超时值（单位为100毫秒），未找到时返回-1
+func keepaliveTimeout(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == dns.EDNS0TCPKEEPALIVE {
+				return int(local.Data[0])<<8 | int(local.Data[1])
+			}
+		}
+	}
+	return -1
+}
+
+func TestHandler_ListenTCP(t *testing.T) {
+	// 借用httptest的自签名证书启动DoT服务
+	tlsSrv := httptest.NewUnstartedServer(nil)
+	tlsSrv.StartTLS()
+	certPool := x509.NewCertPool()
+	certPool.AddCert(tlsSrv.Certificate())
+	certs := tlsSrv.TLS.Certificates
+	tlsSrv.Close()
+
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("1.1.1.1 ip.cn")},
+		Listen:       []string{freeUDPAddr(t)}, ListenTCP: true, TCPKeepalive: 30 * time.Second,
+		DoTListen: freeUDPAddr(t), TLSConfig: &tls.Config{Certificates: certs},
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- handler.ListenAndServe() }()
+	defer func() {
+		handler.Shutdown()
+		assert.NotNil(t, <-errCh)
+	}()
+
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	// 未携带keepalive选项时不设置
+	r, err := exchangeUntilReady(&dns.Client{Net: "tcp"}, handler.Listen[0], req)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, -1, keepaliveTimeout(r))
+	// 携带keepalive选项时返回配置的超时
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{}})
+	r, err = exchangeUntilReady(&dns.Client{Net: "tcp"}, handler.Listen[0], req)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, keepaliveTimeout(r))
+	// DoT
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: certPool, ServerName: "example.com"}}
+	r, err = exchangeUntilReady(client, handler.DoTListen, req)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 300, keepaliveTimeout(r))
+	// UDP不设置keepalive
+	r, err = queryUntilReady(handler.Listen[0], req)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, keepaliveTimeout(r))
+}
+
+func TestHandler_Query(t *testing.T) {
+	resp := &dns.Msg{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ip.cn.", Rrtype: dns.TypeA,
+		Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}}
+	caller := &countCaller{resp: resp}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+	}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	r, result := handler.Query(req)
+	assert.Equal(t, req.Id, r.Id)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "clean", result.Group)
+	assert.Equal(t, "not match gfwlist", result.Reason)
+	assert.Equal(t, 1, caller.count)
+	// 第二次查询命中缓存
+	r, result = handler.Query(req)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "", result.Group)
+	assert.Equal(t, "hit cache", result.Reason)
+	assert.Equal(t, 1, caller.count)
+}
+
+func TestHandler_DenyPrivate(t *testing.T) {
+	resp := &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(192, 168, 1, 1)}, &dns.A{A: net.IPv4(1, 1, 1, 1)}}}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+	}
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	r, _ := handler.Query(req)
+	assert.Len(t, r.Answer, 2)
+
+	group.DenyPrivate = true
+	r, _ = handler.Query(req)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+}
+
+func TestHandler_Flags(t *testing.T) {
+	caller := &recordCaller{resp: &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}}}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+	}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	req.RecursionDesired = false
+	// 默认沿用客户端的RD及上游的RA
+	r, _ := handler.Query(req)
+	assert.False(t, caller.request.RecursionDesired)
+	assert.False(t, r.RecursionDesired)
+	assert.False(t, r.RecursionAvailable)
+
+	group.ForceRD, handler.ForceRA = true, true
+	r, _ = handler.Query(req)
+	assert.True(t, caller.request.RecursionDesired)
+	assert.False(t, req.RecursionDesired) // 不修改客户端请求
+	assert.False(t, r.RecursionDesired)
+	assert.True(t, r.RecursionAvailable)
+}
+
+func TestHandler_MinimalAny(t *testing.T) {
+	caller := &recordCaller{resp: &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}}}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")}, MinimalAny: true,
+	}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeANY)
+	// 返回最小响应且不转发
+	r, result := handler.Query(req)
+	assert.Nil(t, caller.request)
+	assert.Equal(t, "minimal any", result.Reason)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, req.Id, r.Id)
+	assert.Len(t, r.Answer, 1)
+	hinfo := r.Answer[0].(*dns.HINFO)
+	assert.Equal(t, "RFC8482", hinfo.Cpu)
+	assert.Equal(t, "example.com.", hinfo.Hdr.Name)
+	// 其它类型的请求不受影响
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.NotNil(t, caller.request)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// 关闭后ANY请求转发至上游
+	caller.request, handler.MinimalAny = nil, false
+	handler.Query(req)
+	assert.Equal(t, dns.TypeANY, caller.request.Question[0].Qtype)
+}
+
+func TestHandler_TTLOverrides(t *testing.T) {
+	resp := &dns.Msg{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 600}, A: net.IPv4(1, 1, 1, 1)}}}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+		Cache:        cache.NewDNSCache(10, 0, time.Hour),
+		TTLOverrides: map[string]uint32{"cdn.example.com": 30},
+	}
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+
+	ttl, ok := handler.MatchTTLOverride("a.cdn.example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(30), ttl)
+	_, ok = handler.MatchTTLOverride("example.com.")
+	assert.False(t, ok)
+	ttl, ok = handler.MatchTTLOverride("A.CDN.Example.com.") // 不区分大小写
+	assert.True(t, ok)
+	assert.Equal(t, uint32(30), ttl)
+	// 命中的域名（及子域名）使用指定TTL，优先于缓存TTL
+	for _, name := range []string{"cdn.example.com.", "img.cdn.example.com.", "img.cdn.example.com.", "IMG.Cdn.example.com."} {
+		r, _ := handler.Query(new(dns.Msg).SetQuestion(name, dns.TypeA))
+		assert.Equal(t, uint32(30), r.Answer[0].Header().Ttl, name)
+	}
+	// 其它域名不受影响
+	r, _ := handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Equal(t, uint32(600), r.Answer[0].Header().Ttl)
+	r, result := handler.Query(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Equal(t, "hit cache", result.Reason)
+	assert.True(t, r.Answer[0].Header().Ttl > 30)
+}
+
+func TestHandler_ClientMaxTTL(t *testing.T) {
+	resp := &dns.Msg{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 3600}, A: net.IPv4(1, 1, 1, 1)},
+		&dns.A{Hdr: dns.RR_Header{Ttl: 60}, A: net.IPv4(1, 1, 1, 2)}}}
+	dnsCache := cache.NewDNSCache(10, 0, time.Hour*24)
+	dnsCache.KeepTTL = true
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		Cache: dnsCache, ClientMaxTTL: 300, TTLOverrides: map[string]uint32{"cdn.example.com": 900},
+	}
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	ttls := func(r *dns.Msg) (ttls []uint32) {
+		for _, rr := range r.Answer {
+			ttls = append(ttls, rr.Header().Ttl)
+		}
+		return
+	}
+
+	// 返回给客户端的ttl不超过ClientMaxTTL，缓存中保留上游ttl
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	r, _ := handler.Query(req)
+	assert.ElementsMatch(t, []uint32{300, 60}, ttls(r))
+	r, result := handler.Query(req)
+	assert.Equal(t, "hit cache", result.Reason)
+	assert.ElementsMatch(t, []uint32{300, 60}, ttls(r))
+	assert.ElementsMatch(t, []uint32{3600, 60}, ttls(dnsCache.Get(req)))
+	// ttl_overrides优先于ClientMaxTTL
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("cdn.example.com.", dns.TypeA))
+	assert.Equal(t, []uint32{900, 900}, ttls(r))
+}
+
+func TestHandler_TruncateUDP(t *testing.T) {
+	resp := new(dns.Msg)
+	for i := 0; i < 100; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("big.example.com. 600 IN A 10.0.%d.%d", i/256, i%256))
+		resp.Answer = append(resp.Answer, rr)
+	}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+	}
+	handler.QueryLogger.SetOutput(ioutil.Discard)
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+
+	// 未携带EDNS0时按512字节截断，上游响应及缓存命中均适用
+	for i := 0; i < 2; i++ {
+		writer, req := &MockRespWriter{}, new(dns.Msg).SetQuestion("big.example.com.", dns.TypeA)
+		handler.ServeDNS(writer, req)
+		assert.True(t, writer.r.Truncated)
+		assert.True(t, len(writer.r.Answer) > 0 && len(writer.r.Answer) < 100)
+		buf, err := writer.r.Pack()
+		assert.Nil(t, err)
+		assert.True(t, len(buf) <= dns.MinMsgSize)
+		assert.Nil(t, new(dns.Msg).Unpack(buf))
+		assert.Equal(t, req.Id, writer.r.Id)
+	}
+	assert.Len(t, handler.Cache.Get(new(dns.Msg).SetQuestion("big.example.com.", dns.TypeA)).Answer, 100)
+	// 按客户端通告的缓冲区大小截断
+	writer, req := &MockRespWriter{}, new(dns.Msg).SetQuestion("big.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	handler.ServeDNS(writer, req)
+	assert.True(t, writer.r.Truncated)
+	buf, _ := writer.r.Pack()
+	assert.True(t, len(buf) > dns.MinMsgSize && len(buf) <= 1232)
+	// 缓冲区足够时不截断
+	req = new(dns.Msg).SetQuestion("big.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	handler.ServeDNS(writer, req)
+	assert.False(t, writer.r.Truncated)
+	assert.Len(t, writer.r.Answer, 100)
+}
+
+// 基于map的缓存，不处理ttl
+type mapCache struct {
+	mux   sync.Mutex
+	items map[string]*dns.Msg
+}
+
+func (c *mapCache) key(request *dns.Msg) string {
+	return request.Question[0].String()
+}
+
+func (c *mapCache) Get(request *dns.Msg) *dns.Msg {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if r, ok := c.items[c.key(request)]; ok {
+		return r.Copy()
+	}
+	return nil
+}
+
+func (c *mapCache) Set(request *dns.Msg, r *dns.Msg) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.items[c.key(request)] = r.Copy()
+}
+
+func (c *mapCache) Delete(request *dns.Msg) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.items, c.key(request))
+}
+
+func (c *mapCache) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.items)
+}
+
+func TestHandler_CustomCache(t *testing.T) {
+	c := &mapCache{items: map[string]*dns.Msg{}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: c,
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+	}
+	rr, _ := dns.NewRR("ip.cn. 600 IN A 1.1.1.1")
+	caller := &countCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	group := &Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	_, result := handler.Query(req)
+	assert.Equal(t, "not match gfwlist", result.Reason)
+	assert.Equal(t, 1, c.Len())
+	r, result := handler.Query(req)
+	assert.Equal(t, "hit cache", result.Reason)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 1, caller.count)
+	c.Delete(req)
+	_, result = handler.Query(req)
+	assert.NotEqual(t, "hit cache", result.Reason)
+	assert.Equal(t, 2, caller.count)
+	// 不支持列出条目的缓存在管理接口中返回空列表
+	w := httptest.NewRecorder()
+	handler.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/cache/entries", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"entries":[]`)
+}
+
+// 打包响应的ResponseWriter，同真实的dns服务
+type packRespWriter struct {
+	MockRespWriter
+}
+
+func (w *packRespWriter) WriteMsg(resp *dns.Msg) error {
+	_, err := resp.Pack()
+	return err
+}
+
+func TestHandler_ConcurrentCacheHit(t *testing.T) {
+	// 响应携带OPT、SOA记录，Pack时会改写OPT记录，并发命中缓存时不能共享（需使用-race运行）
+	resp := new(dns.Msg)
+	rr, _ := dns.NewRR("ip.cn. 600 IN A 1.1.1.1")
+	soa, _ := dns.NewRR("cn. 600 IN SOA ns.cn. admin.cn. 1 2 3 4 5")
+	resp.Answer, resp.Ns = []dns.RR{rr}, []dns.RR{soa}
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+	caller := &countCaller{resp: resp}
+	group := &Group{Callers: []outbound.Caller{caller}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups: map[string]*Group{"clean": group, "dirty": group}}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	handler.ServeDNS(&packRespWriter{}, req)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				handler.ServeDNS(&packRespWriter{}, req.Copy())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, caller.count)
+}
+
+func TestHandler_CNIP6(t *testing.T) {
+	newResp := func(ip string) *dns.Msg {
+		return &dns.Msg{Answer: []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "google.com.", Rrtype: dns.TypeAAAA,
+			Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP(ip)}}}
+	}
+	clean := &Group{Callers: []outbound.Caller{&staticCaller{resp: newResp("2001:db8::1")}}}
+	dirty := &Group{Callers: []outbound.Caller{&staticCaller{resp: newResp("2001:db8::2")}}}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText("||google.com"), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")},
+		Groups:       map[string]*Group{"clean": clean, "dirty": dirty},
+	}
+	req := new(dns.Msg).SetQuestion("google.com.", dns.TypeAAAA)
+	// 未配置cnip6时不检查AAAA记录
+	_, result := handler.Query(req)
+	assert.Equal(t, "clean", result.Group)
+	// ipv6地址不在cnip6中，且匹配gfwlist
+	handler.CNIP6 = cache.NewRamSetByText("240e::/20")
+	r, result := handler.Query(req)
+	assert.Equal(t, "dirty", result.Group)
+	assert.Equal(t, "2001:db8::2", r.Answer[0].(*dns.AAAA).AAAA.String())
+	// ipv6地址在cnip6中
+	handler.CNIP6 = cache.NewRamSetByText("2001:db8::/32")
+	_, result = handler.Query(req)
+	assert.Equal(t, "clean", result.Group)
+}
+
+func TestHandler_MatchRule(t *testing.T) {
+	resp := &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText("||google.com"), CNIP: cache.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("")}, QueryLogger: log.New(),
+	}
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}}
+	work := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}, Matcher: matcher.NewABPByText("*.corp.com")}
+	handler.Groups = map[string]*Group{"clean": group, "dirty": group, "work": work}
+
+	_, result := handler.Query(new(dns.Msg).SetQuestion("git.corp.com.", dns.TypeA))
+	assert.Equal(t, "work", result.Group)
+	assert.Equal(t, "*.corp.com", result.Rule)
+	_, result = handler.Query(new(dns.Msg).SetQuestion("www.google.com.", dns.TypeA))
+	assert.Equal(t, "match gfwlist", result.Reason)
+	assert.Equal(t, "||google.com", result.Rule)
+	_, result = handler.Query(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+	assert.Equal(t, "", result.Rule)
+	handler.LogQuery("127.0.0.1", dns.Question{Name: "www.google.com."}, result)
+}
+
+func TestHandler_RoutingMode(t *testing.T) {
+	cnResp := &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}}
+	resp := &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(8, 8, 8, 8)}}}
+	handler := &Handler{Mux: new(sync.RWMutex),
+		GFWMatcher: matcher.NewABPByText("||google.com"), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		QueryLogger: log.New(),
+	}
+	clean := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}}
+	dirty := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}}
+	work := &Group{Callers: []outbound.Caller{&staticCaller{resp: cnResp}}, Matcher: matcher.NewABPByText("*.corp.com")}
+	proxy := &Group{Callers: []outbound.Caller{&staticCaller{resp: resp}}}
+	handler.Groups = map[string]*Group{"clean": clean, "dirty": dirty, "work": work, "proxy": proxy}
+
+	// gfwlist模式：未匹配组规则的域名按gfwlist在clean、dirty间分流
+	for _, mode := range []string{"", RoutingGFWList} {
+		handler.RoutingMode = mode
+		assert.True(t, handler.IsValid())
+		_, result := handler.Query(new(dns.Msg).SetQuestion("git.corp.com.", dns.TypeA))
+		assert.Equal(t, "work", result.Group)
+		_, result = handler.Query(new(dns.Msg).SetQuestion("www.google.com.", dns.TypeA))
+		assert.Equal(t, "dirty", result.Group)
+		_, result = handler.Query(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+		assert.Equal(t, "clean", result.Group)
+	}
+
+	// rules-only模式：不再判断gfwlist，未匹配组规则的域名使用默认组
+	handler.RoutingMode = RoutingRulesOnly
+	assert.False(t, handler.IsValid()) // 未指定默认组
+	handler.DefaultGroup = "proxy"
+	delete(handler.Groups, "clean")
+	delete(handler.Groups, "dirty")
+	assert.True(t, handler.IsValid()) // 无需clean、dirty组
+	assert.Equal(t, []string{"proxy"}, handler.requiredGroups())
+	_, result := handler.Query(new(dns.Msg).SetQuestion("git.corp.com.", dns.TypeA))
+	assert.Equal(t, "work", result.Group)
+	_, result = handler.Query(new(dns.Msg).SetQuestion("www.google.com.", dns.TypeA))
+	assert.Equal(t, "proxy", result.Group)
+	assert.Equal(t, "default group", result.Reason)
+	_, result = handler.Query(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA))
+	assert.Equal(t, "proxy", result.Group)
+
+	handler.RoutingMode = "unknown"
+	assert.False(t, handler.IsValid())
+}
+
+func TestGroup_NoCallers(t *testing.T) {
+	failed := &countCaller{}
+	breakers := []outbound.Caller{outbound.NewBreakerCaller(failed, 1, time.Minute),
+		outbound.NewBreakerCaller(failed, 1, time.Minute)}
+	group := &Group{Callers: breakers}
+	handler := &Handler{Mux: new(sync.RWMutex), GFWMatcher: matcher.NewABPByText(""),
+		CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups: map[string]*Group{"clean": group, "dirty": group}}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	// 首次请求失败后两个上游均熔断
+	r, _ := handler.Query(req)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	assert.Equal(t, 2, failed.count)
+	assert.Equal(t, uint64(0), group.NoCallers())
+	// 上游均熔断时不再请求上游，计数并返回SERVFAIL
+	r, _ = handler.Query(req)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	assert.Equal(t, 2, failed.count)
+	assert.Equal(t, uint64(1), group.NoCallers())
+	// 部分上游熔断时只请求可用的上游
+	ok := &countCaller{resp: &dns.Msg{}}
+	group.Callers = append(breakers, ok)
+	r, _ = handler.Query(req)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, 2, failed.count)
+	assert.Equal(t, 1, ok.count)
+	assert.Equal(t, uint64(1), group.NoCallers())
+}
+
+// 阻塞直至ctx被取消的Caller，记录被取消的次数
+type cancelCaller struct {
+	started  chan struct{}
+	canceled int32
+}
+
+func (caller *cancelCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	return caller.CallContext(context.Background(), request)
+}
+
+func (caller *cancelCaller) CallContext(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error) {
+	caller.started <- struct{}{}
+	<-ctx.Done()
+	atomic.AddInt32(&caller.canceled, 1)
+	return nil, ctx.Err()
+}
+
+func TestGroup_CancelLosers(t *testing.T) {
+	before := runtime.NumGoroutine()
+	slow := &cancelCaller{started: make(chan struct{}, 2)}
+	resp := &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}}
+	winner := &delayCaller{delay: 10 * time.Millisecond, resp: resp}
+	group := &Group{Callers: []outbound.Caller{slow, winner, slow}, Concurrent: true}
+
+	assert.Equal(t, resp.Answer, group.CallDNS(&dns.Msg{}).Answer)
+	<-slow.started
+	<-slow.started
+	// 胜出者返回后落选的请求应被立即取消，且不残留goroutine
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && (atomic.LoadInt32(&slow.canceled) < 2 || runtime.NumGoroutine() > before) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&slow.canceled))
+	assert.True(t, runtime.NumGoroutine() <= before)
+}
+
+// 延迟一段时间后返回固定响应的Caller
+type delayCaller struct {
+	delay time.Duration
+	resp  *dns.Msg
+}
+
+func (caller *delayCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	time.Sleep(caller.delay)
+	return withQuestion(request, caller.resp.Copy()), nil
+}
+
+// 比较响应码及应答记录，上游的响应会补全question section
+func assertReply(t *testing.T, expected, r *dns.Msg) {
+	assert.NotNil(t, r)
+	if r != nil {
+		assert.Equal(t, expected.Rcode, r.Rcode)
+		assert.Equal(t, len(expected.Answer), len(r.Answer))
+		for i := 0; i < len(expected.Answer) && i < len(r.Answer); i++ {
+			assert.Equal(t, expected.Answer[i].String(), r.Answer[i].String())
+		}
+	}
+}
+
+func TestGroup_Failover(t *testing.T) {
+	valid := &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}}
+	servFail := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	refused := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeRefused}}
+	nxDomain := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}
+	first, second := &countCaller{resp: servFail}, &countCaller{resp: valid}
+	group := &Group{Callers: []outbound.Caller{first, second}}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	// 首个上游返回SERVFAIL时使用下一个上游的有效响应
+	assertReply(t, valid, group.CallDNS(req))
+	assert.Equal(t, 1, first.count)
+	assert.Equal(t, 1, second.count)
+	// 默认直接使用无应答记录的NOERROR响应（NODATA），启用RetryNoData后同样视为失败
+	first.resp = &dns.Msg{}
+	assertReply(t, first.resp, group.CallDNS(req))
+	assert.Equal(t, 1, second.count)
+	group.RetryNoData = true
+	assertReply(t, valid, group.CallDNS(req))
+	assert.Equal(t, 2, second.count)
+	// 并发模式下同样跳过失败的响应
+	group.Concurrent = true
+	first.resp = servFail
+	assertReply(t, valid, group.CallDNS(req))
+	group.Concurrent = false
+	// 默认不对REFUSED、NXDOMAIN重试
+	first.resp = refused
+	assertReply(t, refused, group.CallDNS(req))
+	first.resp = nxDomain
+	assertReply(t, nxDomain, group.CallDNS(req))
+	// 自定义视为失败的响应码
+	group.FailoverCodes = []int{dns.RcodeRefused}
+	first.resp = refused
+	assertReply(t, valid, group.CallDNS(req))
+	first.resp = servFail
+	assertReply(t, servFail, group.CallDNS(req))
+	// 所有上游均失败时返回首个失败的响应
+	group.FailoverCodes = nil
+	second.resp = &dns.Msg{} // RetryNoData下视为失败
+	assertReply(t, servFail, group.CallDNS(req))
+	second.resp = nil
+	assertReply(t, servFail, group.CallDNS(req))
+}
+
+func TestGroup_MinAnswers(t *testing.T) {
+	single := &dns.Msg{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: net.IPv4(9, 9, 9, 9)}}}
+	multi := &dns.Msg{Answer: []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Rrtype: dns.TypeCNAME}, Target: "cdn.ip.cn."},
+		&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: net.IPv4(1, 1, 1, 1)},
+		&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: net.IPv4(1, 1, 1, 2)},
+	}}
+	first, second := &countCaller{resp: single}, &countCaller{resp: multi}
+	group := &Group{Callers: []outbound.Caller{first, second}, MinAnswers: 2}
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	// 仅含单个A记录的响应疑似被污染，使用下一个上游的响应
+	assertReply(t, multi, group.CallDNS(req))
+	assert.Equal(t, 1, first.count)
+	assert.Equal(t, 1, second.count)
+	// 记录数满足要求时直接使用（CNAME记录不计入）
+	first.resp = multi
+	assertReply(t, multi, group.CallDNS(req))
+	assert.Equal(t, 1, second.count)
+	group.MinAnswers = 3
+	assertReply(t, multi, group.CallDNS(req)) // 均不满足时返回首个失败的响应
+	assert.Equal(t, 2, second.count)
+	// 仅对A/AAAA请求生效
+	group.MinAnswers, first.resp = 2, single
+	assertReply(t, single, group.CallDNS(new(dns.Msg).SetQuestion("ip.cn.", dns.TypeMX)))
+	// 未设置时不限制
+	group.MinAnswers = 0
+	assertReply(t, single, group.CallDNS(req))
+}
+
+func TestHandler_NormalizeNames(t *testing.T) {
+	resp := chainResponse("ExAmple.COM. 60 IN CNAME CDN.Example.NET.", "CDN.Example.NET. 60 IN A 1.1.1.1")
+	caller := &recordCaller{resp: resp}
+	group := &Group{Callers: []outbound.Caller{caller}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups: map[string]*Group{"clean": group, "dirty": group}}
+	names := func(r *dns.Msg) (names []string) {
+		for _, rr := range r.Answer {
+			names = append(names, rr.Header().Name)
+		}
+		return names
+	}
+
+	// 未启用时原样返回上游的大小写
+	r, _ := handler.Query(new(dns.Msg).SetQuestion("eXample.com.", dns.TypeA))
+	assert.Equal(t, []string{"ExAmple.COM.", "CDN.Example.NET."}, names(r))
+	// 启用后与请求域名一致，其余名称转为小写，命中缓存时同样生效
+	handler.NormalizeNames = true
+	for _, qname := range []string{"eXample.com.", "eXample.com.", "EXAMPLE.com."} {
+		r, _ = handler.Query(new(dns.Msg).SetQuestion(qname, dns.TypeA))
+		assert.Equal(t, []string{qname, "cdn.example.net."}, names(r))
+		assert.Equal(t, qname, r.Question[0].Name)
+	}
+	// 不修改缓存中的记录
+	cached := handler.Cache.Get(new(dns.Msg).SetQuestion("eXample.com.", dns.TypeA))
+	assert.Equal(t, []string{"ExAmple.COM.", "CDN.Example.NET."}, names(cached))
+}
+
+func TestHandler_HostsTTL(t *testing.T) {
+	handler := &Handler{Mux: new(sync.RWMutex), HostsReaders: []hosts.Reader{
+		hosts.NewReaderByText("1.1.1.1 example.com\n::1 example.com")}}
+	queries := []*dns.Msg{
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA),
+		new(dns.Msg).SetQuestion("1.1.1.1.in-addr.arpa.", dns.TypePTR),
+	}
+	// 默认TTL为0
+	for _, req := range queries {
+		r, result := handler.Query(req)
+		assert.Equal(t, "hit hosts", result.Reason)
+		assert.Equal(t, uint32(0), r.Answer[0].Header().Ttl)
+	}
+	// 使用配置的TTL，刷新配置时一并更新
+	handler.Refresh(&Handler{HostsTTL: 300})
+	for _, req := range queries {
+		r, _ := handler.Query(req)
+		assert.Equal(t, uint32(300), r.Answer[0].Header().Ttl)
+	}
+}
+
+func TestHandler_GroupTTL(t *testing.T) {
+	rr, _ := dns.NewRR("example.com. 7200 IN A 1.1.1.1")
+	caller := &staticCaller{resp: &dns.Msg{Answer: []dns.RR{rr}}}
+	c := cache.NewDNSCache(10, time.Minute, time.Hour)
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: c, QueryLogger: log.New(),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"),
+		Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{caller}},
+			"dirty": {Callers: []outbound.Caller{caller}},
+			"short": {Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("||short.com"),
+				MaxTTL: 2 * time.Minute},
+			"long": {Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("||long.com"),
+				MinTTL: 3 * time.Hour, MaxTTL: 4 * time.Hour},
+		}}
+	ttl := func(name string) uint32 {
+		req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		handler.Query(req)
+		return c.Get(req).Answer[0].Header().Ttl
+	}
+	// 各组响应按各自的范围缓存，未设置时使用全局范围
+	assert.Equal(t, uint32(3600), ttl("example.com."))
+	assert.Equal(t, uint32(120), ttl("short.com."))
+	assert.Equal(t, uint32(10800), ttl("long.com."))
+}
+
+type levelHook struct{}
+
+func (levelHook) Levels() []log.Level { return log.AllLevels }
+
+func (levelHook) Fire(*log.Entry) error { return nil }
+
+func TestHandler_LogEnabled(t *testing.T) {
+	logger := log.New()
+	handler := &Handler{QueryLogger: logger}
+	assert.True(t, handler.logEnabled())
+	logger.SetOutput(ioutil.Discard)
+	assert.False(t, handler.logEnabled())
+	logger.AddHook(&levelHook{}) // hook仍需收到日志
+	assert.True(t, handler.logEnabled())
+	logger.SetOutput(os.Stderr)
+	logger.SetLevel(log.WarnLevel)
+	assert.False(t, handler.logEnabled())
+}
+
+// 命中缓存的请求处理，优化前后的结果（go test -bench CacheHit -benchtime 2s，Intel Xeon）：
+//
+//	优化前 serial:   14662 ns/op  1816 B/op  43 allocs/op（约6.8万QPS）
+//	优化后 serial:     852 ns/op   408 B/op   8 allocs/op（约117万QPS）
+//	优化前 parallel: 14778 ns/op  1816 B/op  43 allocs/op
+//	优化后 parallel:   944 ns/op   408 B/op   8 allocs/op
+//
+// 优化前的主要开销依次为：每次打乱记录时重新设置随机数种子、深度复制整个缓存响应、格式化不会输出的请求日志、
+// 对非反向解析域名拆分标签、未命中hosts时仍分配响应
+func BenchmarkHandler_CacheHit(b *testing.B) {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard) // 同query_log.file为/dev/null
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: answerA("1.1.1.1")}}}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText("1.1.1.0/24"), QueryLogger: logger,
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("1.1.1.1 dns1")},
+		Groups:       map[string]*Group{"clean": group, "dirty": group}}
+	request := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	handler.ServeDNS(&MockRespWriter{}, request)
+	b.Run("serial", func(b *testing.B) {
+		writer := &MockRespWriter{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			handler.ServeDNS(writer, request)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			writer, request := &MockRespWriter{}, request.Copy()
+			for pb.Next() {
+				handler.ServeDNS(writer, request)
+			}
+		})
+	})
+}
@@ -0,0 +1,81 @@
+package inbound
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 记录单个请求期间各上游的调用耗时，供慢请求日志使用
+type callLog struct {
+	mux   sync.Mutex
+	calls []string
+}
+
+type callLogKey struct{}
+
+// 返回携带callLog的ctx，SlowQuery为0时不记录
+func (handler *Handler) withCallLog(ctx context.Context) (context.Context, *callLog) {
+	if handler.SlowQuery <= 0 {
+		return ctx, nil
+	}
+	calls := new(callLog)
+	return context.WithValue(ctx, callLogKey{}, calls), calls
+}
+
+// 若ctx携带callLog，则记录caller的调用耗时及错误
+func recordCall(ctx context.Context, caller outbound.Caller, elapsed time.Duration, err error) {
+	calls, _ := ctx.Value(callLogKey{}).(*callLog)
+	if calls == nil {
+		return
+	}
+	call := fmt.Sprintf("%s(%v)", callerName(caller), elapsed.Round(time.Microsecond))
+	if err != nil {
+		call += ": " + err.Error()
+	}
+	calls.mux.Lock()
+	calls.calls = append(calls.calls, call)
+	calls.mux.Unlock()
+}
+
+// 返回上游的描述，优先使用上游地址，未实现fmt.Stringer时使用类型名
+func callerName(caller outbound.Caller) string {
+	if s, ok := caller.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", caller)
+}
+
+// 返回已记录的上游调用，以逗号分隔
+func (calls *callLog) String() string {
+	if calls == nil {
+		return ""
+	}
+	calls.mux.Lock()
+	defer calls.mux.Unlock()
+	return strings.Join(calls.calls, ", ")
+}
+
+// 请求耗时超出SlowQuery时以warn级别将处理详情记录至程序日志，不受请求日志（QueryLogger）配置的影响
+func (handler *Handler) logSlowQuery(src string, question dns.Question, result *QueryResult, elapsed time.Duration) {
+	if handler.SlowQuery <= 0 || elapsed < handler.SlowQuery || result == nil {
+		return
+	}
+	fields := log.Fields{"domain": question.Name, "type": dns.Type(question.Qtype).String(), "src": src,
+		"reason": result.Reason, "elapsed": elapsed.Round(time.Microsecond).String()}
+	if result.Group != "" {
+		fields["group"] = result.Group
+	}
+	if result.Rule != "" {
+		fields["rule"] = result.Rule
+	}
+	if result.Callers != "" {
+		fields["callers"] = result.Callers
+	}
+	log.WithFields(fields).Warnln("slow query")
+}
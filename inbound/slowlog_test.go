@@ -0,0 +1,63 @@
+package inbound
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandler_SlowQuery(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	slow := &delayCaller{delay: 80 * time.Millisecond, resp: answerA("1.1.1.1")}
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(), SlowQuery: 50 * time.Millisecond,
+		GFWMatcher: matcher.NewABPByText(""), Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{slow}, Matcher: matcher.NewABPByText("||example.com")},
+		}}
+	handler.QueryLogger.SetOutput(ioutil.Discard) // 慢请求日志不受请求日志配置的影响
+
+	// 超出阈值时记录组、规则、上游及耗时
+	handler.ServeDNS(&MockRespWriter{}, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	output := buf.String()
+	assert.Contains(t, output, "slow query")
+	assert.Contains(t, output, "domain=example.com.")
+	assert.Contains(t, output, "group=clean")
+	assert.Contains(t, output, "rule=\"||example.com\"")
+	assert.Contains(t, output, "callers=\"*inbound.delayCaller(")
+	assert.Contains(t, output, "elapsed=")
+
+	// 未超出阈值或未启用时不记录
+	buf.Reset()
+	slow.delay = 0
+	handler.ServeDNS(&MockRespWriter{}, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Empty(t, buf.String())
+	slow.delay, handler.SlowQuery = 80*time.Millisecond, 0
+	handler.ServeDNS(&MockRespWriter{}, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Empty(t, buf.String())
+}
+
+func TestRecordCall(t *testing.T) {
+	handler := &Handler{SlowQuery: time.Second}
+	ctx, calls := handler.withCallLog(context.Background())
+	recordCall(ctx, outbound.NewDNSCaller("1.1.1.1:53", "udp", nil), time.Millisecond, nil)
+	recordCall(ctx, &delayCaller{}, 2*time.Millisecond, errors.New("timeout"))
+	assert.Equal(t, "udp://1.1.1.1:53(1ms), *inbound.delayCaller(2ms): timeout", calls.String())
+	// 未启用时不记录
+	handler.SlowQuery = 0
+	ctx, calls = handler.withCallLog(context.Background())
+	assert.Nil(t, calls)
+	recordCall(ctx, &delayCaller{}, time.Millisecond, nil)
+	assert.Equal(t, "", calls.String())
+}
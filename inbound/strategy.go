@@ -0,0 +1,73 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// 并发模式下的响应选择方式
+const (
+	StrategyFirst  = ""          // 使用最先返回的有效响应
+	StrategyMerge  = "all-merge" // 等待所有上游返回，合并各有效响应的应答记录并去重
+	StrategyQuorum = "quorum"    // 有Quorum个上游返回相同的应答记录时才使用该响应，用于防范污染
+)
+
+// 生成记录去除TTL后的字符串，用于比较记录是否相同
+func rrKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	return rr.String()
+}
+
+// 生成应答记录集合的摘要，记录相同（忽略顺序及TTL）的响应摘要相同
+func answerKey(r *dns.Msg) string {
+	keys := make([]string, 0, len(r.Answer))
+	for _, rr := range r.Answer {
+		keys = append(keys, rrKey(rr))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\n")
+}
+
+// 等待n个并发请求全部返回，以首个有效响应为基础合并其余有效响应中不重复的应答记录。均无效时返回nil
+func mergeAnswers(ch chan *dns.Msg, n int, accept func(r *dns.Msg) bool) (merged *dns.Msg) {
+	seen := map[string]bool{}
+	for i := 0; i < n; i++ {
+		r := <-ch
+		if !accept(r) {
+			continue
+		}
+		if merged == nil {
+			merged = r.Copy()
+			merged.Answer = nil
+		}
+		for _, rr := range r.Answer {
+			if key := rrKey(rr); !seen[key] {
+				seen[key] = true
+				merged.Answer = append(merged.Answer, dns.Copy(rr))
+			}
+		}
+	}
+	return merged
+}
+
+// 依次读取n个并发请求的响应，有quorum个有效响应的应答记录相同时立即返回其中首个响应。无法达成时返回nil
+func quorumAnswer(ch chan *dns.Msg, n, quorum int, accept func(r *dns.Msg) bool) *dns.Msg {
+	votes, firsts := map[string]int{}, map[string]*dns.Msg{}
+	for i := 0; i < n; i++ {
+		r := <-ch
+		if !accept(r) {
+			continue
+		}
+		key := answerKey(r)
+		if votes[key]++; firsts[key] == nil {
+			firsts[key] = r
+		}
+		if votes[key] >= quorum {
+			return firsts[key]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package inbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"testing"
+	"time"
+)
+
+// 生成包含多个A记录的响应
+func answerAs(ips ...string) *dns.Msg {
+	r := new(dns.Msg)
+	for _, ip := range ips {
+		rr, _ := dns.NewRR("example.com. 600 IN A " + ip)
+		r.Answer = append(r.Answer, rr)
+	}
+	return r
+}
+
+func TestAnswerKey(t *testing.T) {
+	a, b := answerAs("1.1.1.1", "1.1.1.2"), answerAs("1.1.1.2", "1.1.1.1")
+	b.Answer[0].Header().Ttl, b.Answer[1].Header().Name = 30, "EXAMPLE.com."
+	assert.Equal(t, answerKey(a), answerKey(b)) // 忽略顺序、TTL及大小写
+	assert.NotEqual(t, answerKey(a), answerKey(answerAs("1.1.1.1")))
+	assert.Equal(t, uint32(30), b.Answer[0].Header().Ttl) // 不修改原记录
+}
+
+func TestGroup_StrategyFirst(t *testing.T) {
+	fast := &delayCaller{resp: answerAs("1.1.1.1")}
+	slow := &delayCaller{delay: 100 * time.Millisecond, resp: answerAs("2.2.2.2")}
+	group := &Group{Callers: []outbound.Caller{slow, fast}, Concurrent: true}
+	r := group.CallDNS(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Equal(t, answerKey(answerAs("1.1.1.1")), answerKey(r))
+}
+
+func TestGroup_StrategyMerge(t *testing.T) {
+	servFail := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	group := &Group{Concurrent: true, Strategy: StrategyMerge, Callers: []outbound.Caller{
+		&delayCaller{resp: answerAs("1.1.1.1", "1.1.1.2")},
+		&delayCaller{delay: 50 * time.Millisecond, resp: answerAs("1.1.1.2", "1.1.1.3")},
+		&delayCaller{resp: servFail},
+	}}
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	// 等待所有上游返回，合并有效响应中的记录并去重
+	r := group.CallDNS(req)
+	assert.Equal(t, answerKey(answerAs("1.1.1.1", "1.1.1.2", "1.1.1.3")), answerKey(r))
+	// 均失败时返回失败的响应
+	group.Callers = []outbound.Caller{&delayCaller{resp: servFail}, &countCaller{}}
+	assert.Equal(t, dns.RcodeServerFailure, group.CallDNS(req).Rcode)
+}
+
+func TestGroup_StrategyQuorum(t *testing.T) {
+	poisoned := &delayCaller{resp: answerAs("9.9.9.9")}
+	agreeA := &delayCaller{delay: 20 * time.Millisecond, resp: answerAs("1.1.1.1", "1.1.1.2")}
+	agreeB := &delayCaller{delay: 40 * time.Millisecond, resp: answerAs("1.1.1.2", "1.1.1.1")}
+	slow := &delayCaller{delay: time.Second, resp: answerAs("1.1.1.1", "1.1.1.2")}
+	group := &Group{Concurrent: true, Strategy: StrategyQuorum, Quorum: 2,
+		Callers: []outbound.Caller{poisoned, agreeA, agreeB, slow}}
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	// 最先返回的污染响应被忽略，两个上游返回相同记录后立即使用，不等待其余上游
+	begin := time.Now()
+	r := group.CallDNS(req)
+	assert.True(t, time.Since(begin) < 500*time.Millisecond)
+	assert.Equal(t, answerKey(agreeA.resp), answerKey(r))
+	// 各上游返回的记录均不一致时返回nil（SERVFAIL）
+	group.Callers = []outbound.Caller{poisoned, agreeA, &delayCaller{resp: answerAs("8.8.8.8")}}
+	assert.Nil(t, group.CallDNS(req))
+	// 未设置Quorum时为过半数
+	group.Quorum = 0
+	group.Callers = []outbound.Caller{poisoned, agreeA, agreeB}
+	assert.Equal(t, answerKey(agreeA.resp), answerKey(group.CallDNS(req)))
+	group.Callers = []outbound.Caller{poisoned, agreeA, agreeB, &delayCaller{resp: answerAs("8.8.8.8")}}
+	assert.Nil(t, group.CallDNS(req))
+}
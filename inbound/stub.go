@@ -0,0 +1,84 @@
+package inbound
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"strings"
+)
+
+// 合成记录使用的TTL（秒）
+const stubTTL = 3600
+
+// StubZone 存根区域，区域及其所有子域名的请求均转发至区域指定的上游（依次尝试，失败时尝试下一个）
+type StubZone struct {
+	Callers    []outbound.Caller
+	Synthesize bool // 为true时直接应答区域顶点的NS/SOA请求，且为缺少SOA记录的否定响应补充SOA记录
+	group      *Group
+}
+
+// NewStubZone 创建使用指定上游的存根区域
+func NewStubZone(callers []outbound.Caller, synthesize bool) *StubZone {
+	return &StubZone{Callers: callers, Synthesize: synthesize, group: &Group{Callers: callers}}
+}
+
+// MatchStubZone 查找域名（或其上级域名）所属的存根区域，区域名不区分大小写，未找到时返回nil
+func (handler *Handler) MatchStubZone(name string) (zone string, stub *StubZone) {
+	if len(handler.StubZones) == 0 {
+		return "", nil
+	}
+	for _, zone = range domainSuffixes(strings.ToLower(name)) {
+		if stub = handler.StubZones[zone]; stub != nil {
+			return zone, stub
+		}
+	}
+	return "", nil
+}
+
+// 生成区域的SOA记录，参数均为合成值
+func stubSOA(zone string) *dns.SOA {
+	soa := synthSOA(zone, stubTTL)
+	soa.Minttl = negativeTTL
+	return soa
+}
+
+// Resolve 向存根区域的上游转发请求，zone为MatchStubZone返回的区域名。所有上游均失败时返回nil
+func (stub *StubZone) Resolve(zone string, request *dns.Msg) *dns.Msg {
+	return stub.ResolveContext(context.Background(), zone, request)
+}
+
+// ResolveContext 同Resolve，ctx结束后不再尝试后续上游
+func (stub *StubZone) ResolveContext(ctx context.Context, zone string, request *dns.Msg) *dns.Msg {
+	question := request.Question[0]
+	apex := strings.EqualFold(strings.TrimSuffix(question.Name, "."), zone)
+	if stub.Synthesize && apex && question.Qclass == dns.ClassINET &&
+		(question.Qtype == dns.TypeSOA || question.Qtype == dns.TypeNS) {
+		r := new(dns.Msg).SetReply(request)
+		r.Authoritative = true
+		if question.Qtype == dns.TypeSOA {
+			r.Answer = []dns.RR{stubSOA(zone)}
+		} else {
+			hdr := dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: stubTTL}
+			r.Answer = []dns.RR{&dns.NS{Hdr: hdr, Ns: "ns." + dns.Fqdn(zone)}}
+		}
+		return r
+	}
+	group := stub.group
+	if group == nil {
+		group = &Group{Callers: stub.Callers}
+	}
+	r := group.CallDNSContext(ctx, request)
+	if r == nil || !stub.Synthesize || len(r.Answer) > 0 {
+		return r
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return r
+	}
+	if hasSOA(r.Ns) {
+		return r
+	}
+	// 否定响应缺少SOA时无法被下游缓存（RFC 2308），补充合成的SOA记录
+	r = r.Copy()
+	r.Ns = append(r.Ns, stubSOA(zone))
+	return r
+}
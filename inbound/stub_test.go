@@ -0,0 +1,68 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"sync"
+	"testing"
+)
+
+func TestHandler_StubZone(t *testing.T) {
+	down, stubCaller := &countCaller{}, &recordCaller{resp: answerA("10.0.0.1")}
+	groupCaller := &recordCaller{resp: answerA("1.1.1.1")}
+	group := &Group{Callers: []outbound.Caller{groupCaller}}
+	handler := &Handler{Mux: new(sync.RWMutex), GFWMatcher: matcher.NewABPByText(""),
+		CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		Groups:    map[string]*Group{"clean": group, "dirty": group},
+		Forward:   map[string]outbound.Caller{"corp.lan": groupCaller},
+		StubZones: map[string]*StubZone{"corp.lan": NewStubZone([]outbound.Caller{down, stubCaller}, false)}}
+
+	// 区域内的请求依次转发至区域的上游，优先于forward
+	r, result := handler.Query(new(dns.Msg).SetQuestion("Host.Corp.LAN.", dns.TypeA))
+	assert.Equal(t, "stub zone corp.lan", result.Reason)
+	assert.Equal(t, "10.0.0.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 1, down.count)
+	assert.Equal(t, "Host.Corp.LAN.", stubCaller.request.Question[0].Name)
+	// 区域外的请求正常分流
+	r, result = handler.Query(new(dns.Msg).SetQuestion("corp.lan.example.com.", dns.TypeA))
+	assert.Equal(t, "clean", result.Group)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+	// 上游均失败时返回SERVFAIL
+	handler.StubZones["corp.lan"] = NewStubZone([]outbound.Caller{down}, false)
+	r, _ = handler.Query(new(dns.Msg).SetQuestion("corp.lan.", dns.TypeA))
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+}
+
+func TestStubZone_Synthesize(t *testing.T) {
+	caller := &recordCaller{resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}}
+	stub := NewStubZone([]outbound.Caller{caller}, true)
+
+	// 直接应答区域顶点的SOA/NS请求
+	r := stub.Resolve("corp.lan", new(dns.Msg).SetQuestion("Corp.Lan.", dns.TypeSOA))
+	assert.True(t, r.Authoritative)
+	assert.Equal(t, "corp.lan.", r.Answer[0].(*dns.SOA).Hdr.Name)
+	r = stub.Resolve("corp.lan", new(dns.Msg).SetQuestion("corp.lan.", dns.TypeNS))
+	assert.Equal(t, "ns.corp.lan.", r.Answer[0].(*dns.NS).Ns)
+	assert.Nil(t, caller.request)
+	// 为缺少SOA的否定响应补充SOA，不修改上游响应
+	r = stub.Resolve("corp.lan", new(dns.Msg).SetQuestion("none.corp.lan.", dns.TypeA))
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	assert.Equal(t, "corp.lan.", r.Ns[0].(*dns.SOA).Hdr.Name)
+	assert.Empty(t, caller.resp.Ns)
+	// 已有SOA或非否定响应时原样返回
+	soa := stubSOA("upstream.lan")
+	caller.resp.Ns = []dns.RR{soa}
+	r = stub.Resolve("corp.lan", new(dns.Msg).SetQuestion("none.corp.lan.", dns.TypeA))
+	assert.Equal(t, []dns.RR{soa}, r.Ns)
+	caller.resp = answerA("10.0.0.1")
+	r = stub.Resolve("corp.lan", new(dns.Msg).SetQuestion("host.corp.lan.", dns.TypeA))
+	assert.Empty(t, r.Ns)
+	// 未启用时转发顶点的SOA请求
+	stub.Synthesize = false
+	stub.Resolve("corp.lan", new(dns.Msg).SetQuestion("corp.lan.", dns.TypeSOA))
+	assert.Equal(t, dns.TypeSOA, caller.request.Question[0].Qtype)
+}
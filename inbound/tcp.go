@@ -0,0 +1,57 @@
+package inbound
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"time"
+)
+
+// dns消息头的长度，长度前缀小于该值的请求不可能是合法的dns消息
+const dnsHeaderSize = 12
+
+// 收到TCP/DoT请求的首个字节后，须在该时限内读完整个请求，避免客户端以极慢的速度发送请求长期占用连接
+var tcpFrameTimeout = 2 * time.Second
+
+// frameReader 替换dns.Server默认的TCP读取逻辑：校验2字节长度前缀，并限制单个请求的读取耗时
+type frameReader struct {
+	dns.Reader
+	maxSize int // 请求长度上限（字节）
+}
+
+// ReadTCP 读取一个带长度前缀的dns请求，长度前缀不合法或读取超时时返回错误（dns.Server随即关闭连接）。
+// timeout为等待请求到达的时限（首个请求为读超时，之后为空闲超时）
+func (reader *frameReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	var prefix [2]byte
+	if _, err := io.ReadFull(conn, prefix[:1]); err != nil {
+		return nil, err
+	}
+	// 收到首个字节后，剩余部分须在tcpFrameTimeout内读完
+	if tcpFrameTimeout < timeout {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpFrameTimeout))
+	}
+	if _, err := io.ReadFull(conn, prefix[1:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(prefix[:]))
+	if length < dnsHeaderSize || length > reader.maxSize {
+		return nil, fmt.Errorf("invalid tcp message length %d from %s", length, conn.RemoteAddr())
+	}
+	m := make([]byte, length)
+	if _, err := io.ReadFull(conn, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 返回TCP/DoT服务使用的DecorateReader。MaxTCPSize不在(dnsHeaderSize, dns.MaxMsgSize)内时不额外限制请求长度
+func (handler *Handler) decorateReader(reader dns.Reader) dns.Reader {
+	maxSize := handler.MaxTCPSize
+	if maxSize <= dnsHeaderSize || maxSize > dns.MaxMsgSize {
+		maxSize = dns.MaxMsgSize
+	}
+	return &frameReader{Reader: reader, maxSize: maxSize}
+}
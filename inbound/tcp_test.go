@@ -0,0 +1,160 @@
+package inbound
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 判断连接是否在timeout内被服务端关闭
+func closedWithin(conn net.Conn, timeout time.Duration) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := ioutil.ReadAll(conn)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+func TestHandler_TCPFrame(t *testing.T) {
+	defer func(timeout time.Duration) { tcpFrameTimeout = timeout }(tcpFrameTimeout)
+	tcpFrameTimeout = 100 * time.Millisecond
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(),
+		HostsReaders: []hosts.Reader{hosts.NewReaderByText("1.1.1.1 ip.cn")},
+		Listen:       []string{freeUDPAddr(t)}, ListenTCP: true, TCPKeepalive: time.Minute, MaxTCPSize: 512,
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- handler.ListenAndServe() }()
+	defer func() {
+		handler.Shutdown()
+		assert.NotNil(t, <-errCh)
+	}()
+	addr := handler.Listen[0]
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	r, err := exchangeUntilReady(&dns.Client{Net: "tcp"}, addr, req)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		assert.Nil(t, err)
+		return conn
+	}
+	// 长度前缀超出上限或小于dns消息头时直接关闭连接
+	for _, prefix := range [][]byte{{0xff, 0xff}, {0x02, 0x01}, {0x00, 0x05}, {0x00, 0x00}} {
+		conn := dial()
+		_, _ = conn.Write(prefix)
+		assert.True(t, closedWithin(conn, time.Second), "%v", prefix)
+		_ = conn.Close()
+	}
+	// 只发送部分请求（包括只发送长度前缀的首个字节）时，超过时限后关闭连接，而非等待空闲超时
+	buf, _ := req.Pack()
+	for _, partial := range [][]byte{{0x00}, append([]byte{0x00, byte(len(buf))}, buf[:5]...)} {
+		conn := dial()
+		begin := time.Now()
+		_, _ = conn.Write(partial)
+		assert.True(t, closedWithin(conn, time.Second))
+		assert.True(t, time.Since(begin) < 500*time.Millisecond)
+		_ = conn.Close()
+	}
+	// 被关闭的异常连接不影响后续请求
+	r, err = exchangeUntilReady(&dns.Client{Net: "tcp"}, addr, req)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.1.1.1", r.Answer[0].(*dns.A).A.String())
+}
+
+func TestHandler_DecorateReader(t *testing.T) {
+	handler := &Handler{}
+	assert.Equal(t, dns.MaxMsgSize, handler.decorateReader(nil).(*frameReader).maxSize)
+	handler.MaxTCPSize = 100000
+	assert.Equal(t, dns.MaxMsgSize, handler.decorateReader(nil).(*frameReader).maxSize)
+	handler.MaxTCPSize = 1024
+	assert.Equal(t, 1024, handler.decorateReader(nil).(*frameReader).maxSize)
+}
+
+// 生成包含n条TXT记录（每条约200字节）的响应，模拟SPF/DKIM等聚合记录
+func largeTXT(name string, n int) *dns.Msg {
+	r := new(dns.Msg)
+	for i := 0; i < n; i++ {
+		txt := fmt.Sprintf("v=spf1 include:_spf%03d.example.com ", i) + strings.Repeat("a", 160)
+		r.Answer = append(r.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT,
+			Class: dns.ClassINET, Ttl: 600}, Txt: []string{txt}})
+	}
+	return r
+}
+
+func TestHandler_LargeTXT(t *testing.T) {
+	group := &Group{Callers: []outbound.Caller{&staticCaller{resp: largeTXT("spf.example.com.", 40)}}}
+	huge := &Group{Callers: []outbound.Caller{&staticCaller{resp: largeTXT("huge.example.com.", 300)}},
+		Matcher: matcher.NewABPByText("||huge.example.com")}
+	handler := &Handler{Mux: new(sync.RWMutex), QueryLogger: log.New(), Listen: []string{freeUDPAddr(t)}, ListenTCP: true,
+		Cache: cache.NewDNSCache(10, time.Minute, time.Hour), GFWMatcher: matcher.NewABPByText(""),
+		CNIP: cache.NewRamSetByText(""), Groups: map[string]*Group{"clean": group, "dirty": group, "huge": huge}}
+	handler.QueryLogger.SetOutput(ioutil.Discard)
+	errCh := make(chan error, 1)
+	go func() { errCh <- handler.ListenAndServe() }()
+	defer func() {
+		handler.Shutdown()
+		assert.NotNil(t, <-errCh)
+	}()
+	addr := handler.Listen[0]
+	newReq := func(name string) *dns.Msg {
+		req := new(dns.Msg).SetQuestion(name, dns.TypeTXT)
+		req.SetEdns0(1232, false)
+		return req
+	}
+
+	// UDP响应超出缓冲区时截断并设置TC，且可正常解析
+	r, err := exchangeUntilReady(&dns.Client{UDPSize: 1232}, addr, newReq("spf.example.com."))
+	assert.Nil(t, err)
+	assert.True(t, r.Truncated)
+	assert.True(t, len(r.Answer) > 0 && len(r.Answer) < 40)
+	// 改用TCP重试时返回完整的记录
+	r, err = exchangeUntilReady(&dns.Client{Net: "tcp"}, addr, newReq("spf.example.com."))
+	assert.Nil(t, err)
+	assert.False(t, r.Truncated)
+	assert.Len(t, r.Answer, 40)
+	for i, rr := range r.Answer {
+		assert.True(t, strings.HasPrefix(rr.(*dns.TXT).Txt[0], fmt.Sprintf("v=spf1 include:_spf%03d", i)))
+	}
+	// 未压缩时超出65535字节的TCP响应经压缩后完整返回
+	assert.True(t, largeTXT("huge.example.com.", 300).Len() > dns.MaxMsgSize)
+	r, err = exchangeUntilReady(&dns.Client{Net: "tcp"}, addr, newReq("huge.example.com."))
+	assert.Nil(t, err)
+	assert.False(t, r.Truncated)
+	assert.Len(t, r.Answer, 300)
+
+	// 启用Compress时始终压缩，UDP响应更小
+	writer := &MockRespWriter{}
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("spf.example.com.", dns.TypeTXT))
+	plain, _ := writer.r.Pack()
+	handler.Compress = true
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("spf.example.com.", dns.TypeTXT))
+	packed, _ := writer.r.Pack()
+	assert.True(t, len(packed) <= dns.MinMsgSize)
+	assert.True(t, len(plain) <= dns.MinMsgSize)
+	assert.True(t, writer.r.Truncated)
+	req := new(dns.Msg).SetQuestion("spf.example.com.", dns.TypeTXT)
+	req.SetEdns0(16384, false)
+	handler.ServeDNS(writer, req)
+	assert.True(t, writer.r.Compress)
+	assert.False(t, writer.r.Truncated)
+	compressedLen := writer.r.Len()
+	handler.Compress = false
+	handler.ServeDNS(writer, req)
+	assert.False(t, writer.r.Compress)
+	assert.True(t, compressedLen < writer.r.Len())
+	// 缓存中的响应不受影响
+	assert.False(t, handler.Cache.Get(req).Compress)
+}
@@ -1,17 +1,144 @@
 package inbound
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/janeczku/go-ipset/ipset"
 	"github.com/miekg/dns"
 	"github.com/sparrc/go-ping"
 	"github.com/wolf-joe/ts-dns/cache"
 	"math"
 	"net"
+	"os/exec"
+	"strings"
 	"sync"
 	"time"
 )
 
 const maxRtt = 500
 
+// ipset命令路径，方便单测替换
+var ipsetBin = "ipset"
+
+// 内网、回环、链路本地等私有地址段，用于过滤公网分组响应中的私有ip，防范dns重绑定
+var privateNets = parseCIDRs("0.0.0.0/8", "10.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10")
+
+// 解析网段列表，仅用于初始化常量，解析失败时panic
+func parseCIDRs(cidrs ...string) (subnets []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return
+}
+
+// 判断ip是否为私有地址
+func isPrivateIP(ip net.IP) bool {
+	for _, subnet := range privateNets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 移除dns响应中指向私有地址的A/AAAA记录，如所有A/AAAA记录均被移除则清空answer（NODATA）。不修改原响应
+func filterPrivate(r *dns.Msg) *dns.Msg {
+	if r == nil {
+		return nil
+	}
+	var answer []dns.RR
+	filtered, remain := false, false
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			answer = append(answer, rr)
+			continue
+		}
+		if isPrivateIP(ip) {
+			filtered = true
+		} else {
+			remain = true
+			answer = append(answer, rr)
+		}
+	}
+	if !filtered {
+		return r
+	}
+	if !remain {
+		answer = nil
+	}
+	r = r.Copy()
+	r.Answer = answer
+	return r
+}
+
+// 按客户端通告的EDNS0缓冲区大小（未携带时为512字节）截断UDP响应，有记录被移除时设置TC标志，
+// 使客户端改用TCP重试。需要截断时返回副本，不修改原响应
+func truncateUDP(request, r *dns.Msg) *dns.Msg {
+	size := dns.MinMsgSize
+	if opt := request.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if r.Len() <= size {
+		return r
+	}
+	r = r.Copy()
+	r.Truncate(size)
+	return r
+}
+
+// TCP响应超出65535字节时压缩域名，仍超出时截断并设置TC标志，避免无法写入响应。需要截断时返回副本，不修改原响应
+func truncateTCP(r *dns.Msg) *dns.Msg {
+	if r.Len() <= dns.MaxMsgSize {
+		return r
+	}
+	r = r.Copy()
+	r.Truncate(dns.MaxMsgSize)
+	return r
+}
+
+// 返回启用域名压缩的响应。只复制消息本身，各section与r共享
+func compressed(r *dns.Msg) *dns.Msg {
+	if r.Compress {
+		return r
+	}
+	c := *r
+	c.Compress = true
+	return &c
+}
+
+// 返回域名本身及其各级上级域名，如"a.b.com."返回["a.b.com", "b.com", "com"]
+func domainSuffixes(name string) (suffixes []string) {
+	for suffix := strings.TrimSuffix(name, "."); suffix != ""; {
+		suffixes = append(suffixes, suffix)
+		i := strings.Index(suffix, ".")
+		if i == -1 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	return
+}
+
+// 生成ANY请求的最小响应（RFC 8482），仅包含一条CPU为"RFC8482"的HINFO记录
+func minimalAny(request *dns.Msg) *dns.Msg {
+	r := new(dns.Msg).SetReply(request)
+	question := request.Question[0]
+	header := dns.RR_Header{Name: question.Name, Rrtype: dns.TypeHINFO, Class: question.Qclass, Ttl: 3789} // TTL同Cloudflare的实现
+	r.Answer = []dns.RR{&dns.HINFO{Hdr: header, Cpu: "RFC8482"}}
+	return r
+}
+
 // 提取dns响应中的A记录列表
 func extractA(r *dns.Msg) (records []*dns.A) {
 	if r == nil {
@@ -26,13 +153,91 @@ func extractA(r *dns.Msg) (records []*dns.A) {
 	return
 }
 
-// 如dns响应中所有ipv4地址都在目标范围内（或没有ipv4地址）返回true，否则返回False
-func allInRange(r *dns.Msg, ipRange *cache.RamSet) bool {
+// 将r设置为request的响应。SetReply会重置rcode，需要还原
+func reply(request, r *dns.Msg) *dns.Msg {
+	rcode := r.Rcode
+	r.SetReply(request)
+	r.Rcode = rcode
+	return r
+}
+
+// 生成ts-dns自身发起的探测请求。参考QNAME minimisation（RFC 7816），只查询根域名的NS记录，
+// 不携带任何用户域名及ECS信息，避免向上游泄露信息
+func probeRequest() *dns.Msg {
+	return new(dns.Msg).SetQuestion(".", dns.TypeNS)
+}
+
+// 判断dns请求是否携带EDNS0 TCP Keepalive选项（RFC 7828）
+func hasKeepalive(request *dns.Msg) bool {
+	if opt := request.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if option.Option() == dns.EDNS0TCPKEEPALIVE {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 返回设置了EDNS0 TCP Keepalive选项的响应副本，timeout为告知客户端的连接空闲超时。
+// miekg/dns v1.1.28中EDNS0_TCP_KEEPALIVE的编码有误，因此使用EDNS0_LOCAL构造
+func setKeepalive(r *dns.Msg, timeout time.Duration) *dns.Msg {
+	r = r.Copy()
+	opt := r.IsEdns0()
+	if opt == nil {
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		opt = r.IsEdns0()
+	}
+	var options []dns.EDNS0
+	for _, option := range opt.Option { // 移除上游响应中的keepalive
+		if option.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, option)
+		}
+	}
+	units := timeout / (100 * time.Millisecond) // 单位为100毫秒
+	if units > math.MaxUint16 {
+		units = math.MaxUint16
+	}
+	data := []byte{byte(units >> 8), byte(units)}
+	opt.Option = append(options, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: data})
+	return r
+}
+
+// 生成dns请求对应的SERVFAIL响应
+func servFail(request *dns.Msg) *dns.Msg {
+	return new(dns.Msg).SetRcode(request, dns.RcodeServerFailure)
+}
+
+// 通过ipset restore将多个ip一次性加入ipset，避免逐个调用ipset命令的开销
+func addIPSetBatch(set *ipset.IPSet, ips []string) error {
+	buf := new(bytes.Buffer)
+	for _, ip := range ips {
+		_, _ = fmt.Fprintf(buf, "add %s %s timeout %d -exist\n", set.Name, ip, set.Timeout)
+	}
+	cmd := exec.Command(ipsetBin, "restore", "-exist")
+	cmd.Stdin = buf
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding %d entries: %v (%s)", len(ips), err, out)
+	}
+	return nil
+}
+
+// 如dns响应中所有ipv4地址都在ipRange内、所有ipv6地址都在ipRange6内（或没有对应地址）返回true，否则返回False。
+// ipRange6为nil时不检查ipv6地址
+func allInRange(r *dns.Msg, ipRange, ipRange6 *cache.RamSet) bool {
 	for _, a := range extractA(r) {
 		if ipv4 := net.ParseIP(a.A.String()).To4(); ipv4 != nil && !ipRange.Contain(ipv4) {
 			return false
 		}
 	}
+	if ipRange6 == nil || r == nil {
+		return true
+	}
+	for _, rr := range r.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !ipRange6.Contain(aaaa.AAAA) {
+			return false
+		}
+	}
 	return true
 }
 
@@ -62,7 +267,7 @@ func fastestA(ch chan *dns.Msg, chLen int) (res *dns.Msg) {
 			res = msg // 防止被最后出现的nil覆盖
 		}
 		for _, a := range extractA(msg) {
-			ipv4 := a.A.String()
+			a, ipv4 := a, a.A.String()
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
@@ -2,20 +2,25 @@ package inbound
 
 import (
 	"github.com/agiledragon/gomonkey"
+	"github.com/janeczku/go-ipset/ipset"
 	"github.com/miekg/dns"
 	"github.com/sparrc/go-ping"
 	"github.com/stretchr/testify/assert"
 	"github.com/wolf-joe/ts-dns/cache"
 	"github.com/wolf-joe/ts-dns/mock"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestTools(t *testing.T) {
 	resp := &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)}}}
 	assert.Equal(t, len(extractA(nil)), 0)
-	assert.False(t, allInRange(resp, cache.NewRamSetByText("")))
-	assert.True(t, allInRange(resp, cache.NewRamSetByText("1.1.1.1")))
+	assert.False(t, allInRange(resp, cache.NewRamSetByText(""), nil))
+	assert.True(t, allInRange(resp, cache.NewRamSetByText("1.1.1.1"), nil))
 
 	assert.True(t, pingRtt("") > maxRtt)
 	assert.True(t, pingRtt("111") > maxRtt)
@@ -27,6 +32,48 @@ func TestTools(t *testing.T) {
 	assert.True(t, pingRtt("1.1.1.1") < maxRtt)
 }
 
+func TestTools_AllInRange6(t *testing.T) {
+	cnip, cnip6 := cache.NewRamSetByText("1.1.1.1"), cache.NewRamSetByText("240e::/20")
+	resp := &dns.Msg{Answer: []dns.RR{&dns.A{A: net.IPv4(1, 1, 1, 1)},
+		&dns.AAAA{AAAA: net.ParseIP("2001:db8::1")}}}
+	assert.True(t, allInRange(resp, cnip, nil)) // 未配置cnip6时忽略AAAA记录
+	assert.False(t, allInRange(resp, cnip, cnip6))
+	resp.Answer[1] = &dns.AAAA{AAAA: net.ParseIP("240e::1")}
+	assert.True(t, allInRange(resp, cnip, cnip6))
+	assert.True(t, allInRange(nil, cnip, cnip6))
+}
+
+func TestTools_ProbeRequest(t *testing.T) {
+	probe := probeRequest()
+	assert.Len(t, probe.Question, 1)
+	assert.Equal(t, ".", probe.Question[0].Name)
+	assert.Equal(t, dns.TypeNS, probe.Question[0].Qtype)
+	assert.Empty(t, probe.Extra) // 不携带ECS等EDNS0信息
+}
+
+func TestTools_Keepalive(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	assert.False(t, hasKeepalive(req))
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	assert.False(t, hasKeepalive(req))
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+	assert.True(t, hasKeepalive(req))
+
+	r := new(dns.Msg).SetReply(req)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	r.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{0, 1}}}
+	keepalive := setKeepalive(r, time.Hour*24) // 超过最大值
+	assert.Len(t, r.IsEdns0().Option, 1)       // 不修改原响应
+	assert.Len(t, keepalive.IsEdns0().Option, 1)
+	assert.Equal(t, []byte{0xff, 0xff}, keepalive.IsEdns0().Option[0].(*dns.EDNS0_LOCAL).Data)
+	// 打包后可被正确解析
+	buf, err := setKeepalive(new(dns.Msg).SetReply(req), 2*time.Second).Pack()
+	assert.Nil(t, err)
+	msg := new(dns.Msg)
+	assert.Nil(t, msg.Unpack(buf))
+	assert.Equal(t, []byte{0, 20}, msg.IsEdns0().Option[0].(*dns.EDNS0_LOCAL).Data)
+}
+
 func TestTools_FastestA(t *testing.T) {
 	// 预设ping rtt值
 	gomonkey.ApplyFunc(pingRtt, func(ip string) int64 {
@@ -63,3 +110,81 @@ func TestTools_FastestA(t *testing.T) {
 	msg = fastestA(ch, chLen)
 	assert.NotNil(t, msg)
 }
+
+// 生成一个记录stdin内容的假ipset命令，返回记录文件路径
+func fakeIPSetBin(tb testing.TB) (dir, output string) {
+	dir, _ = ioutil.TempDir("", "ts-dns-ipset")
+	output = filepath.Join(dir, "output")
+	script := "#!/bin/sh\ncat >> " + output + "\n"
+	_ = ioutil.WriteFile(filepath.Join(dir, "ipset"), []byte(script), 0755)
+	ipsetBin = filepath.Join(dir, "ipset")
+	return
+}
+
+func TestTools_AddIPSetBatch(t *testing.T) {
+	dir, output := fakeIPSetBin(t)
+	defer func() { ipsetBin = "ipset"; _ = os.RemoveAll(dir) }()
+
+	set := &ipset.IPSet{Name: "test", Timeout: 60}
+	resp := &dns.Msg{Answer: []dns.RR{
+		&dns.A{A: net.IPv4(1, 1, 1, 1)}, &dns.AAAA{AAAA: net.ParseIP("::1")},
+		&dns.A{A: net.IPv4(1, 1, 1, 2)}, &dns.A{A: net.IPv4(1, 1, 1, 3)},
+	}}
+	group := &Group{IPSet: set}
+	group.AddIPSet(resp) // 三个ipv4地址一次性写入
+	raw, err := ioutil.ReadFile(output)
+	assert.Nil(t, err)
+	expect := "add test 1.1.1.1 timeout 60 -exist\n" +
+		"add test 1.1.1.2 timeout 60 -exist\n" +
+		"add test 1.1.1.3 timeout 60 -exist\n"
+	assert.Equal(t, string(raw), expect)
+
+	ipsetBin = filepath.Join(dir, "ne")
+	assert.NotNil(t, addIPSetBatch(set, []string{"1.1.1.1"}))
+}
+
+func BenchmarkAddIPSet(b *testing.B) {
+	dir, _ := fakeIPSetBin(b)
+	defer func() { ipsetBin = "ipset"; _ = os.RemoveAll(dir) }()
+	set := &ipset.IPSet{Name: "test", Timeout: 60}
+	var ips []string
+	for i := 0; i < 16; i++ {
+		ips = append(ips, net.IPv4(1, 1, 1, byte(i)).String())
+	}
+	// 逐个添加，每个ip调用一次ipset
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, ip := range ips {
+				_ = addIPSetBatch(set, []string{ip})
+			}
+		}
+	})
+	// 批量添加，每个响应只调用一次ipset
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = addIPSetBatch(set, ips)
+		}
+	})
+}
+
+func TestTools_FilterPrivate(t *testing.T) {
+	assert.Nil(t, filterPrivate(nil))
+	cname := &dns.CNAME{Target: "b.com."}
+	public := &dns.A{A: net.IPv4(1, 1, 1, 1)}
+	r := &dns.Msg{Answer: []dns.RR{cname, public}}
+	assert.Equal(t, r, filterPrivate(r)) // 无私有ip时原样返回
+
+	private := []dns.RR{&dns.A{A: net.IPv4(192, 168, 1, 1)}, &dns.A{A: net.IPv4(127, 0, 0, 1)},
+		&dns.A{A: net.IPv4(10, 1, 1, 1)}, &dns.A{A: net.IPv4(169, 254, 1, 1)},
+		&dns.AAAA{AAAA: net.ParseIP("::1")}, &dns.AAAA{AAAA: net.ParseIP("fe80::1")},
+		&dns.AAAA{AAAA: net.ParseIP("fd00::1")}}
+	r = &dns.Msg{Answer: append([]dns.RR{cname, public}, private...)}
+	filtered := filterPrivate(r)
+	assert.Equal(t, []dns.RR{cname, public}, filtered.Answer)
+	assert.Len(t, r.Answer, 9) // 不修改原响应
+	// 全部被过滤时返回NODATA
+	r = &dns.Msg{Answer: append([]dns.RR{cname}, private...)}
+	filtered = filterPrivate(r)
+	assert.Equal(t, dns.RcodeSuccess, filtered.Rcode)
+	assert.Empty(t, filtered.Answer)
+}
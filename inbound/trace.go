@@ -0,0 +1,59 @@
+package inbound
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// TraceOptionCode 请求处理追踪使用的EDNS0选项码（位于RFC 6891的本地/实验用途范围），选项内容为TraceToken
+const TraceOptionCode = 65001
+
+// 判断请求是否携带内容与TraceToken一致的追踪选项，TraceToken为空时始终返回false
+func (handler *Handler) traceRequested(request *dns.Msg) bool {
+	if handler.TraceToken == "" {
+		return false
+	}
+	opt := request.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == TraceOptionCode &&
+			subtle.ConstantTimeCompare(local.Data, []byte(handler.TraceToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回移除追踪选项后的请求副本，避免将令牌转发至上游
+func stripTrace(request *dns.Msg) *dns.Msg {
+	request = request.Copy()
+	opt := request.IsEdns0()
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != TraceOptionCode {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+	return request
+}
+
+// 将请求的处理结果及耗时以TXT记录的形式附加在响应的additional section中，返回副本
+func appendTrace(r *dns.Msg, question dns.Question, result *QueryResult, elapsed time.Duration) *dns.Msg {
+	lines := []string{"reason=" + result.Reason}
+	if result.Group != "" {
+		lines = append(lines, "group="+result.Group)
+	}
+	if result.Rule != "" {
+		lines = append(lines, "rule="+result.Rule)
+	}
+	lines = append(lines, fmt.Sprintf("elapsed=%v", elapsed.Round(time.Microsecond)))
+	r = r.Copy() // r可能与缓存共享记录
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}
+	r.Extra = append(r.Extra, &dns.TXT{Hdr: hdr, Txt: lines})
+	return r
+}
@@ -0,0 +1,67 @@
+package inbound
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 生成携带追踪选项的请求
+func traceRequest(name, token string) *dns.Msg {
+	req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: TraceOptionCode, Data: []byte(token)})
+	return req
+}
+
+// 提取响应中的追踪记录，未找到时返回nil
+func traceLines(r *dns.Msg) []string {
+	for _, rr := range r.Extra {
+		if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Class == dns.ClassCHAOS {
+			return txt.Txt
+		}
+	}
+	return nil
+}
+
+func TestHandler_Trace(t *testing.T) {
+	caller := &recordCaller{resp: answerA("1.1.1.1")}
+	handler := &Handler{Mux: new(sync.RWMutex), Cache: cache.NewDNSCache(10, time.Minute, time.Hour),
+		GFWMatcher: matcher.NewABPByText(""), CNIP: cache.NewRamSetByText(""), QueryLogger: log.New(),
+		TraceToken: "secret", Groups: map[string]*Group{
+			"clean": {Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("||example.com")},
+			"dirty": {Callers: []outbound.Caller{caller}},
+		}}
+
+	// 令牌正确时附加分组、规则及耗时，且不向上游转发令牌
+	writer := &MockRespWriter{}
+	handler.ServeDNS(writer, traceRequest("example.com.", "secret"))
+	lines := traceLines(writer.r)
+	assert.Equal(t, []string{"reason=match by rules", "group=clean", "rule=||example.com"}, lines[:3])
+	assert.True(t, strings.HasPrefix(lines[3], "elapsed="))
+	assert.Len(t, caller.request.IsEdns0().Option, 0)
+	assert.Equal(t, "1.1.1.1", writer.r.Answer[0].(*dns.A).A.String())
+	// 追踪记录不写入缓存
+	handler.ServeDNS(writer, traceRequest("example.com.", "secret"))
+	assert.Equal(t, "reason=hit cache", traceLines(writer.r)[0])
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	assert.Nil(t, traceLines(writer.r))
+
+	// 普通请求及令牌错误的请求不附加追踪记录
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("other.com.", dns.TypeA))
+	assert.Nil(t, traceLines(writer.r))
+	handler.ServeDNS(writer, traceRequest("other.com.", "wrong"))
+	assert.Nil(t, traceLines(writer.r))
+	// 未配置令牌时不启用
+	handler.TraceToken = ""
+	handler.ServeDNS(writer, traceRequest("other.com.", ""))
+	assert.Nil(t, traceLines(writer.r))
+}
@@ -10,23 +10,33 @@ import (
 // ABPlus 基于部分AdBlock Plus规则的域名匹配器
 type ABPlus struct {
 	DomainMatcher
-	isBlocked     map[string]bool
-	blockedRegs   []*regexp.Regexp
-	unblockedRegs []*regexp.Regexp
+	isBlocked      map[string]bool
+	rules          map[string]string // isBlocked中的域名 -> 原始规则
+	blockedRegs    []*regexp.Regexp
+	blockedRules   []string // 与blockedRegs一一对应的原始规则
+	unblockedRegs  []*regexp.Regexp
+	unblockedRules []string // 与unblockedRegs一一对应的原始规则
 }
 
 // Match 判断域名是否匹配ADBlock Plus规则
 func (matcher *ABPlus) Match(domain string) (matched bool, ok bool) {
+	_, matched, ok = matcher.MatchRule(domain)
+	return
+}
+
+// MatchRule 同Match，并返回命中的原始规则，ok为false时rule为空
+func (matcher *ABPlus) MatchRule(domain string) (rule string, matched bool, ok bool) {
 	if domain == "" {
 		return
 	}
 	if domain[len(domain)-1] == '.' {
 		domain = domain[:len(domain)-1] // 移除域名末尾的根域名
 	}
+	domain = NormalizeDomain(domain) // 国际化域名统一为punycode形式
 	// 依次拆解域名进行匹配
 	for suffix := domain; strings.Contains(suffix, "."); {
 		if matched, ok = matcher.isBlocked[suffix]; ok {
-			return // 对应记录则返回结果
+			return matcher.rules[suffix], matched, ok // 对应记录则返回结果
 		}
 		if suffix[0] == '.' {
 			suffix = suffix[1:] // 移除域名前的点号再匹配
@@ -35,18 +45,18 @@ func (matcher *ABPlus) Match(domain string) (matched bool, ok bool) {
 		}
 	}
 	// 通配符匹配
-	for _, regex := range matcher.blockedRegs {
+	for i, regex := range matcher.blockedRegs {
 		if regex.MatchString(domain) {
-			return true, true
+			return matcher.blockedRules[i], true, true
 		}
 	}
-	for _, regex := range matcher.unblockedRegs {
+	for i, regex := range matcher.unblockedRegs {
 		if regex.MatchString(domain) {
-			return false, true
+			return matcher.unblockedRules[i], false, true
 		}
 	}
 	// 匹配失败
-	return false, false
+	return "", false, false
 }
 
 // NewABPByText 从文本内容读取AdBlock Plus规则
@@ -67,7 +77,7 @@ func NewABPByText(text string) (matcher *ABPlus) {
 		}
 		return rule
 	}
-	matcher = &ABPlus{isBlocked: map[string]bool{}}
+	matcher = &ABPlus{isBlocked: map[string]bool{}, rules: map[string]string{}}
 	for _, line := range strings.Split(text, "\n") {
 		if line == "" || line[0] == '!' || line[0] == '[' {
 			continue // 忽略空行、注释行、类型声明
@@ -75,12 +85,14 @@ func NewABPByText(text string) (matcher *ABPlus) {
 			if line[:13] == "/^https?:\\/\\/" && line[len(line)-5:] == "\\/.*/" { // google正则补丁
 				reg := regexp.MustCompile(line[13 : len(line)-5])
 				matcher.blockedRegs = append(matcher.blockedRegs, reg)
+				matcher.blockedRules = append(matcher.blockedRules, line)
 			}
 			continue
 		}
+		rule := line
 		line = strings.Replace(line, "%2F", "/", -1)
 
-		domain := extractDomain(line) // 提取规则中的域名
+		domain := NormalizeDomain(extractDomain(line)) // 提取规则中的域名，国际化域名统一为punycode形式
 		// 判断域名中是否有通配符
 		if strings.Index(domain, "*") != -1 {
 			// 通配符表达式转正则表达式
@@ -89,8 +101,10 @@ func NewABPByText(text string) (matcher *ABPlus) {
 			regex := regexp.MustCompile("^" + regStr + "$")
 			if line[:2] == "@@" {
 				matcher.unblockedRegs = append(matcher.unblockedRegs, regex)
+				matcher.unblockedRules = append(matcher.unblockedRules, rule)
 			} else {
 				matcher.blockedRegs = append(matcher.blockedRegs, regex)
+				matcher.blockedRules = append(matcher.blockedRules, rule)
 			}
 			continue
 		}
@@ -102,22 +116,24 @@ func NewABPByText(text string) (matcher *ABPlus) {
 			tld = domain[i+1:]
 		}
 		tldReg := regexp.MustCompile(`^[a-zA-Z]{2,}$`)
-		idnReg := regexp.MustCompile(`^xn--[a-zA-Z0-9]{3,}$`)
+		idnReg := regexp.MustCompile(`^xn--[a-zA-Z0-9-]{3,}$`)
 		if !tldReg.MatchString(tld) && !idnReg.MatchString(tld) {
 			continue // 无效域名
 		}
 		matcher.isBlocked[domain] = line[:2] != "@@"
+		matcher.rules[domain] = rule
 	}
 	return matcher
 }
 
-// NewABPByFile 从文件内容读取AdBlock Plus规则
+// NewABPByFile 从文件内容读取AdBlock Plus规则。文件为纯域名列表（每行一个域名，见IsDomainList）时按域名后缀匹配，
+// 此时无需base64解码
 func NewABPByFile(filename string, b64decode bool) (checker *ABPlus, err error) {
 	var raw []byte
 	var text string
 	if raw, err = ioutil.ReadFile(filename); err == nil {
 		text = string(raw)
-		if b64decode {
+		if b64decode && !IsDomainList(text) {
 			if raw, err = base64.StdEncoding.DecodeString(text); err == nil {
 				text = string(raw)
 			}
@@ -126,5 +142,8 @@ func NewABPByFile(filename string, b64decode bool) (checker *ABPlus, err error)
 	if err != nil {
 		return nil, err
 	}
+	if IsDomainList(text) {
+		return NewDomainListByText(text), nil
+	}
 	return NewABPByText(text), nil
 }
@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -67,3 +68,55 @@ func TestNewChecker(t *testing.T) {
 	assert.Equal(t, matched, true)
 	assert.Equal(t, ok, true)
 }
+
+func TestABPlus_MatchRule(t *testing.T) {
+	matcher := NewABPByText(text)
+	rule, matched, ok := matcher.MatchRule("test.abc.com.")
+	assert.Equal(t, ".abc.com", rule)
+	assert.True(t, matched && ok)
+	rule, matched, ok = matcher.MatchRule("www.cip.cc")
+	assert.Equal(t, "@@||cip.cc", rule)
+	assert.True(t, !matched && ok)
+	rule, matched, ok = matcher.MatchRule("m.youtube.com")
+	assert.Equal(t, "|https://*.youtube.com/path", rule)
+	assert.True(t, matched && ok)
+	rule, _, ok = matcher.MatchRule("test.cn")
+	assert.Equal(t, "@@||*.cn", rule)
+	rule, matched, ok = matcher.MatchRule("www.google.com")
+	assert.True(t, strings.HasPrefix(rule, "/^https?:"))
+	assert.True(t, matched && ok)
+	rule, _, ok = matcher.MatchRule("unknown.org")
+	assert.Equal(t, "", rule)
+	assert.False(t, ok)
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	assert.Equal(t, "www.example.com", NormalizeDomain("www.example.com"))
+	assert.Equal(t, "xn--fsqu00a.xn--0zwm56d", NormalizeDomain("例子.测试"))
+	assert.Equal(t, "xn--bcher-kva.de", NormalizeDomain("Bücher.de"))
+	assert.Equal(t, "xn--mnchen-3ya.xn--0zwm56d", NormalizeDomain("münchen。测试"))
+	// miekg/dns表示格式中的\DDD转义
+	assert.Equal(t, "xn--fsqu00a.com.", NormalizeDomain(`\228\190\139\229\173\144.com.`))
+	// 非UTF-8内容保持不变
+	assert.Equal(t, `\255.com`, NormalizeDomain(`\255.com`))
+	// 全角字符按UTS #46映射，无法转换时保持不变
+	assert.Equal(t, "xn--fsqu00a.com", NormalizeDomain("例子．ｃｏｍ"))
+	assert.Equal(t, "-例子.com", NormalizeDomain("-例子.com"))
+}
+
+func TestABPlus_IDN(t *testing.T) {
+	// 国际化域名匹配punycode规则
+	matcher := NewABPByText("||xn--fsqu00a.xn--0zwm56d\n@@||xn--bcher-kva.de")
+	matched, ok := matcher.Match("www.例子.测试.")
+	assert.True(t, matched && ok)
+	matched, ok = matcher.Match("bücher.de")
+	assert.True(t, ok)
+	assert.False(t, matched)
+	// punycode域名匹配国际化域名规则
+	matcher = NewABPByText("||例子.测试\n*.bücher.de")
+	rule, matched, ok := matcher.MatchRule("www.xn--fsqu00a.xn--0zwm56d.")
+	assert.True(t, matched && ok)
+	assert.Equal(t, "||例子.测试", rule)
+	matched, _ = matcher.Match("www.xn--bcher-kva.de")
+	assert.True(t, matched)
+}
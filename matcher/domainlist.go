@@ -0,0 +1,50 @@
+package matcher
+
+import (
+	"strings"
+)
+
+// 去除纯域名列表中一行的行尾注释及首尾空白，返回其中的域名（可能为空）
+func domainListLine(line string) string {
+	if i := strings.IndexByte(line, '#'); i != -1 {
+		line = line[:i]
+	}
+	return strings.TrimSuffix(strings.TrimSpace(line), ".")
+}
+
+// 判断一行内容是否为纯域名：至少包含一个点号，不以点号开头，且不包含ABP规则中的特殊字符及空白
+func isPlainDomain(domain string) bool {
+	if domain == "" || domain[0] == '.' || !strings.Contains(domain, ".") {
+		return false
+	}
+	return !strings.ContainsAny(domain, "|@!/^$*[]:%, \t\r")
+}
+
+// IsDomainList 判断文本是否为纯域名列表（每行一个域名，支持#注释），而非AdBlock Plus规则
+func IsDomainList(text string) bool {
+	found := false
+	for _, line := range strings.Split(text, "\n") {
+		if line = domainListLine(line); line == "" {
+			continue
+		}
+		if !isPlainDomain(line) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// NewDomainListByText 从纯域名列表读取规则，每行一个域名（支持#注释），匹配该域名及其所有子域名
+func NewDomainListByText(text string) (matcher *ABPlus) {
+	matcher = &ABPlus{isBlocked: map[string]bool{}, rules: map[string]string{}}
+	for _, line := range strings.Split(text, "\n") {
+		domain := domainListLine(line)
+		if !isPlainDomain(domain) {
+			continue
+		}
+		domain = NormalizeDomain(domain) // 国际化域名统一为punycode形式
+		matcher.isBlocked[domain], matcher.rules[domain] = true, domain
+	}
+	return matcher
+}
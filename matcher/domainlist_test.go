@@ -0,0 +1,62 @@
+package matcher
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestIsDomainList(t *testing.T) {
+	assert.True(t, IsDomainList("# comment\ngoogle.com\r\n\nyoutube.com # video\nexample.org.\n"))
+	assert.True(t, IsDomainList("例子.测试\n"))
+	assert.False(t, IsDomainList(""))
+	assert.False(t, IsDomainList("# only comments\n"))
+	assert.False(t, IsDomainList(text))                          // ABP规则
+	assert.False(t, IsDomainList("google.com\n||youtube.com\n")) // 混有ABP规则
+	assert.False(t, IsDomainList("google.com\n.abc.com\n"))
+	assert.False(t, IsDomainList("localhost\n"))
+	assert.False(t, IsDomainList(base64.StdEncoding.EncodeToString([]byte("google.com\n"))))
+}
+
+func TestNewDomainListByText(t *testing.T) {
+	matcher := NewDomainListByText("# gfw\ngoogle.com\r\nyoutube.com  # video\n例子.测试\ninvalid\n")
+	for domain, rule := range map[string]string{
+		"google.com.": "google.com", "www.google.com": "google.com", "a.b.youtube.com.": "youtube.com",
+		"www.例子.测试": "xn--fsqu00a.xn--0zwm56d",
+	} {
+		matchedRule, matched, ok := matcher.MatchRule(domain)
+		assert.True(t, ok, domain)
+		assert.True(t, matched, domain)
+		assert.Equal(t, rule, matchedRule, domain)
+	}
+	_, ok := matcher.Match("notgoogle.com")
+	assert.False(t, ok)
+	_, ok = matcher.Match("invalid")
+	assert.False(t, ok)
+}
+
+func TestNewABPByFile_DomainList(t *testing.T) {
+	file, err := ioutil.TempFile("", "ts-dns-domains")
+	assert.Nil(t, err)
+	defer func() { _ = os.Remove(file.Name()) }()
+	_, _ = file.WriteString("# plain domain list\ngoogle.com\ntwitter.com\n")
+	_ = file.Close()
+	// 纯域名列表无需base64解码，按后缀匹配子域名
+	for _, b64decode := range []bool{true, false} {
+		matcher, err := NewABPByFile(file.Name(), b64decode)
+		assert.Nil(t, err)
+		matched, ok := matcher.Match("mobile.twitter.com.")
+		assert.True(t, ok)
+		assert.True(t, matched)
+		_, ok = matcher.Match("baidu.com.")
+		assert.False(t, ok)
+	}
+	// base64编码的纯域名列表同样可用
+	_ = ioutil.WriteFile(file.Name(), []byte(base64.StdEncoding.EncodeToString([]byte("google.com\n"))), 0644)
+	matcher, err := NewABPByFile(file.Name(), true)
+	assert.Nil(t, err)
+	matched, _ := matcher.Match("www.google.com")
+	assert.True(t, matched)
+}
@@ -0,0 +1,68 @@
+package matcher
+
+import (
+	"golang.org/x/net/idna"
+	"strings"
+	"unicode/utf8"
+)
+
+// NormalizeDomain 将国际化域名转换为punycode形式（如"例子.测试"转换为"xn--fsqu00a.xn--0zwm56d"），
+// 支持miekg/dns表示格式中的\DDD转义。纯ASCII的标签保持不变，无法转换（如包含非法字符）时返回原域名
+func NormalizeDomain(domain string) string {
+	if isASCII(domain) && !strings.Contains(domain, "\\") {
+		return domain
+	}
+	name := unescapeDomain(domain)
+	if isASCII(name) || !utf8.ValidString(name) {
+		return domain
+	}
+	// 逐个转换非ASCII标签（按UTS #46映射大小写、全角字符及表意句号等），ASCII标签（如通配符）保持不变
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		var err error
+		if labels[i], err = idna.Lookup.ToASCII(label); err != nil {
+			return domain
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// 判断字符串是否仅包含ASCII字符
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// 还原表示格式中的\DDD转义，其余字符保持不变
+func unescapeDomain(domain string) string {
+	buf := make([]byte, 0, len(domain))
+	for i := 0; i < len(domain); i++ {
+		if domain[i] == '\\' && i+3 < len(domain) && isDigits(domain[i+1:i+4]) {
+			v := int(domain[i+1]-'0')*100 + int(domain[i+2]-'0')*10 + int(domain[i+3]-'0')
+			if v <= 0xff {
+				buf = append(buf, byte(v))
+				i += 3
+				continue
+			}
+		}
+		buf = append(buf, domain[i])
+	}
+	return string(buf)
+}
+
+// 判断字符串是否仅包含数字
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
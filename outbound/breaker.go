@@ -0,0 +1,138 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = "closed"    // 正常请求上游
+	BreakerOpen     = "open"      // 熔断中，直接返回ErrCircuitOpen
+	BreakerHalfOpen = "half-open" // 冷却结束，仅放行一个探测请求
+)
+
+// BreakerCaller 带熔断器的Caller。连续失败threshold次后熔断cooldown时长，期间请求直接失败以便跳过该上游；
+// 冷却结束后放行一个请求探测上游是否恢复，成功则恢复正常，失败则再次熔断
+type BreakerCaller struct {
+	caller    Caller
+	threshold int
+	cooldown  time.Duration
+	mux       sync.Mutex
+	failures  int       // 连续失败次数
+	openUntil time.Time // 熔断结束时间，为零值时代表未熔断
+	probing   bool      // 半开状态下是否已有探测请求在进行
+}
+
+// NewBreakerCaller 为caller包裹熔断器，threshold不大于0时直接返回caller
+func NewBreakerCaller(caller Caller, threshold int, cooldown time.Duration) Caller {
+	if threshold <= 0 {
+		return caller
+	}
+	return &BreakerCaller{caller: caller, threshold: threshold, cooldown: cooldown}
+}
+
+// String 返回被包裹Caller的上游地址
+func (breaker *BreakerCaller) String() string {
+	return fmt.Sprint(breaker.caller)
+}
+
+// Unwrap 返回被包裹的Caller
+func (breaker *BreakerCaller) Unwrap() Caller {
+	return breaker.caller
+}
+
+// State 返回熔断器当前状态：BreakerClosed、BreakerOpen、BreakerHalfOpen之一
+func (breaker *BreakerCaller) State() string {
+	breaker.mux.Lock()
+	defer breaker.mux.Unlock()
+	return breaker.state()
+}
+
+// 返回熔断器当前状态，调用前需持有锁
+func (breaker *BreakerCaller) state() string {
+	switch {
+	case breaker.openUntil.IsZero():
+		return BreakerClosed
+	case time.Now().Before(breaker.openUntil):
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
+
+// 判断是否放行请求，半开状态下仅放行一个探测请求
+func (breaker *BreakerCaller) allow() bool {
+	breaker.mux.Lock()
+	defer breaker.mux.Unlock()
+	switch breaker.state() {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if !breaker.probing {
+			breaker.probing = true
+			return true
+		}
+	}
+	return false
+}
+
+// 根据请求结果更新熔断器状态，被取消及因并发上限未发出的请求不计入结果
+func (breaker *BreakerCaller) record(err error) {
+	breaker.mux.Lock()
+	defer breaker.mux.Unlock()
+	breaker.probing = false
+	switch {
+	case err == nil:
+		breaker.failures, breaker.openUntil = 0, time.Time{}
+	case errors.Is(err, ErrCanceled), errors.Is(err, ErrBusy):
+	default:
+		if breaker.failures++; breaker.failures >= breaker.threshold || !breaker.openUntil.IsZero() {
+			breaker.openUntil = time.Now().Add(breaker.cooldown)
+		}
+	}
+}
+
+// Call 熔断时直接返回ErrCircuitOpen，否则向上游转发请求
+func (breaker *BreakerCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	return breaker.CallContext(context.Background(), request)
+}
+
+// CallContext 同Call，ctx会传递给被包裹的Caller
+func (breaker *BreakerCaller) CallContext(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error) {
+	if !breaker.allow() {
+		return nil, newCallError(ErrCircuitOpen, breaker.String(), fmt.Errorf("skip for %d consecutive failures", breaker.threshold))
+	}
+	r, err = CallContext(ctx, breaker.caller, request)
+	breaker.record(err)
+	return r, err
+}
+
+// Available 判断caller当前是否可用，caller或其包裹的任一层熔断器处于熔断状态时返回false
+func Available(caller Caller) bool {
+	for {
+		if breaker, ok := caller.(*BreakerCaller); ok && breaker.State() == BreakerOpen {
+			return false
+		}
+		wrapper, ok := caller.(interface{ Unwrap() Caller })
+		if !ok {
+			return true
+		}
+		caller = wrapper.Unwrap()
+	}
+}
+
+// Unwrap 逐层解开BreakerCaller等包裹类Caller，返回最内层的Caller
+func Unwrap(caller Caller) Caller {
+	for {
+		wrapper, ok := caller.(interface{ Unwrap() Caller })
+		if !ok {
+			return caller
+		}
+		caller = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,95 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// 按err决定成败的Caller，记录调用次数
+type switchCaller struct {
+	err   error
+	calls int
+}
+
+func (caller *switchCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	caller.calls++
+	if caller.err != nil {
+		return nil, caller.err
+	}
+	return new(dns.Msg).SetReply(request), nil
+}
+
+func (caller *switchCaller) String() string {
+	return "udp://1.1.1.1:53"
+}
+
+func TestBreakerCaller(t *testing.T) {
+	inner := &switchCaller{}
+	assert.Equal(t, inner, NewBreakerCaller(inner, 0, time.Second)) // 不熔断
+	caller := NewBreakerCaller(inner, 2, 20*time.Millisecond)
+	breaker := caller.(*BreakerCaller)
+	assert.Equal(t, "udp://1.1.1.1:53", breaker.String())
+	assert.Equal(t, inner, Unwrap(caller))
+	assert.Equal(t, inner, Unwrap(inner))
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+	// closed：未达到阈值时正常请求，成功后重新计数
+	inner.err = fmt.Errorf("err")
+	_, err := caller.Call(req)
+	assert.NotNil(t, err)
+	inner.err = nil
+	_, err = caller.Call(req)
+	assert.Nil(t, err)
+	inner.err = fmt.Errorf("err")
+	_, _ = caller.Call(req)
+	assert.Equal(t, BreakerClosed, breaker.State())
+	assert.True(t, Available(caller))
+	// 被取消的请求不计入失败
+	inner.err = newCallError(ErrCanceled, "", context.Canceled)
+	_, _ = caller.Call(req)
+	assert.Equal(t, BreakerClosed, breaker.State())
+	inner.err = newCallError(ErrBusy, "", fmt.Errorf("busy")) // 因并发上限未发出的请求同样不计入
+	_, _ = caller.Call(req)
+	assert.Equal(t, BreakerClosed, breaker.State())
+	// closed -> open：连续失败达到阈值
+	inner.err = fmt.Errorf("err")
+	_, _ = caller.Call(req)
+	assert.Equal(t, BreakerOpen, breaker.State())
+	assert.False(t, Available(caller))
+	assert.True(t, Available(inner))
+	// 熔断期间不请求上游
+	inner.calls = 0
+	_, err = caller.Call(req)
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, 0, inner.calls)
+
+	// open -> half-open -> open：探测失败时再次熔断
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	assert.True(t, Available(caller)) // 半开状态下放行探测请求
+	_, err = caller.Call(req)
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, 1, inner.calls)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	// open -> half-open -> closed：探测成功时恢复
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	assert.True(t, breaker.allow())
+	assert.False(t, breaker.allow()) // 半开状态下仅放行一个探测请求
+	breaker.probing = false
+	inner.err = nil
+	r, err := caller.Call(req)
+	assert.Nil(t, err)
+	assert.Equal(t, req.Id, r.Id)
+	assert.Equal(t, BreakerClosed, breaker.State())
+	// 恢复后需重新连续失败达到阈值才熔断
+	inner.err = fmt.Errorf("err")
+	_, _ = caller.Call(req)
+	assert.Equal(t, BreakerClosed, breaker.State())
+}
@@ -0,0 +1,79 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"syscall"
+)
+
+var (
+	// ErrTimeout 上游请求超时
+	ErrTimeout = errors.New("upstream timeout")
+	// ErrUpstreamRefused 上游拒绝服务，如拒绝连接、DoH服务器返回非200状态码
+	ErrUpstreamRefused = errors.New("upstream refused")
+	// ErrProtocol 报文打包/解包失败等协议错误
+	ErrProtocol = errors.New("upstream protocol error")
+	// ErrNetwork 其它网络错误，如代理连接失败、连接被重置
+	ErrNetwork = errors.New("upstream network error")
+	// ErrCanceled 请求在完成前被取消，如并发组中其它上游已率先返回
+	ErrCanceled = errors.New("upstream call canceled")
+	// ErrCircuitOpen 上游连续失败后处于熔断状态，请求未发出
+	ErrCircuitOpen = errors.New("upstream circuit open")
+	// ErrBusy 对该上游同时进行的请求数已达上限，请求未发出
+	ErrBusy = errors.New("upstream busy")
+)
+
+// CallError Caller请求失败时返回的错误，可通过errors.Is(err, ErrTimeout)等方式判断失败类型
+type CallError struct {
+	Kind   error  // ErrTimeout、ErrUpstreamRefused、ErrProtocol、ErrNetwork、ErrCanceled、ErrCircuitOpen、ErrBusy之一
+	Server string // 上游地址
+	Err    error  // 原始错误
+}
+
+// Error 实现error接口
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%s: %v: %v", e.Server, e.Kind, e.Err)
+}
+
+// Unwrap 返回原始错误
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// Is 判断失败类型是否为target
+func (e *CallError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// 生成指定类型的CallError
+func newCallError(kind error, server string, err error) error {
+	return &CallError{Kind: kind, Server: server, Err: err}
+}
+
+// 根据原始错误推断失败类型并包装为CallError，err为nil时返回nil
+func wrapCallError(server string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var callErr *CallError
+	if errors.As(err, &callErr) {
+		return err
+	}
+	var netErr net.Error
+	var dnsErr *dns.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return newCallError(ErrCanceled, server, err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return newCallError(ErrTimeout, server, err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return newCallError(ErrUpstreamRefused, server, err)
+	case errors.As(err, &dnsErr):
+		return newCallError(ErrProtocol, server, err)
+	default:
+		return newCallError(ErrNetwork, server, err)
+	}
+}
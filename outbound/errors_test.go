@@ -0,0 +1,112 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 总是返回错误的代理
+type failDialer struct{}
+
+func (d *failDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("proxy unavailable")
+}
+
+// 启动一个UDP服务器，收到请求时用reply生成响应，reply返回nil时不响应
+func newUDPServer(t *testing.T, reply func(req []byte) []byte) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := reply(buf[:n]); resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+func TestWrapCallError(t *testing.T) {
+	assert.Nil(t, wrapCallError("", nil))
+	err := wrapCallError("1.1.1.1:53", fmt.Errorf("err"))
+	assert.True(t, errors.Is(err, ErrNetwork))
+	assert.Equal(t, "1.1.1.1:53: upstream network error: err", err.Error())
+	assert.Equal(t, err, wrapCallError("", err)) // 不重复包装
+	err = wrapCallError("", context.DeadlineExceeded)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, errors.Is(wrapCallError("", dns.ErrId), ErrProtocol))
+	assert.True(t, errors.Is(wrapCallError("", context.Canceled), ErrCanceled))
+}
+
+func TestDNSCaller_Errors(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	// 上游不响应
+	silent := newUDPServer(t, func(req []byte) []byte { return nil })
+	defer func() { _ = silent.Close() }()
+	caller := NewDNSCaller(silent.LocalAddr().String(), "udp", nil)
+	caller.client.Timeout = 50 * time.Millisecond
+	_, err := caller.Call(req)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	// 上游响应无法解析的报文
+	garbage := newUDPServer(t, func(req []byte) []byte { return []byte{1, 2, 3} })
+	defer func() { _ = garbage.Close() }()
+	caller = NewDNSCaller(garbage.LocalAddr().String(), "udp", nil)
+	_, err = caller.Call(req)
+	assert.True(t, errors.Is(err, ErrProtocol))
+	// 上游拒绝连接
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	caller = NewDNSCaller(addr, "tcp", nil)
+	_, err = caller.Call(req)
+	assert.True(t, errors.Is(err, ErrUpstreamRefused))
+	// 代理连接失败
+	caller = NewDNSCaller(addr, "tcp", &failDialer{})
+	_, err = caller.Call(req)
+	assert.True(t, errors.Is(err, ErrNetwork))
+	var callErr *CallError
+	assert.True(t, errors.As(err, &callErr))
+	assert.Equal(t, "tcp://"+addr, callErr.Server)
+}
+
+func TestDoHCaller_Errors(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	caller, err := NewDoHCaller("https://localhost/dns-query", nil)
+	assert.Nil(t, err)
+	_, err = caller.Call(req) // 未调用Resolve
+	assert.True(t, errors.Is(err, ErrNetwork))
+
+	var status int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte{1, 2, 3})
+	}))
+	srv.StartTLS()
+	defer srv.Close()
+	caller, err = NewDoHCaller(srv.URL+"/dns-query", nil)
+	assert.Nil(t, err)
+	trustDoHServer(caller, srv)
+	// 非200状态码
+	status = http.StatusInternalServerError
+	_, err = caller.Call(req)
+	assert.True(t, errors.Is(err, ErrUpstreamRefused))
+	// 响应内容无法解析
+	status = http.StatusOK
+	_, err = caller.Call(req)
+	assert.True(t, errors.Is(err, ErrProtocol))
+}
@@ -0,0 +1,77 @@
+package outbound
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+)
+
+// connPool TCP/DoT连接池，限制空闲连接数及池内连接总数。达到总数上限时新请求使用不入池的临时连接
+type connPool struct {
+	dial     func() (*dns.Conn, error)
+	maxIdle  int
+	maxTotal int // 为0时不限制
+	mux      sync.Mutex
+	idle     []*dns.Conn
+	total    int // 池内连接数，包括空闲及使用中的连接
+}
+
+// 新建连接池，maxTotal不大于0时不限制连接总数
+func newConnPool(dial func() (*dns.Conn, error), maxIdle, maxTotal int) *connPool {
+	if maxTotal > 0 && maxIdle > maxTotal {
+		maxIdle = maxTotal
+	}
+	return &connPool{dial: dial, maxIdle: maxIdle, maxTotal: maxTotal}
+}
+
+// 取出一个连接：优先复用空闲连接，其次新建入池连接，达到上限时新建临时连接。reused代表是否为复用的空闲连接，
+// pooled代表用完后是否可归还
+func (pool *connPool) get() (co *dns.Conn, reused, pooled bool, err error) {
+	pool.mux.Lock()
+	if n := len(pool.idle); n > 0 {
+		co, pool.idle = pool.idle[n-1], pool.idle[:n-1]
+		pool.mux.Unlock()
+		return co, true, true, nil
+	}
+	if pooled = pool.maxTotal <= 0 || pool.total < pool.maxTotal; pooled {
+		pool.total++
+	}
+	pool.mux.Unlock()
+	if co, err = pool.dial(); err != nil {
+		if pooled {
+			pool.release()
+		}
+		return nil, false, false, err
+	}
+	return co, false, pooled, nil
+}
+
+// 归还连接，broken代表连接已不可用。临时连接、不可用的连接及超出空闲上限的连接会被关闭
+func (pool *connPool) put(co *dns.Conn, pooled, broken bool) {
+	if pooled && !broken {
+		pool.mux.Lock()
+		if len(pool.idle) < pool.maxIdle {
+			pool.idle = append(pool.idle, co)
+			pool.mux.Unlock()
+			return
+		}
+		pool.mux.Unlock()
+	}
+	_ = co.Close()
+	if pooled {
+		pool.release()
+	}
+}
+
+// 池内连接数减一
+func (pool *connPool) release() {
+	pool.mux.Lock()
+	pool.total--
+	pool.mux.Unlock()
+}
+
+// 返回空闲连接数及池内连接总数
+func (pool *connPool) stats() (idle, total int) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	return len(pool.idle), pool.total
+}
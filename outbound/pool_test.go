@@ -0,0 +1,117 @@
+package outbound
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 统计已接受连接数的Listener
+type countListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestConnPool(t *testing.T) {
+	var dialed int
+	pool := newConnPool(func() (*dns.Conn, error) {
+		dialed++
+		client, _ := net.Pipe()
+		return &dns.Conn{Conn: client}, nil
+	}, 1, 2)
+	// 达到总数上限后使用临时连接
+	co1, reused, pooled, err := pool.get()
+	assert.Nil(t, err)
+	assert.False(t, reused)
+	assert.True(t, pooled)
+	co2, _, pooled, _ := pool.get()
+	assert.True(t, pooled)
+	co3, _, pooled, _ := pool.get()
+	assert.False(t, pooled)
+	idle, total := pool.stats()
+	assert.Equal(t, 0, idle)
+	assert.Equal(t, 2, total)
+	// 归还后最多保留maxIdle个空闲连接
+	pool.put(co3, false, false)
+	pool.put(co1, true, false)
+	pool.put(co2, true, false)
+	idle, total = pool.stats()
+	assert.Equal(t, 1, idle)
+	assert.Equal(t, 1, total)
+	// 复用空闲连接
+	co, reused, pooled, _ := pool.get()
+	assert.True(t, reused)
+	assert.True(t, pooled)
+	assert.Equal(t, 3, dialed)
+	// 不可用的连接不再归还
+	pool.put(co, true, true)
+	idle, total = pool.stats()
+	assert.Equal(t, 0, idle)
+	assert.Equal(t, 0, total)
+	// 建立连接失败时不计入总数
+	pool.dial = func() (*dns.Conn, error) { return nil, fmt.Errorf("err") }
+	_, _, _, err = pool.get()
+	assert.NotNil(t, err)
+	_, total = pool.stats()
+	assert.Equal(t, 0, total)
+	// maxIdle不超过maxTotal
+	assert.Equal(t, 1, newConnPool(nil, 5, 1).maxIdle)
+}
+
+func TestDNSCaller_Pool(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listener := &countListener{Listener: tcpListener}
+	srv := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		_ = w.WriteMsg(new(dns.Msg).SetReply(req))
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+	caller := NewDNSCaller(listener.Addr().String(), "tcp", nil)
+	caller.SetPool(1, 2)
+	// 顺序请求复用同一连接
+	for i := 0; i < 5; i++ {
+		r, err := caller.Call(req)
+		assertSuccess(t, r, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&listener.accepted))
+	// 并发请求时池内连接数不超过上限，空闲连接数不超过maxIdle
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := caller.Call(req)
+			assertSuccess(t, r, err)
+		}()
+	}
+	wg.Wait()
+	idle, total := caller.pool.stats()
+	assert.Equal(t, 1, idle)
+	assert.Equal(t, 1, total)
+	// 空闲连接被上游关闭后使用新连接重试
+	_ = caller.pool.idle[0].Close()
+	r, err := caller.Call(req)
+	assertSuccess(t, r, err)
+
+	// UDP及使用代理的Caller不启用连接池
+	udpCaller := NewDNSCaller("127.0.0.1:53", "udp", nil)
+	udpCaller.SetPool(1, 2)
+	assert.Nil(t, udpCaller.pool)
+	caller.SetPool(0, 0)
+	assert.Nil(t, caller.pool)
+}
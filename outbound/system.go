@@ -0,0 +1,204 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// SystemTTL SystemCaller生成的记录的TTL（秒），net.Resolver不提供原始记录的TTL
+	SystemTTL = 60
+	// 单次系统解析的超时时间
+	systemTimeout = 5 * time.Second
+)
+
+var (
+	errEmptyQuestion  = errors.New("empty question")
+	errNotImplemented = errors.New("query type not supported by system resolver")
+)
+
+// SystemCaller 通过Go的net.Resolver（遵循操作系统的解析配置，如macOS的系统解析器、resolv.conf）解析请求。
+// 仅支持IN类的A、AAAA、CNAME、MX、NS、PTR、SRV、TXT请求，其余请求返回NOTIMP
+type SystemCaller struct {
+	resolver *net.Resolver
+}
+
+// NewSystemCaller 创建一个SystemCaller，resolver为nil时使用net.DefaultResolver
+func NewSystemCaller(resolver *net.Resolver) *SystemCaller {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &SystemCaller{resolver: resolver}
+}
+
+// String 实现fmt.Stringer接口
+func (caller *SystemCaller) String() string {
+	return "system://"
+}
+
+// Call 通过系统解析器解析请求，失败时返回CallError
+func (caller *SystemCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	return caller.CallContext(context.Background(), request)
+}
+
+// CallContext 同Call，ctx被取消时返回ErrCanceled。net.Resolver无法区分NXDOMAIN与无对应类型的记录，
+// 因此仅A/AAAA请求在地址不存在时返回NXDOMAIN，其余类型返回无应答记录的NOERROR响应
+func (caller *SystemCaller) CallContext(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error) {
+	if len(request.Question) == 0 {
+		return nil, newCallError(ErrProtocol, caller.String(), errEmptyQuestion)
+	}
+	ctx, cancel := context.WithTimeout(ctx, systemTimeout)
+	defer cancel()
+	question := request.Question[0]
+	r = new(dns.Msg).SetReply(request)
+	r.RecursionAvailable = true
+	if question.Qclass != dns.ClassINET {
+		r.Rcode = dns.RcodeNotImplemented
+		return r, nil
+	}
+	if r.Answer, err = caller.lookup(ctx, question); err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
+				r.Rcode = dns.RcodeNameError
+			}
+			return r, nil
+		}
+		if err == errNotImplemented {
+			r.Rcode = dns.RcodeNotImplemented
+			return r, nil
+		}
+		if ctx.Err() == context.Canceled {
+			return nil, newCallError(ErrCanceled, caller.String(), err)
+		}
+		return nil, wrapCallError(caller.String(), err)
+	}
+	return r, nil
+}
+
+// 按请求类型调用net.Resolver并将结果转换为dns记录
+func (caller *SystemCaller) lookup(ctx context.Context, question dns.Question) (rrs []dns.RR, err error) {
+	name := question.Name
+	hdr := func(rrType uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrType, Class: dns.ClassINET, Ttl: SystemTTL}
+	}
+	switch question.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		var addrs []net.IPAddr
+		if addrs, err = caller.resolver.LookupIPAddr(ctx, name); err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ip := addr.IP.To4(); ip != nil && question.Qtype == dns.TypeA {
+				rrs = append(rrs, &dns.A{Hdr: hdr(dns.TypeA), A: ip})
+			} else if ip == nil && question.Qtype == dns.TypeAAAA {
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: addr.IP})
+			}
+		}
+	case dns.TypeCNAME:
+		var target string
+		if target, err = caller.resolver.LookupCNAME(ctx, name); err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(dns.Fqdn(target), name) { // 无CNAME时返回域名本身
+			rrs = append(rrs, &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: dns.Fqdn(target)})
+		}
+	case dns.TypeMX:
+		var mxs []*net.MX
+		if mxs, err = caller.resolver.LookupMX(ctx, name); err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			rrs = append(rrs, &dns.MX{Hdr: hdr(dns.TypeMX), Preference: mx.Pref, Mx: dns.Fqdn(mx.Host)})
+		}
+	case dns.TypeNS:
+		var nss []*net.NS
+		if nss, err = caller.resolver.LookupNS(ctx, name); err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			rrs = append(rrs, &dns.NS{Hdr: hdr(dns.TypeNS), Ns: dns.Fqdn(ns.Host)})
+		}
+	case dns.TypeTXT:
+		var txts []string
+		if txts, err = caller.resolver.LookupTXT(ctx, name); err != nil {
+			return nil, err
+		}
+		for _, txt := range txts {
+			rrs = append(rrs, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: splitTXT(txt)})
+		}
+	case dns.TypeSRV:
+		var srvs []*net.SRV
+		if _, srvs, err = caller.resolver.LookupSRV(ctx, "", "", name); err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			rrs = append(rrs, &dns.SRV{Hdr: hdr(dns.TypeSRV), Priority: srv.Priority, Weight: srv.Weight,
+				Port: srv.Port, Target: dns.Fqdn(srv.Target)})
+		}
+	case dns.TypePTR:
+		ip := reverseAddr(name)
+		if ip == "" {
+			return nil, errNotImplemented
+		}
+		var hosts []string
+		if hosts, err = caller.resolver.LookupAddr(ctx, ip); err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			rrs = append(rrs, &dns.PTR{Hdr: hdr(dns.TypePTR), Ptr: dns.Fqdn(host)})
+		}
+	default:
+		return nil, errNotImplemented
+	}
+	return rrs, nil
+}
+
+// net.Resolver会合并TXT记录中的多个字符串，重新按255字节拆分以便打包
+func splitTXT(txt string) (parts []string) {
+	for len(txt) > 255 {
+		parts, txt = append(parts, txt[:255]), txt[255:]
+	}
+	return append(parts, txt)
+}
+
+// 将in-addr.arpa./ip6.arpa.格式的反向解析域名转换为ip地址，格式不正确时返回空串
+func reverseAddr(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	var labels []string
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != 4 {
+			return ""
+		}
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) != 32 {
+			return ""
+		}
+	default:
+		return ""
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	var addr string
+	if len(labels) == 4 {
+		addr = strings.Join(labels, ".")
+	} else {
+		for i := 0; i < 32; i += 4 {
+			if i > 0 {
+				addr += ":"
+			}
+			addr += strings.Join(labels[i:i+4], "")
+		}
+	}
+	if net.ParseIP(addr) == nil {
+		return ""
+	}
+	return addr
+}
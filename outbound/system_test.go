@@ -0,0 +1,99 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// 创建通过Dial将请求发往本地测试服务器的net.Resolver
+func mockResolver(t *testing.T, handler dns.HandlerFunc) (resolver *net.Resolver, shutdown func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := &dns.Server{PacketConn: conn, Handler: handler}
+	go func() { _ = srv.ActivateAndServe() }()
+	resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, "udp", conn.LocalAddr().String())
+	}}
+	return resolver, func() { _ = srv.Shutdown() }
+}
+
+func TestSystemCaller(t *testing.T) {
+	resolver, shutdown := mockResolver(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		r := new(dns.Msg).SetReply(req)
+		question := req.Question[0]
+		var record string
+		switch {
+		case question.Name == "noexist.test.":
+			r.Rcode = dns.RcodeNameError
+		case question.Qtype == dns.TypeA:
+			record = question.Name + " 300 IN A 1.2.3.4"
+		case question.Qtype == dns.TypeAAAA:
+			record = question.Name + " 300 IN AAAA ::1"
+		case question.Qtype == dns.TypeMX:
+			record = question.Name + " 300 IN MX 10 mail.test."
+		case question.Qtype == dns.TypeTXT:
+			record = question.Name + ` 300 IN TXT "hello" "world"`
+		case question.Qtype == dns.TypePTR:
+			record = question.Name + " 300 IN PTR host.test."
+		}
+		if record != "" {
+			rr, _ := dns.NewRR(record)
+			r.Answer = []dns.RR{rr}
+		}
+		_ = w.WriteMsg(r)
+	})
+	defer shutdown()
+	caller := NewSystemCaller(resolver)
+	assert.Equal(t, "system://", caller.String())
+	call := func(name string, qtype uint16) *dns.Msg {
+		r, err := caller.Call(new(dns.Msg).SetQuestion(name, qtype))
+		assert.Nil(t, err)
+		return r
+	}
+
+	r := call("www.test.", dns.TypeA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "1.2.3.4", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(SystemTTL), r.Answer[0].Header().Ttl)
+	r = call("www.test.", dns.TypeAAAA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "::1", r.Answer[0].(*dns.AAAA).AAAA.String())
+	r = call("www.test.", dns.TypeMX)
+	assert.Equal(t, "mail.test.", r.Answer[0].(*dns.MX).Mx)
+	r = call("www.test.", dns.TypeTXT)
+	assert.Equal(t, []string{"helloworld"}, r.Answer[0].(*dns.TXT).Txt)
+	r = call("4.3.2.1.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, "host.test.", r.Answer[0].(*dns.PTR).Ptr)
+	// 地址不存在时返回NXDOMAIN
+	r = call("noexist.test.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	// 不支持的类型返回NOTIMP
+	r = call("www.test.", dns.TypeHINFO)
+	assert.Equal(t, dns.RcodeNotImplemented, r.Rcode)
+	_, err := caller.Call(new(dns.Msg))
+	assert.True(t, errors.Is(err, ErrProtocol))
+
+	// 上游无响应时返回超时或取消错误
+	timeoutResolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, _ := net.Pipe()
+		return client, nil
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = NewSystemCaller(timeoutResolver).CallContext(ctx, new(dns.Msg).SetQuestion("www.test.", dns.TypeA))
+	assert.True(t, errors.Is(err, ErrTimeout), err)
+}
+
+func TestReverseAddr(t *testing.T) {
+	assert.Equal(t, "1.2.3.4", reverseAddr("4.3.2.1.in-addr.arpa."))
+	assert.Equal(t, "0000:0000:0000:0000:0000:0000:0000:0001",
+		reverseAddr("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."))
+	assert.Equal(t, "", reverseAddr("3.2.1.in-addr.arpa."))
+	assert.Equal(t, "", reverseAddr("a.3.2.1.in-addr.arpa."))
+	assert.Equal(t, "", reverseAddr("example.com."))
+}
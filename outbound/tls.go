@@ -0,0 +1,150 @@
+package outbound
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// DefaultTLSMinVersion DoT、DoH上游默认的最低TLS版本
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+// 每个DoT Caller缓存的TLS会话数，同一Caller的连接共享
+const dotSessionCacheSize = 8
+
+// TLSOptions DoT、DoH上游的TLS参数，字段为0或nil时使用默认值
+type TLSOptions struct {
+	MinVersion   uint16   // 为0时使用DefaultTLSMinVersion
+	MaxVersion   uint16   // 为0时不限制
+	CipherSuites []uint16 // TLS 1.2及以下使用的加密套件，TLS 1.3的加密套件不可配置
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13,
+}
+
+// 可配置的加密套件，按IANA名称索引。不包括RC4、3DES等不安全的套件
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// ParseTLSVersion 将"1.0"~"1.3"转换为TLS版本号，为空时返回0
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown tls version: %s", version)
+}
+
+// ParseCipherSuites 将IANA名称（如"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"，不区分大小写）转换为加密套件列表
+func ParseCipherSuites(names []string) (suites []uint16, err error) {
+	for _, name := range names {
+		suite, ok := cipherSuites[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", name)
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// 返回生效的最低TLS版本
+func (opts TLSOptions) minVersion() uint16 {
+	if opts.MinVersion == 0 {
+		return DefaultTLSMinVersion
+	}
+	return opts.MinVersion
+}
+
+// Validate 校验TLS版本范围，最低版本大于最高版本时返回错误
+func (opts TLSOptions) Validate() error {
+	if min := opts.minVersion(); opts.MaxVersion != 0 && min > opts.MaxVersion {
+		return fmt.Errorf("tls min version %#x is greater than max version %#x", min, opts.MaxVersion)
+	}
+	return nil
+}
+
+// 将TLS参数写入config
+func (opts TLSOptions) apply(config *tls.Config) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	config.MinVersion, config.MaxVersion, config.CipherSuites = opts.minVersion(), opts.MaxVersion, opts.CipherSuites
+	return nil
+}
+
+// 返回DoT Caller的TLS会话在ClientSessionCache中的key，规则同crypto/tls：优先使用ServerName，否则为服务器地址中的主机名
+func (caller *DNSCaller) sessionKey() string {
+	if name := caller.client.TLSConfig.ServerName; name != "" {
+		return name
+	}
+	host, _, err := net.SplitHostPort(caller.server)
+	if err != nil {
+		return caller.server
+	}
+	return host
+}
+
+// 判断DoT Caller是否缓存了可用于恢复的TLS会话，非DoT Caller总是返回false
+func (caller *DNSCaller) hasSession() bool {
+	if caller.client.TLSConfig == nil || caller.client.TLSConfig.ClientSessionCache == nil {
+		return false
+	}
+	_, ok := caller.client.TLSConfig.ClientSessionCache.Get(caller.sessionKey())
+	return ok
+}
+
+// 清除DoT Caller缓存的TLS会话，使下次连接使用完整握手
+func (caller *DNSCaller) dropSession() {
+	if caller.client.TLSConfig != nil && caller.client.TLSConfig.ClientSessionCache != nil {
+		caller.client.TLSConfig.ClientSessionCache.Put(caller.sessionKey(), nil)
+	}
+}
+
+// DoT连接的TLS握手失败，用于区分握手失败与连接建立后的请求失败
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string {
+	return "tls handshake: " + e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// 使用client建立到上游的连接。DoT连接的TCP连接建立后TLS握手失败时返回handshakeError
+func (caller *DNSCaller) dial(client *dns.Client) (*dns.Conn, error) {
+	co, err := client.Dial(caller.server)
+	var opErr *net.OpError
+	if err != nil && client.TLSConfig != nil && !(errors.As(err, &opErr) && opErr.Op == "dial") {
+		return nil, &handshakeError{err: err} // TCP连接建立失败时返回Op为"dial"的*net.OpError
+	}
+	return co, err
+}
+
+// 判断err是否为TLS握手失败
+func isHandshakeError(err error) bool {
+	var hsErr *handshakeError
+	return errors.As(err, &hsErr)
+}
@@ -0,0 +1,163 @@
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseTLSOptions(t *testing.T) {
+	version, err := ParseTLSVersion("")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0), version)
+	version, err = ParseTLSVersion("1.3")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+	_, err = ParseTLSVersion("1.4")
+	assert.NotNil(t, err)
+
+	suites, err := ParseCipherSuites([]string{"tls_ecdhe_rsa_with_aes_128_gcm_sha256",
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305}, suites)
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}) // 不安全的套件
+	assert.NotNil(t, err)
+	_, err = ParseCipherSuites([]string{"TLS_AES_128_GCM_SHA256"}) // TLS 1.3的套件不可配置
+	assert.NotNil(t, err)
+
+	// 默认最低版本为TLS 1.2
+	config := &tls.Config{}
+	assert.Nil(t, TLSOptions{}.apply(config))
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.NotNil(t, TLSOptions{MaxVersion: tls.VersionTLS11}.Validate())
+	assert.Nil(t, TLSOptions{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}.Validate())
+}
+
+func TestDoHCaller_TLSOptions(t *testing.T) {
+	// 仅支持TLS 1.2的服务器
+	srv := newUnstartedDoHServer(t, func(*http.Request, []byte) {})
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	caller, err := NewDoHCaller(srv.URL+"/dns-query", nil)
+	assert.Nil(t, err)
+	trustDoHServer(caller, srv)
+	r, err := caller.Call(req)
+	assertSuccess(t, r, err)
+	// 仅允许TLS 1.3的Caller握手失败
+	caller, _ = NewDoHCaller(srv.URL+"/dns-query", nil)
+	assert.Nil(t, caller.SetTLSOptions(TLSOptions{MinVersion: tls.VersionTLS13}))
+	trustDoHServer(caller, srv)
+	_, err = caller.Call(req)
+	assert.NotNil(t, err)
+	assert.NotNil(t, caller.SetTLSOptions(TLSOptions{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS12}))
+}
+
+func TestDoTCaller_TLSOptions(t *testing.T) {
+	// 借用httptest的证书（签发给example.com）启动仅支持TLS 1.2的DoT服务器
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: certSrv.TLS.Certificates, MaxVersion: tls.VersionTLS12})
+	assert.Nil(t, err)
+	srv := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		_ = w.WriteMsg(new(dns.Msg).SetReply(req))
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+	certPool := x509.NewCertPool()
+	certPool.AddCert(certSrv.Certificate())
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	newCaller := func(opts TLSOptions) *DNSCaller {
+		caller := NewDoTCaller(listener.Addr().String(), "example.com", nil)
+		assert.Nil(t, caller.SetTLSOptions(opts))
+		caller.client.TLSConfig.RootCAs = certPool
+		return caller
+	}
+	r, err := newCaller(TLSOptions{}).Call(req)
+	assertSuccess(t, r, err)
+	_, err = newCaller(TLSOptions{MinVersion: tls.VersionTLS13}).Call(req)
+	assert.NotNil(t, err)
+	// 非DoT Caller不受影响
+	assert.Nil(t, NewDNSCaller("127.0.0.1:53", "udp", nil).SetTLSOptions(TLSOptions{MinVersion: tls.VersionTLS13}))
+}
+
+func TestDoTCaller_SessionResumption(t *testing.T) {
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	// 第failAt次握手失败，模拟使会话票据失效后直接断开连接的服务器
+	var handshakes, failAt int32
+	config := &tls.Config{Certificates: certSrv.TLS.Certificates}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		if n := atomic.AddInt32(&handshakes, 1); n == atomic.LoadInt32(&failAt) {
+			return nil, errors.New("ticket rejected")
+		}
+		return nil, nil
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	assert.Nil(t, err)
+	var queries, drop int32 // drop不为0时不响应请求直接断开连接
+	srv := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		if atomic.LoadInt32(&drop) != 0 {
+			_ = w.Close()
+			return
+		}
+		_ = w.WriteMsg(new(dns.Msg).SetReply(req))
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+	certPool := x509.NewCertPool()
+	certPool.AddCert(certSrv.Certificate())
+	req := new(dns.Msg).SetQuestion("ip.cn.", dns.TypeA)
+
+	caller := NewDoTCaller(listener.Addr().String(), "example.com", nil)
+	caller.client.TLSConfig.RootCAs = certPool
+	caller.SetPool(1, 1)
+	didResume := func() bool {
+		idle := caller.pool.idle[0]
+		resumed := idle.Conn.(*tls.Conn).ConnectionState().DidResume
+		_ = idle.Close() // 关闭连接，使下次请求重新建立连接
+		caller.pool.idle, caller.pool.total = nil, 0
+		return resumed
+	}
+	// 首次连接为完整握手，之后的连接恢复已缓存的会话
+	assert.False(t, caller.hasSession())
+	r, err := caller.Call(req)
+	assertSuccess(t, r, err)
+	assert.False(t, didResume())
+	assert.True(t, caller.hasSession())
+	r, err = caller.Call(req)
+	assertSuccess(t, r, err)
+	assert.True(t, didResume())
+
+	// 恢复会话的握手失败时清除会话并使用新连接重试
+	atomic.StoreInt32(&failAt, atomic.LoadInt32(&handshakes)+1)
+	r, err = caller.Call(req)
+	assertSuccess(t, r, err)
+	assert.False(t, didResume())
+	assert.Equal(t, atomic.LoadInt32(&failAt)+1, atomic.LoadInt32(&handshakes))
+
+	// 握手成功后的请求失败不重试，也不清除会话
+	atomic.StoreInt32(&drop, 1)
+	before := atomic.LoadInt32(&queries)
+	_, err = caller.Call(req)
+	assert.True(t, errors.Is(err, ErrNetwork))
+	assert.Equal(t, before+1, atomic.LoadInt32(&queries))
+	assert.True(t, caller.hasSession())
+	caller.pool.idle, caller.pool.total = nil, 0
+
+	// 非DoT Caller不缓存会话
+	udp := NewDNSCaller("127.0.0.1:53", "udp", nil)
+	assert.False(t, udp.hasSession())
+	udp.dropSession()
+}